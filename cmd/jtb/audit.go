@@ -0,0 +1,26 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+
+	"github.com/andrebq/jtb/engine"
+	"github.com/rs/zerolog"
+)
+
+// openAudit sends the audit events of e to o.audit, if set
+func (o *engineOptions) openAudit(e *engine.E) error {
+	if o.audit == "" {
+		return nil
+	}
+	if err := os.MkdirAll(filepath.Dir(o.audit), 0700); err != nil {
+		return err
+	}
+	file, err := os.OpenFile(o.audit, os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0600)
+	if err != nil {
+		return err
+	}
+	o.auditFile = file
+	e.SetAudit(engine.AuditToLogger(zerolog.New(e.RedactWriter(file))))
+	return nil
+}
@@ -0,0 +1,50 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"os"
+
+	"github.com/andrebq/jtb/engine"
+)
+
+func check(args []string) error {
+	flags := flag.NewFlagSet("check", flag.ExitOnError)
+	var opts engineOptions
+	opts.register(flags)
+	format := flags.String("format", "text", "Output format: text or json")
+	flags.Parse(args)
+	if flags.NArg() == 0 {
+		return fmt.Errorf("usage: jtb check [flags] script.js")
+	}
+
+	e, script, err := opts.open(flags.Arg(0), false)
+	if err != nil {
+		return err
+	}
+	defer opts.close(e)
+	diags := e.Check(script)
+	switch *format {
+	case "text":
+		for _, d := range diags {
+			fmt.Fprintln(os.Stdout, d)
+		}
+	case "json":
+		enc := json.NewEncoder(os.Stdout)
+		enc.SetIndent("", "  ")
+		if diags == nil {
+			diags = []engine.Diagnostic{}
+		}
+		if err := enc.Encode(diags); err != nil {
+			return err
+		}
+	default:
+		return fmt.Errorf("unknown format %v", *format)
+	}
+	if engine.HasErrors(diags) {
+		return errors.New("check failed")
+	}
+	return nil
+}
@@ -0,0 +1,122 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+
+	"github.com/andrebq/jtb/engine"
+)
+
+func deps(args []string) error {
+	flags := flag.NewFlagSet("deps", flag.ExitOnError)
+	var opts engineOptions
+	opts.register(flags)
+	format := flags.String("format", "tree", "Output format: tree, json or dot")
+	flags.Parse(args)
+	if flags.NArg() == 0 {
+		return fmt.Errorf("usage: jtb deps [flags] script.js")
+	}
+
+	e, script, err := opts.open(flags.Arg(0), false)
+	if err != nil {
+		return err
+	}
+	defer opts.close(e)
+	// the script is never executed, only requires using string literals
+	// are part of the graph. Problems are reported after the graph.
+	modules, diags := e.Dependencies(script)
+	switch *format {
+	case "tree":
+		printTree(os.Stdout, modules)
+	case "json":
+		enc := json.NewEncoder(os.Stdout)
+		enc.SetIndent("", "  ")
+		if err := enc.Encode(modules); err != nil {
+			return err
+		}
+	case "dot":
+		printDot(os.Stdout, modules)
+	default:
+		return fmt.Errorf("unknown format %v", *format)
+	}
+	for _, d := range diags {
+		fmt.Fprintln(os.Stderr, d)
+	}
+	if engine.HasErrors(diags) {
+		return errors.New("unable to find every dependency")
+	}
+	return nil
+}
+
+func moduleLabel(m engine.ModuleInfo) string {
+	label := fmt.Sprintf("%v (%v)", m.Resolved, m.Trust)
+	if m.Trust == engine.TrustRemote {
+		label += " [REMOTE]"
+	}
+	if m.Dangerous {
+		label += " [DANGEROUS]"
+	}
+	return label
+}
+
+func printTree(out io.Writer, modules []engine.ModuleInfo) {
+	byName := map[string]engine.ModuleInfo{}
+	children := map[string][]string{}
+	for _, m := range modules {
+		byName[m.Resolved] = m
+		for _, imp := range m.Importers {
+			children[imp] = append(children[imp], m.Resolved)
+		}
+	}
+	var walk func(name string, prefix string, last bool, visiting map[string]bool)
+	walk = func(name string, prefix string, last bool, visiting map[string]bool) {
+		branch, next := "├── ", "│   "
+		if last {
+			branch, next = "└── ", "    "
+		}
+		if visiting[name] {
+			fmt.Fprintf(out, "%v%v%v (cycle)\n", prefix, branch, name)
+			return
+		}
+		fmt.Fprintf(out, "%v%v%v\n", prefix, branch, moduleLabel(byName[name]))
+		visiting[name] = true
+		for i, c := range children[name] {
+			walk(c, prefix+next, i == len(children[name])-1, visiting)
+		}
+		delete(visiting, name)
+	}
+	for _, root := range children[""] {
+		fmt.Fprintln(out, moduleLabel(byName[root]))
+		for i, c := range children[root] {
+			walk(c, "", i == len(children[root])-1, map[string]bool{root: true})
+		}
+	}
+}
+
+func printDot(out io.Writer, modules []engine.ModuleInfo) {
+	fmt.Fprintln(out, "digraph jtb {")
+	for _, m := range modules {
+		attrs := []string{fmt.Sprintf("label=%q", fmt.Sprintf("%v\n(%v)", m.Resolved, m.Trust))}
+		switch {
+		case m.Dangerous:
+			attrs = append(attrs, "color=red", "style=filled", "fillcolor=mistyrose")
+		case m.Trust == engine.TrustRemote:
+			attrs = append(attrs, "color=orange", "style=filled", "fillcolor=lightyellow")
+		}
+		fmt.Fprintf(out, "  %q [%v];\n", m.Resolved, strings.Join(attrs, ", "))
+	}
+	for _, m := range modules {
+		for _, imp := range m.Importers {
+			if imp == "" {
+				continue
+			}
+			fmt.Fprintf(out, "  %q -> %q;\n", imp, m.Resolved)
+		}
+	}
+	fmt.Fprintln(out, "}")
+}
@@ -0,0 +1,96 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+
+	"github.com/andrebq/jtb/engine"
+	"github.com/rs/zerolog"
+)
+
+func defaultLogFile() string {
+	dir, err := os.UserCacheDir()
+	if err != nil {
+		return ""
+	}
+	return filepath.Join(dir, "jtb", "jtb.log")
+}
+
+// openLog sends the logs of e to o.log, if set
+func (o *engineOptions) openLog(e *engine.E) error {
+	if o.log == "" {
+		return nil
+	}
+	if err := os.MkdirAll(filepath.Dir(o.log), 0700); err != nil {
+		return err
+	}
+	file, err := os.OpenFile(o.log, os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0600)
+	if err != nil {
+		return err
+	}
+	o.logFile = file
+	e.SetLogger(zerolog.New(e.RedactWriter(file)).With().Timestamp().Logger())
+	return nil
+}
+
+// showErrors prints the log entries of the given error ids
+func showErrors(args []string) error {
+	flags := flag.NewFlagSet("errors", flag.ExitOnError)
+	log := flags.String("log", defaultLogFile(), "Log file written by jtb run")
+	flags.Parse(args)
+	if flags.NArg() == 0 {
+		return fmt.Errorf("usage: jtb errors [-log file] error-id...")
+	}
+	wanted := map[string]bool{}
+	for _, id := range flags.Args() {
+		wanted[id] = false
+	}
+
+	file, err := os.Open(*log)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+	scanner := bufio.NewScanner(file)
+	scanner.Buffer(nil, 1<<20)
+	for scanner.Scan() {
+		var entry map[string]interface{}
+		if json.Unmarshal(scanner.Bytes(), &entry) != nil {
+			continue
+		}
+		id, _ := entry[engine.ErrorIDField].(string)
+		if _, ok := wanted[id]; !ok {
+			continue
+		}
+		wanted[id] = true
+		printLogEntry(entry)
+	}
+	if err := scanner.Err(); err != nil {
+		return err
+	}
+	for id, found := range wanted {
+		if !found {
+			return fmt.Errorf("error %v not found in %v", id, *log)
+		}
+	}
+	return nil
+}
+
+func printLogEntry(entry map[string]interface{}) {
+	fmt.Fprintf(os.Stdout, "%v\n", entry[engine.ErrorIDField])
+	keys := make([]string, 0, len(entry))
+	for k := range entry {
+		if k != engine.ErrorIDField {
+			keys = append(keys, k)
+		}
+	}
+	sort.Strings(keys)
+	for _, k := range keys {
+		fmt.Fprintf(os.Stdout, "  %v: %v\n", k, entry[k])
+	}
+}
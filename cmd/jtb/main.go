@@ -0,0 +1,250 @@
+// Command jtb runs javascript files using the jtb engine
+package main
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"os/signal"
+	"path/filepath"
+	"strings"
+	"syscall"
+
+	"github.com/andrebq/jtb/engine"
+	"github.com/rs/zerolog"
+)
+
+type (
+	stringList []string
+
+	// engineOptions are the flags shared by every command that runs a script
+	engineOptions struct {
+		anchor     string
+		unrestrict stringList
+		yes        bool
+		approvals  string
+		lockdown   bool
+		isolate    bool
+		log        string
+		audit      string
+		execPolicy string
+
+		consoleLevel string
+		consoleLog   bool
+
+		env stringList
+
+		logFile   *os.File
+		auditFile *os.File
+	}
+)
+
+func (s *stringList) String() string     { return strings.Join(*s, ",") }
+func (s *stringList) Set(v string) error { *s = append(*s, v); return nil }
+
+func main() {
+	engine.ExecLimitsHelper()
+	args := os.Args[1:]
+	cmd := "run"
+	if len(args) > 0 && !strings.HasPrefix(args[0], "-") && !strings.Contains(args[0], ".") {
+		cmd, args = args[0], args[1:]
+	}
+	var err error
+	switch cmd {
+	case "run":
+		err = run(args)
+	case "check":
+		err = check(args)
+	case "deps":
+		err = deps(args)
+	case "errors":
+		err = showErrors(args)
+	default:
+		err = fmt.Errorf("unknown command %v", cmd)
+	}
+	var exit *engine.ExitError
+	if errors.As(err, &exit) {
+		os.Exit(exit.Code)
+	}
+	if err != nil {
+		fmt.Fprint(os.Stderr, engine.FormatError(err))
+		os.Exit(1)
+	}
+}
+
+func (o *engineOptions) register(flags *flag.FlagSet) {
+	flags.StringVar(&o.anchor, "anchor", "", "Directory used to anchor local modules, defaults to the directory of the script")
+	flags.Var(&o.unrestrict, "unrestrict", "Builtin module that local scripts are allowed to use (eg.: @rawexec), can be repeated")
+	flags.BoolVar(&o.lockdown, "lockdown", false, "Freeze all javascript intrinsics and deny eval/Function to remote modules")
+	flags.BoolVar(&o.isolate, "isolate", false, "Run each remote origin in its own runtime, exposing only copies of its exports")
+	flags.StringVar(&o.log, "log", defaultLogFile(), "File that receives the engine logs, including the cause of errors shown as error ids")
+	flags.StringVar(&o.audit, "audit", "", "File that receives an entry for every sensitive operation (dangerous requires, processes, downloads)")
+	flags.StringVar(&o.execPolicy, "exec-policy", "", "YAML file listing the binaries (and arguments) @rawexec is allowed to run")
+	flags.StringVar(&o.consoleLevel, "console-level", "trace", "Minimum level printed by console (trace, debug, info, warn, error)")
+	flags.BoolVar(&o.consoleLog, "console-log", false, "Send console messages to the log file instead of stderr")
+	flags.Var(&o.env, "env", "Environment variable (or pattern, eg.: AWS_*) visible to the script through @process, can be repeated")
+	flags.BoolVar(&o.yes, "yes", false, "Grant the permissions requested by the script without asking")
+	flags.StringVar(&o.approvals, "approvals", defaultApprovalsFile(), "File used to remember approved permissions, empty to disable it")
+}
+
+func run(args []string) error {
+	flags := flag.NewFlagSet("run", flag.ExitOnError)
+	var opts engineOptions
+	opts.register(flags)
+	flags.Parse(args)
+	if flags.NArg() == 0 {
+		return fmt.Errorf("usage: jtb run [flags] script.js [args...]")
+	}
+
+	e, script, err := opts.open(flags.Arg(0), true)
+	if err != nil {
+		return err
+	}
+	defer opts.close(e)
+	e.SetArgs(flags.Args()[1:])
+	killOnSignal(e)
+	err = runScript(e, script)
+	var exit *engine.ExitError
+	if !errors.As(err, &exit) {
+		code := 0
+		if err != nil {
+			code = 1
+		}
+		if hookErr := e.RunExitHooks(code); errors.As(hookErr, &exit) || err == nil {
+			err = hookErr
+		}
+	}
+	if errors.As(err, &exit) {
+		return err
+	}
+	if err != nil {
+		// errors might contain the output of processes that received secrets
+		return errors.New(strings.TrimSuffix(e.Redact(engine.FormatError(err)), "\n"))
+	}
+	return nil
+}
+
+// killOnSignal kills the processes started by the script when jtb is
+// interrupted, they run in their own process groups so they don't
+// receive the signals sent by the terminal
+func killOnSignal(e *engine.E) {
+	sigs := make(chan os.Signal, 1)
+	signal.Notify(sigs, os.Interrupt, syscall.SIGTERM)
+	go func() {
+		sig := <-sigs
+		e.KillProcesses()
+		code := 143
+		if sig == os.Interrupt {
+			code = 130
+		}
+		os.Exit(code)
+	}()
+}
+
+// useColors returns true if f is a terminal and colors
+// were not disabled with NO_COLOR (https://no-color.org)
+func useColors(f *os.File) bool {
+	if _, ok := os.LookupEnv("NO_COLOR"); ok {
+		return false
+	}
+	stat, err := f.Stat()
+	return err == nil && stat.Mode()&os.ModeCharDevice != 0
+}
+
+// close the engine, the log and audit files
+func (o *engineOptions) close(e *engine.E) {
+	e.Close()
+	for _, f := range []*os.File{o.logFile, o.auditFile} {
+		if f != nil {
+			f.Close()
+		}
+	}
+}
+
+func runScript(e *engine.E, script string) error {
+	_, err := e.InteractiveEval(fmt.Sprintf("require(%q)", script))
+	return err
+}
+
+// open returns an engine anchored at o.anchor (or the directory of script)
+// and the path to script relative to the anchor.
+//
+// The engine is granted the permissions requested by the script,
+// if approve is true the user must accept them first.
+func (o *engineOptions) open(script string, approve bool) (*engine.E, string, error) {
+	m, err := readManifest(script)
+	if err != nil {
+		return nil, "", err
+	}
+	if approve {
+		if err := o.approve(m); err != nil {
+			return nil, "", err
+		}
+	}
+	anchor := o.anchor
+	absScript, err := filepath.Abs(script)
+	if err != nil {
+		return nil, "", err
+	}
+	if anchor == "" {
+		anchor = filepath.Dir(absScript)
+	}
+	anchor, err = filepath.Abs(anchor)
+	if err != nil {
+		return nil, "", err
+	}
+	rel, err := filepath.Rel(anchor, absScript)
+	if err != nil || strings.HasPrefix(rel, "..") {
+		return nil, "", fmt.Errorf("script %v is not inside the anchor %v", script, anchor)
+	}
+	e, err := engine.New()
+	if err != nil {
+		return nil, "", err
+	}
+	if err := e.AnchorModules(anchor); err != nil {
+		o.close(e)
+		return nil, "", err
+	}
+	if err := o.openLog(e); err != nil {
+		o.close(e)
+		return nil, "", err
+	}
+	if err := o.openAudit(e); err != nil {
+		o.close(e)
+		return nil, "", err
+	}
+	// engine.Close closes the streams, but the CLI still needs
+	// them to report errors
+	e.ConnectStdio(struct{ io.Reader }{os.Stdin}, struct{ io.Writer }{os.Stdout}, struct{ io.Writer }{os.Stderr})
+	e.UseColors(useColors(os.Stdout), useColors(os.Stderr))
+	for _, m := range o.unrestrict {
+		e.Unrestrict(m)
+	}
+	if err := e.Grant(m.perms); err != nil {
+		o.close(e)
+		return nil, "", err
+	}
+	if err := o.applyExecPolicy(e); err != nil {
+		o.close(e)
+		return nil, "", err
+	}
+	e.IsolateRemote(o.isolate)
+	level, err := zerolog.ParseLevel(o.consoleLevel)
+	if err != nil || level < zerolog.TraceLevel || level > zerolog.ErrorLevel {
+		o.close(e)
+		return nil, "", fmt.Errorf("invalid console level %q", o.consoleLevel)
+	}
+	e.SetConsoleLevel(level)
+	e.ConsoleToLogger(o.consoleLog)
+	e.ConsolePlainText(true)
+	e.AllowEnv(o.env...)
+	if o.lockdown {
+		if err := e.Lockdown(); err != nil {
+			o.close(e)
+			return nil, "", err
+		}
+	}
+	return e, "./" + filepath.ToSlash(rel), nil
+}
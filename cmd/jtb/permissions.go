@@ -0,0 +1,173 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/andrebq/jtb/engine"
+)
+
+type (
+	// manifest contains the permissions requested by a script
+	manifest struct {
+		script string
+		perms  engine.Permissions
+		// hash identifies the script and its sidecar manifest,
+		// any change to them requires a new approval
+		hash string
+	}
+
+	approval struct {
+		Script      string             `json:"script"`
+		Permissions engine.Permissions `json:"permissions"`
+	}
+)
+
+// sidecarPath returns the path to the optional manifest stored next to script,
+// eg.: deploy.js -> deploy.permissions.yaml
+func sidecarPath(script string) string {
+	return strings.TrimSuffix(script, filepath.Ext(script)) + ".permissions.yaml"
+}
+
+// readManifest merges the permissions from the header of script
+// and its sidecar file
+func readManifest(script string) (*manifest, error) {
+	code, err := ioutil.ReadFile(script)
+	if err != nil {
+		return nil, err
+	}
+	perms, err := engine.ParseManifest(code)
+	if err != nil {
+		return nil, fmt.Errorf("unable to read permissions from %v: %w", script, err)
+	}
+	h := sha256.New()
+	h.Write(code)
+	sidecar, err := ioutil.ReadFile(sidecarPath(script))
+	switch {
+	case err == nil:
+		filePerms, err := engine.ParseManifestFile(sidecar)
+		if err != nil {
+			return nil, fmt.Errorf("unable to read permissions from %v: %w", sidecarPath(script), err)
+		}
+		perms.Merge(filePerms)
+		h.Write([]byte{0})
+		h.Write(sidecar)
+	case !os.IsNotExist(err):
+		return nil, err
+	}
+	return &manifest{
+		script: script,
+		perms:  perms,
+		hash:   hex.EncodeToString(h.Sum(nil)),
+	}, nil
+}
+
+func defaultApprovalsFile() string {
+	dir, err := os.UserConfigDir()
+	if err != nil {
+		return ""
+	}
+	return filepath.Join(dir, "jtb", "approvals.json")
+}
+
+func loadApprovals(file string) (map[string]approval, error) {
+	approvals := map[string]approval{}
+	content, err := ioutil.ReadFile(file)
+	if os.IsNotExist(err) {
+		return approvals, nil
+	} else if err != nil {
+		return nil, err
+	}
+	if err := json.Unmarshal(content, &approvals); err != nil {
+		return nil, fmt.Errorf("invalid approvals file %v: %w", file, err)
+	}
+	return approvals, nil
+}
+
+func saveApprovals(file string, approvals map[string]approval) error {
+	content, err := json.MarshalIndent(approvals, "", "  ")
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(filepath.Dir(file), 0700); err != nil {
+		return err
+	}
+	return ioutil.WriteFile(file, content, 0600)
+}
+
+// approve asks the user to accept the permissions requested by the script,
+// unless they were approved before or the user passed -yes.
+func (o *engineOptions) approve(m *manifest) error {
+	if len(m.perms) == 0 || o.yes {
+		return nil
+	}
+	var approvals map[string]approval
+	if o.approvals != "" {
+		var err error
+		approvals, err = loadApprovals(o.approvals)
+		if err != nil {
+			return err
+		}
+		if _, ok := approvals[m.hash]; ok {
+			return nil
+		}
+	}
+	fmt.Fprintf(os.Stderr, "%v requests the following permissions:\n", m.script)
+	for _, line := range strings.Split(m.perms.String(), "\n") {
+		fmt.Fprintf(os.Stderr, "  %v\n", line)
+	}
+	if stat, err := os.Stdin.Stat(); err != nil || stat.Mode()&os.ModeCharDevice == 0 {
+		return errors.New("permissions were not approved, use -yes to approve them without asking")
+	}
+	fmt.Fprint(os.Stderr, "Allow? [y/N] ")
+	if answer := strings.ToLower(strings.TrimSpace(readLine())); answer != "y" && answer != "yes" {
+		return errors.New("permissions were not approved")
+	}
+	if o.approvals == "" {
+		return nil
+	}
+	approvals[m.hash] = approval{Script: m.script, Permissions: m.perms}
+	return saveApprovals(o.approvals, approvals)
+}
+
+// readLine reads stdin one byte at a time, so nothing
+// is buffered away from the script
+func readLine() string {
+	var line []byte
+	buf := make([]byte, 1)
+	for {
+		n, err := os.Stdin.Read(buf)
+		if n == 0 || err != nil || buf[0] == '\n' {
+			return string(line)
+		}
+		line = append(line, buf[0])
+	}
+}
+
+// applyExecPolicy limits the binaries the script can run
+// to the ones listed in o.execPolicy, if set
+func (o *engineOptions) applyExecPolicy(e *engine.E) error {
+	if o.execPolicy == "" {
+		return nil
+	}
+	content, err := ioutil.ReadFile(o.execPolicy)
+	if err != nil {
+		return err
+	}
+	rules, err := engine.ParseExecPolicy(content)
+	if err != nil {
+		return fmt.Errorf("invalid exec policy %v: %w", o.execPolicy, err)
+	}
+	if rules == nil {
+		// an empty file denies every binary
+		rules = []engine.ExecRule{}
+	}
+	return e.SetExecPolicy(rules)
+}
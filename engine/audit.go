@@ -0,0 +1,75 @@
+package engine
+
+import (
+	"github.com/andrebq/jtb/internal/modules/modutils"
+	"github.com/rs/zerolog"
+)
+
+type (
+	// AuditEvent records a sensitive operation made by a script
+	AuditEvent = modutils.AuditEvent
+)
+
+const (
+	// AuditRequire is emitted when a dangerous builtin is required
+	AuditRequire = modutils.AuditRequire
+	// AuditExec is emitted for every process started (or denied) by @rawexec
+	AuditExec = modutils.AuditExec
+	// AuditFileWrite is emitted by builtins that write to files
+	AuditFileWrite = modutils.AuditFileWrite
+	// AuditNetwork is emitted for network requests, including module downloads
+	AuditNetwork = modutils.AuditNetwork
+	// AuditSecret is emitted when @secrets loads a secret (the value is never included)
+	AuditSecret = modutils.AuditSecret
+)
+
+// SetAudit sends every sensitive operation made by scripts to fn,
+// fn is called from the goroutine running the script or from the ones
+// running its workers, but never concurrently.
+func (e *E) SetAudit(fn func(AuditEvent)) {
+	e.audit = fn
+}
+
+// AuditToLogger returns a function, to be used with SetAudit, that writes
+// every event as a structured entry to logger
+func AuditToLogger(logger zerolog.Logger) func(AuditEvent) {
+	return func(ev AuditEvent) {
+		arr := zerolog.Arr()
+		for _, frame := range ev.CallStack {
+			arr.Str(frame)
+		}
+		logger.Log().
+			Time("time", ev.Time).
+			Str("kind", string(ev.Kind)).
+			Str("module", ev.Module).
+			Fields(ev.Details).
+			Array("callStack", arr).
+			Send()
+	}
+}
+
+func (e *E) emitAudit(ev AuditEvent) {
+	if e.audit == nil {
+		return
+	}
+	for k, v := range ev.Details {
+		ev.Details[k] = e.redactValue(v)
+	}
+	e.auditLock.Lock()
+	defer e.auditLock.Unlock()
+	e.audit.Emit(ev)
+}
+
+// sharedAudit returns the audit function of e for a worker,
+// its calls are serialized with the ones made by e
+func (e *E) sharedAudit() modutils.Audit {
+	if e.audit == nil {
+		return nil
+	}
+	audit := e.audit
+	return func(ev AuditEvent) {
+		e.auditLock.Lock()
+		defer e.auditLock.Unlock()
+		audit(ev)
+	}
+}
@@ -0,0 +1,353 @@
+package engine
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/url"
+	"path"
+	"reflect"
+	"strings"
+
+	"github.com/andrebq/jtb/internal/modules/modutils"
+	"github.com/dop251/goja/ast"
+	"github.com/dop251/goja/file"
+	"github.com/spf13/afero"
+)
+
+type (
+	// Severity of a diagnostic, only errors should prevent a script from running
+	Severity string
+
+	// DiagnosticKind identifies the problem found by Check
+	DiagnosticKind string
+
+	// Diagnostic is a problem found by Check
+	Diagnostic struct {
+		Severity Severity       `json:"severity"`
+		Kind     DiagnosticKind `json:"kind"`
+		// Module where the problem was found, empty for the script itself
+		Module string `json:"module"`
+		// Position of the problem, eg.: lib/util.js:10:5
+		Position string `json:"position,omitempty"`
+		Message  string `json:"message"`
+	}
+
+	checker struct {
+		r       *rootRequire
+		visited map[string]bool
+		diags   []Diagnostic
+
+		// modules found by the checker, in the same format used by LoadedModules
+		modules     map[string]*ModuleInfo
+		moduleOrder []string
+	}
+
+	requireCall struct {
+		specifier string
+		position  string
+	}
+)
+
+const (
+	SeverityError   = Severity("error")
+	SeverityWarning = Severity("warning")
+
+	DiagnosticSyntax       = DiagnosticKind("syntax")
+	DiagnosticUnresolved   = DiagnosticKind("unresolved")
+	DiagnosticAnchorEscape = DiagnosticKind("anchor-escape")
+	DiagnosticRestricted   = DiagnosticKind("restricted")
+	DiagnosticDynamic      = DiagnosticKind("dynamic-require")
+)
+
+func (d Diagnostic) String() string {
+	where := d.Position
+	if where == "" {
+		where = d.Module
+	}
+	if where == "" {
+		return fmt.Sprintf("%v: %v (%v)", d.Severity, d.Message, d.Kind)
+	}
+	return fmt.Sprintf("%v: %v: %v (%v)", d.Severity, where, d.Message, d.Kind)
+}
+
+// HasErrors returns true if any of the diagnostics is an error
+func HasErrors(diags []Diagnostic) bool {
+	for _, d := range diags {
+		if d.Severity == SeverityError {
+			return true
+		}
+	}
+	return false
+}
+
+// Check parses script and all its transitive dependencies, without
+// executing any code, and reports syntax errors, paths that cannot be
+// resolved, local paths escaping the anchor and builtins that cannot be
+// used with the trust level of the module requiring them.
+//
+// script is resolved in the same way as a require call from InteractiveEval.
+// Only requires using string literals can be checked, any other
+// require call is reported as a warning.
+func (e *E) Check(script string) []Diagnostic {
+	_, diags := e.Dependencies(script)
+	return diags
+}
+
+// Dependencies returns the modules that script would load, without
+// executing any code, along with the diagnostics reported by Check.
+//
+// Modules are returned in the same format used by LoadedModules, but
+// requires that cannot be checked (see Check) are not part of the graph,
+// use LoadedModules after running the script to get every module it loaded.
+func (e *E) Dependencies(script string) ([]ModuleInfo, []Diagnostic) {
+	c := &checker{
+		r:       e.require,
+		visited: make(map[string]bool),
+		modules: make(map[string]*ModuleInfo),
+	}
+	c.r.init()
+	c.checkRequire("", "", nil, requireCall{specifier: script})
+	var modules []ModuleInfo
+	for _, resolved := range c.moduleOrder {
+		modules = append(modules, *c.modules[resolved])
+	}
+	return modules, c.diags
+}
+
+// track records that importer requires the module identified by resolved,
+// info is used only if this is the first time resolved was found.
+func (c *checker) track(importer string, info ModuleInfo) {
+	existing := c.modules[info.Resolved]
+	if existing == nil {
+		existing = &info
+		c.modules[info.Resolved] = existing
+		c.moduleOrder = append(c.moduleOrder, info.Resolved)
+	}
+	for _, v := range existing.Importers {
+		if v == importer {
+			return
+		}
+	}
+	existing.Importers = append(existing.Importers, importer)
+}
+
+// trackImporter records another importer of a module that was already found,
+// modules that could not be read are ignored.
+func (c *checker) trackImporter(importer string, resolved string) {
+	if c.modules[resolved] != nil {
+		c.track(importer, ModuleInfo{Resolved: resolved})
+	}
+}
+
+func (c *checker) report(severity Severity, kind DiagnosticKind, module string, position string, msg string, args ...interface{}) {
+	c.diags = append(c.diags, Diagnostic{
+		Severity: severity,
+		Kind:     kind,
+		Module:   module,
+		Position: position,
+		Message:  fmt.Sprintf(msg, args...),
+	})
+}
+
+// checkRequire validates a require made by importer, dir is used to resolve local
+// modules and remote is not nil if importer is an untrusted remote module.
+func (c *checker) checkRequire(importer string, dir string, remote *untrustedRemoteRequire, call requireCall) {
+	name := call.specifier
+	switch {
+	case c.r.isBuiltin(name):
+		c.checkBuiltin(importer, remote != nil, call)
+	case remote != nil:
+		c.checkRemote(importer, remote, call)
+	case importer == "" && c.r.isRemote(name):
+		remote, err := newRemote(c.r, name)
+		if err != nil {
+			c.report(SeverityError, DiagnosticUnresolved, importer, call.position, "%v is not a valid remote module", name)
+			return
+		}
+		c.checkRemote(importer, remote, call)
+	case c.r.isLocal(name):
+		c.checkLocal(importer, dir, call)
+	default:
+		c.report(SeverityError, DiagnosticUnresolved, importer, call.position, "%v is not understood as a valid module path", name)
+	}
+}
+
+func (c *checker) checkBuiltin(importer string, fromRemote bool, call requireCall) {
+	name := call.specifier
+	switch {
+	case c.r.builtins[name] == nil:
+		c.report(SeverityError, DiagnosticUnresolved, importer, call.position, "builtin %v is not defined", name)
+	case fromRemote && !c.r.isAllowedForRemote(name):
+		c.report(SeverityError, DiagnosticRestricted, importer, call.position, "builtin %v is not allowed from remote modules", name)
+	case !fromRemote && c.r.isRestricted(name):
+		c.report(SeverityError, DiagnosticRestricted, importer, call.position, "builtin %v is restricted", name)
+	default:
+		c.track(importer, ModuleInfo{
+			Specifier: name,
+			Resolved:  name,
+			Trust:     TrustBuiltin,
+			Dangerous: c.r.isDangerous(name),
+		})
+	}
+}
+
+func (c *checker) checkLocal(importer string, dir string, call requireCall) {
+	joined := path.Join(dir, call.specifier)
+	if joined == ".." || strings.HasPrefix(joined, "../") {
+		c.report(SeverityError, DiagnosticAnchorEscape, importer, call.position, "%v is outside of the anchor", call.specifier)
+		return
+	}
+	tf := &trustedFileRequire{root: c.r, dir: dir}
+	_, relativePath, err := tf.resolvePathTo(call.specifier)
+	if err != nil || relativePath == "" {
+		c.report(SeverityError, DiagnosticUnresolved, importer, call.position, "unable to resolve %v", call.specifier)
+		return
+	}
+	if c.visited[relativePath] {
+		c.trackImporter(importer, relativePath)
+		return
+	}
+	c.visited[relativePath] = true
+	content, err := afero.ReadFile(c.r.e.fs, relativePath)
+	if err != nil {
+		c.report(SeverityError, DiagnosticUnresolved, importer, call.position, "unable to read %v: %v", call.specifier, err)
+		return
+	}
+	c.track(importer, ModuleInfo{
+		Specifier: call.specifier,
+		Resolved:  relativePath,
+		Trust:     TrustLocal,
+		Hash:      contentHash(content),
+	})
+	for _, req := range c.parse(relativePath, relativePath, path.Base(relativePath), content) {
+		c.checkRequire(relativePath, path.Dir(relativePath), nil, req)
+	}
+}
+
+func (c *checker) checkRemote(importer string, remote *untrustedRemoteRequire, call requireCall) {
+	target, err := url.Parse(call.specifier)
+	if err != nil {
+		c.report(SeverityError, DiagnosticUnresolved, importer, call.position, "%v is not a valid module path", call.specifier)
+		return
+	}
+	if target.Scheme != "" {
+		if !remote.sameOrigin(target) {
+			remote = remote.newOrigin(target)
+		}
+		remote = remote.sub(target)
+	} else {
+		target = remote.absURL(target.Path)
+	}
+	candidates := remote.candidates(target)
+	for _, candidate := range candidates {
+		if c.visited[candidate.String()] {
+			c.trackImporter(importer, publicURL(candidate))
+			return
+		}
+	}
+	target, content, err := remote.downloadFirst(candidates)
+	if err != nil {
+		c.report(SeverityError, DiagnosticUnresolved, importer, call.position, "unable to download %v: %v", call.specifier, err)
+		return
+	}
+	c.visited[target.String()] = true
+	module := publicURL(target)
+	c.track(importer, ModuleInfo{
+		Specifier: call.specifier,
+		Resolved:  module,
+		Trust:     TrustRemote,
+		Hash:      contentHash(content),
+	})
+	sub := remote.sub(target)
+	for _, req := range c.parse(module, target.String(), path.Base(target.Path), content) {
+		c.checkRequire(module, "", sub, req)
+	}
+}
+
+// parse content and return all require calls, data modules are validated
+// but never have dependencies.
+func (c *checker) parse(module string, modulePath string, sourceFile string, content []byte) []requireCall {
+	switch kindOf(modulePath) {
+	case jsonModule:
+		if !json.Valid(content) {
+			c.report(SeverityError, DiagnosticSyntax, module, "", "invalid JSON document")
+		}
+		return nil
+	case yamlModule:
+		if _, err := modutils.YamlToJSON(string(content)); err != nil {
+			c.report(SeverityError, DiagnosticSyntax, module, "", "invalid YAML document: %v", err)
+		}
+		return nil
+	}
+	code := content
+	if needsTranspile(modulePath, content) {
+		out, err := c.r.e.programs.transpile(modulePath, sourceFile, content, func() (*transpiled, error) {
+			return transpile(module, modulePath, sourceFile, content)
+		})
+		if err != nil {
+			c.report(SeverityError, DiagnosticSyntax, module, "", "%v", err)
+			return nil
+		}
+		code = append(append(append([]byte(nil), out.code...), '\n'), sourceMapComment(out.sourceMap)...)
+	}
+	prg, err := parseModuleCode(module, string(code))
+	if err != nil {
+		c.report(SeverityError, DiagnosticSyntax, module, "", "%v", err)
+		return nil
+	}
+	var calls []requireCall
+	walkAST(reflect.ValueOf(prg.Body), func(call *ast.CallExpression) {
+		callee, ok := call.Callee.(*ast.Identifier)
+		if !ok || callee.Name != "require" {
+			return
+		}
+		req := requireCall{position: positionOf(prg.File, call.Idx0())}
+		if len(call.ArgumentList) > 0 {
+			if lit, ok := call.ArgumentList[0].(*ast.StringLiteral); ok {
+				req.specifier = lit.Value.String()
+				calls = append(calls, req)
+				return
+			}
+		}
+		c.report(SeverityWarning, DiagnosticDynamic, module, req.position, "require is not called with a string literal and cannot be checked")
+	})
+	return calls
+}
+
+func positionOf(f *file.File, idx file.Idx) string {
+	return f.Position(int(idx) - f.Base()).String()
+}
+
+var (
+	astPkgPath = reflect.TypeOf(ast.Program{}).PkgPath()
+)
+
+// walkAST calls fn for every call expression found in v,
+// only values from the goja/ast package are visited.
+func walkAST(v reflect.Value, fn func(*ast.CallExpression)) {
+	switch v.Kind() {
+	case reflect.Interface, reflect.Ptr:
+		if v.IsNil() {
+			return
+		}
+		if call, ok := v.Interface().(*ast.CallExpression); ok && v.Kind() == reflect.Ptr {
+			fn(call)
+		}
+		walkAST(v.Elem(), fn)
+	case reflect.Slice:
+		for i := 0; i < v.Len(); i++ {
+			walkAST(v.Index(i), fn)
+		}
+	case reflect.Struct:
+		if v.Type().PkgPath() != astPkgPath {
+			return
+		}
+		for i := 0; i < v.NumField(); i++ {
+			if v.Type().Field(i).PkgPath != "" {
+				// unexported
+				continue
+			}
+			walkAST(v.Field(i), fn)
+		}
+	}
+}
@@ -6,46 +6,302 @@ import (
 	"errors"
 	"fmt"
 	"io"
+	"strings"
+	"time"
 
+	"github.com/andrebq/jtb/internal/modules/modutils"
+	"github.com/andrebq/jtb/internal/modules/stdio"
 	"github.com/dop251/goja"
+	"github.com/rs/zerolog"
 )
 
 type (
 	// console implements a restricted form of javascript console global
 	console struct {
 		e *E
+
+		counters map[string]int
+		timers   map[string]time.Time
+		depth    int
 	}
 )
 
+// SetConsoleLevel changes the minimum level of the messages printed by console,
+// console.trace is zerolog.TraceLevel, console.debug zerolog.DebugLevel,
+// console.log and console.info zerolog.InfoLevel, and so on.
+//
+// By default, every message is printed.
+func (e *E) SetConsoleLevel(level zerolog.Level) {
+	e.consoleLevel = level
+}
+
+// ConsolePlainText prints strings passed to console as they are, objects and
+// arrays as JSON and functions as [Function: name], like node does.
+//
+// By default, every argument is encoded as JSON.
+func (e *E) ConsolePlainText(enable bool) {
+	e.consolePlainText = enable
+}
+
+// ConsoleToLogger sends the messages printed by console to the logger of the engine
+// (see SetLogger) instead of stderr, as events tagged with the module that called console.
+func (e *E) ConsoleToLogger(enable bool) {
+	e.consoleToLogger = enable
+}
+
 func (c *console) ToValue() goja.Value {
 	obj := c.e.runtime.NewObject()
+	c.counters = map[string]int{}
+	c.timers = map[string]time.Time{}
 
-	obj.Set("info", c.info)
-	obj.Set("debug", c.info)
-	obj.Set("error", c.info)
+	obj.Set("trace", c.trace)
+	obj.Set("debug", c.printer(zerolog.DebugLevel))
+	obj.Set("log", c.printer(zerolog.InfoLevel))
+	obj.Set("info", c.printer(zerolog.InfoLevel))
+	obj.Set("warn", c.printer(zerolog.WarnLevel))
+	obj.Set("error", c.printer(zerolog.ErrorLevel))
+	obj.Set("assert", c.assert)
+	obj.Set("table", c.table)
+	obj.Set("time", c.time)
+	obj.Set("timeLog", c.timeLog)
+	obj.Set("timeEnd", c.timeEnd)
+	obj.Set("count", c.count)
+	obj.Set("countReset", c.countReset)
+	obj.Set("group", c.group)
+	obj.Set("groupCollapsed", c.group)
+	obj.Set("groupEnd", c.groupEnd)
 
 	return obj
 }
 
-func (c *console) info(call goja.FunctionCall) goja.Value {
+func (c *console) printer(level zerolog.Level) func(goja.FunctionCall) goja.Value {
+	return func(call goja.FunctionCall) goja.Value {
+		c.print(level, call.Arguments, nil)
+		return goja.Undefined()
+	}
+}
+
+func (c *console) trace(call goja.FunctionCall) goja.Value {
+	if !c.enabled(zerolog.TraceLevel) {
+		return goja.Undefined()
+	}
+	var stack []string
+	for _, frame := range modutils.CallStack(c.e.runtime) {
+		if !strings.HasSuffix(frame, "from <native>") {
+			stack = append(stack, frame)
+		}
+	}
+	c.print(zerolog.TraceLevel, call.Arguments, stack)
+	return goja.Undefined()
+}
+
+func (c *console) assert(call goja.FunctionCall) goja.Value {
+	if call.Argument(0).ToBoolean() {
+		return goja.Undefined()
+	}
+	args := []goja.Value{c.e.runtime.ToValue("Assertion failed")}
+	if len(call.Arguments) > 1 {
+		args = append(args, call.Arguments[1:]...)
+	}
+	c.print(zerolog.ErrorLevel, args, nil)
+	return goja.Undefined()
+}
+
+// table prints an array of objects as columns, anything
+// else is printed like console.log
+func (c *console) table(call goja.FunctionCall) goja.Value {
+	if !c.enabled(zerolog.InfoLevel) {
+		return goja.Undefined()
+	}
+	var out []byte
+	if _, ok := call.Argument(0).(*goja.Object); ok {
+		if ex := c.e.runtime.Try(func() {
+			out = stdio.Table(c.e.runtime, call.Argument(0), call.Argument(1), false)
+		}); ex != nil {
+			out = nil
+		}
+	}
+	if out == nil {
+		c.print(zerolog.InfoLevel, call.Arguments[:1], nil)
+		return goja.Undefined()
+	}
+	c.emit(zerolog.InfoLevel, strings.TrimSuffix(string(out), "\n"), nil)
+	return goja.Undefined()
+}
+
+func (c *console) time(call goja.FunctionCall) goja.Value {
+	label := consoleLabel(call.Argument(0))
+	if _, ok := c.timers[label]; ok {
+		c.printText(zerolog.WarnLevel, fmt.Sprintf("Timer '%v' already exists", label))
+		return goja.Undefined()
+	}
+	c.timers[label] = time.Now()
+	return goja.Undefined()
+}
+
+func (c *console) timeLog(call goja.FunctionCall) goja.Value {
+	c.elapsed(call, false)
+	return goja.Undefined()
+}
+
+func (c *console) timeEnd(call goja.FunctionCall) goja.Value {
+	c.elapsed(call, true)
+	return goja.Undefined()
+}
+
+func (c *console) elapsed(call goja.FunctionCall, end bool) {
+	label := consoleLabel(call.Argument(0))
+	start, ok := c.timers[label]
+	if !ok {
+		c.printText(zerolog.WarnLevel, fmt.Sprintf("Timer '%v' does not exist", label))
+		return
+	}
+	if end {
+		delete(c.timers, label)
+	}
+	args := []goja.Value{c.e.runtime.ToValue(fmt.Sprintf("%v: %v", label, time.Since(start)))}
+	if !end && len(call.Arguments) > 1 {
+		args = append(args, call.Arguments[1:]...)
+	}
+	c.print(zerolog.InfoLevel, args, nil)
+}
+
+func (c *console) count(call goja.FunctionCall) goja.Value {
+	label := consoleLabel(call.Argument(0))
+	c.counters[label]++
+	c.printText(zerolog.InfoLevel, fmt.Sprintf("%v: %v", label, c.counters[label]))
+	return goja.Undefined()
+}
+
+func (c *console) countReset(call goja.FunctionCall) goja.Value {
+	delete(c.counters, consoleLabel(call.Argument(0)))
+	return goja.Undefined()
+}
+
+func (c *console) group(call goja.FunctionCall) goja.Value {
+	if len(call.Arguments) > 0 {
+		c.print(zerolog.InfoLevel, call.Arguments, nil)
+	}
+	c.depth++
+	return goja.Undefined()
+}
+
+func (c *console) groupEnd(call goja.FunctionCall) goja.Value {
+	if c.depth > 0 {
+		c.depth--
+	}
+	return goja.Undefined()
+}
+
+func consoleLabel(v goja.Value) string {
+	if goja.IsUndefined(v) {
+		return "default"
+	}
+	return v.String()
+}
+
+func (c *console) enabled(level zerolog.Level) bool {
+	return level >= c.e.consoleLevel
+}
+
+func (c *console) printText(level zerolog.Level, text string) {
+	c.print(level, []goja.Value{c.e.runtime.ToValue(text)}, nil)
+}
+
+// print writes every argument encoded as JSON (or formatted as text, see
+// ConsolePlainText), separated by spaces
+func (c *console) print(level zerolog.Level, args []goja.Value, stack []string) {
+	if !c.enabled(level) {
+		return
+	}
 	buf := &bytes.Buffer{}
-	for idx, v := range call.Arguments {
+	for idx, v := range args {
 		if idx > 0 {
 			buf.WriteRune(' ')
 		}
-		exported := v.Export()
-		jsonBytes, err := json.Marshal(exported)
+		if c.e.consolePlainText {
+			buf.WriteString(formatValue(v))
+			continue
+		}
+		jsonBytes, err := json.Marshal(v.Export())
 		if err != nil {
-			fmt.Fprintf(buf, "%v", exported)
+			// eg.: functions
+			buf.WriteString(formatValue(v))
 			continue
 		}
 		buf.Write(jsonBytes)
 	}
-	buf.WriteRune('\n')
+	c.emit(level, buf.String(), stack)
+}
+
+// formatValue returns how v is printed as text: strings as they are,
+// objects and arrays encoded as JSON, functions and errors as a short
+// description and everything else as its javascript string.
+func formatValue(v goja.Value) string {
+	if v == nil || goja.IsUndefined(v) {
+		return "undefined"
+	}
+	if sym, ok := v.(*goja.Symbol); ok {
+		return fmt.Sprintf("Symbol(%v)", sym)
+	}
+	obj, ok := v.(*goja.Object)
+	if !ok {
+		return v.String()
+	}
+	if _, ok := goja.AssertFunction(obj); ok {
+		if name := obj.Get("name"); name != nil && name.String() != "" {
+			return fmt.Sprintf("[Function: %v]", name)
+		}
+		return "[Function (anonymous)]"
+	}
+	if obj.ClassName() == "Error" {
+		return obj.String()
+	}
+	jsonBytes, err := json.Marshal(obj)
+	if err != nil || string(jsonBytes) == "undefined" {
+		// eg.: cyclic objects
+		return obj.String()
+	}
+	var str string
+	if json.Unmarshal(jsonBytes, &str) == nil {
+		// objects encoded as a string (eg.: dates)
+		return str
+	}
+	return string(jsonBytes)
+}
+
+// emit sends text to the logger or to stderr, indented by the current group
+func (c *console) emit(level zerolog.Level, text string, stack []string) {
+	text = c.e.Redact(text)
+	for i := range stack {
+		stack[i] = c.e.Redact(stack[i])
+	}
+	if c.e.consoleToLogger {
+		ev := c.e.logger.WithLevel(level).
+			Str("source", "console").
+			Str("module", modutils.CallerModule(c.e.runtime))
+		if c.depth > 0 {
+			ev = ev.Int("group", c.depth)
+		}
+		if stack != nil {
+			ev = ev.Strs("stack", stack)
+		}
+		ev.Msg(text)
+		return
+	}
+	indent := strings.Repeat("  ", c.depth)
+	buf := &bytes.Buffer{}
+	for _, line := range strings.Split(text, "\n") {
+		buf.WriteString(indent)
+		buf.WriteString(line)
+		buf.WriteRune('\n')
+	}
+	for _, frame := range stack {
+		fmt.Fprintf(buf, "%v    at %v\n", indent, frame)
+	}
 	_, err := io.Copy(c.e.stderr, buf)
 	if err != nil {
 		errID := c.e.logError("console.info", err)
 		panic(c.e.runtime.NewGoError(errors.New("Unable to process call to console: " + errID)))
 	}
-	return goja.Undefined()
 }
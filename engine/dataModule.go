@@ -0,0 +1,167 @@
+package engine
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"path"
+
+	"github.com/andrebq/jtb/internal/modules/modutils"
+	"github.com/dop251/goja"
+)
+
+type (
+	moduleKind int
+)
+
+const (
+	unknownModule moduleKind = iota
+	scriptModule
+	jsonModule
+	yamlModule
+)
+
+var (
+	deepFreezeProgram = goja.MustCompile("__goja__deepFreeze.js", `(function deepFreeze(obj){
+		if (obj === null || typeof obj !== "object" || Object.isFrozen(obj)) {
+			return obj;
+		}
+		Object.freeze(obj);
+		Object.getOwnPropertyNames(obj).forEach(function(name) {
+			deepFreeze(obj[name]);
+		});
+		return obj;
+	})`, true)
+)
+
+func kindOf(modulePath string) moduleKind {
+	switch path.Ext(modulePath) {
+	case ".js", ".mjs", ".ts":
+		return scriptModule
+	case ".json":
+		return jsonModule
+	case ".yaml", ".yml":
+		return yamlModule
+	}
+	return unknownModule
+}
+
+// moduleCandidates returns the paths that should be tried, in order,
+// when resolving modulePath.
+//
+// Paths with a known extension are used as-is, otherwise modulePath
+// is treated as either a script without the extension or a directory
+// with an index file.
+func moduleCandidates(modulePath string) []string {
+	modulePath = path.Clean(modulePath)
+	if kindOf(modulePath) != unknownModule {
+		return []string{modulePath}
+	}
+	return []string{
+		modulePath + ".js",
+		modulePath + ".ts",
+		path.Join(modulePath, "index.js"),
+		path.Join(modulePath, "index.ts"),
+	}
+}
+
+// loadData sets the exports of md to the deep frozen content of a JSON/YAML file
+func (r *rootRequire) loadData(md *moduleDef, name string, kind moduleKind, content []byte) error {
+	if kind == yamlModule {
+		var err error
+		content, err = modutils.YamlToJSON(string(content))
+		if err != nil {
+			return fmt.Errorf("Unable to parse %v, cause: %w", name, err)
+		}
+	}
+	data, err := r.decodeJSON(content)
+	if err != nil {
+		return fmt.Errorf("Unable to parse %v, cause: %w", name, err)
+	}
+	fn, err := r.e.runtime.RunProgram(deepFreezeProgram)
+	if err != nil {
+		return err
+	}
+	deepFreeze, _ := goja.AssertFunction(fn)
+	data, err = deepFreeze(goja.Undefined(), data)
+	if err != nil {
+		return err
+	}
+	md.module.Set("exports", data)
+	md.exports = data
+	md.module.Set("loaded", true)
+	r.e.freeze(md.module)
+	md.loading = false
+	return nil
+}
+
+// decodeJSON converts content to javascript values,
+// keeping the same key order used in the document
+func (r *rootRequire) decodeJSON(content []byte) (goja.Value, error) {
+	if len(bytes.TrimSpace(content)) == 0 {
+		// YamlToJSON returns nothing for files without documents
+		return r.e.runtime.NewObject(), nil
+	}
+	dec := json.NewDecoder(bytes.NewBuffer(content))
+	dec.UseNumber()
+	val, err := r.decodeJSONValue(dec)
+	if err != nil {
+		return nil, err
+	}
+	if _, err := dec.Token(); !errors.Is(err, io.EOF) {
+		return nil, errors.New("unexpected content after the end of the document")
+	}
+	return val, nil
+}
+
+func (r *rootRequire) decodeJSONValue(dec *json.Decoder) (goja.Value, error) {
+	tk, err := dec.Token()
+	if err != nil {
+		return nil, err
+	}
+	switch tk := tk.(type) {
+	case json.Delim:
+		switch tk {
+		case '{':
+			obj := r.e.runtime.NewObject()
+			for dec.More() {
+				key, err := dec.Token()
+				if err != nil {
+					return nil, err
+				}
+				val, err := r.decodeJSONValue(dec)
+				if err != nil {
+					return nil, err
+				}
+				obj.Set(key.(string), val)
+			}
+			_, err = dec.Token()
+			return obj, err
+		case '[':
+			var items []interface{}
+			for dec.More() {
+				val, err := r.decodeJSONValue(dec)
+				if err != nil {
+					return nil, err
+				}
+				items = append(items, val)
+			}
+			_, err = dec.Token()
+			return r.e.runtime.NewArray(items...), err
+		}
+	case json.Number:
+		if n, err := tk.Int64(); err == nil {
+			return r.e.runtime.ToValue(n), nil
+		}
+		n, err := tk.Float64()
+		if err != nil {
+			return nil, err
+		}
+		return r.e.runtime.ToValue(n), nil
+	case nil:
+		return goja.Null(), nil
+	}
+	return r.e.runtime.ToValue(tk), nil
+}
@@ -5,13 +5,18 @@ import (
 	"io"
 	"io/ioutil"
 	"path/filepath"
-	"strconv"
+	"sync"
 
 	"github.com/andrebq/jtb/internal/modules/encoding/utf8"
+	"github.com/andrebq/jtb/internal/modules/modutils"
+	"github.com/andrebq/jtb/internal/modules/process"
 	"github.com/andrebq/jtb/internal/modules/rawexec"
+	rawfetch "github.com/andrebq/jtb/internal/modules/rawfetch"
+	"github.com/andrebq/jtb/internal/modules/secrets"
 	"github.com/andrebq/jtb/internal/modules/sleep"
 	"github.com/andrebq/jtb/internal/modules/stdio"
 	"github.com/andrebq/jtb/internal/modules/uuid"
+	"github.com/andrebq/jtb/internal/modules/workers"
 	"github.com/dop251/goja"
 	"github.com/rs/zerolog"
 	"github.com/spf13/afero"
@@ -21,6 +26,24 @@ const (
 	jtbVersion = "--bleeding-edge--"
 )
 
+var (
+	// boot and freeze programs are the same for every engine,
+	// compiling them only once makes New a lot cheaper
+	bootProgram = goja.MustCompile("__goja__boot.js", `
+	Object.freeze(Object);
+	Object.freeze(Array);
+	Object.freeze(String);
+	Object.freeze(Number);
+	Object.freeze(Date);
+	Object.freeze(Function);
+	`, false)
+
+	freezeProgram = goja.MustCompile("__goja__freeze.js", `(function(obj){
+		Object.freeze(obj);
+		return obj;
+	})`, false)
+)
+
 type (
 	// E contains the engine used to run all javascript code
 	E struct {
@@ -32,12 +55,55 @@ type (
 		stderr io.Writer
 		stdout io.Writer
 
+		// colors enable colored output from @stdio writers
+		// for stdout and stderr
+		colors [2]bool
+
 		interactiveEval int64
 		errCount        int64
 
 		logger zerolog.Logger
+		audit  modutils.Audit
+		// auditLock serializes the calls to audit made by the engine and its workers
+		auditLock sync.Mutex
+
+		// consoleLevel is the minimum level printed by console,
+		// consoleToLogger sends console messages to logger and
+		// consolePlainText prints them as text instead of JSON
+		consoleLevel     zerolog.Level
+		consoleToLogger  bool
+		consolePlainText bool
 
 		require *rootRequire
+		loop    *eventLoop
+
+		programs *ProgramCache
+		freezeFn goja.Callable
+
+		// grants are the permissions given to local scripts with Grant
+		grants Permissions
+
+		// exec is the @rawexec module, execPolicy limits the binaries it can run
+		exec       *rawexec.Module
+		execPolicy *rawexec.Policy
+
+		// secrets holds the values loaded by @secrets, shared with workers,
+		// they are redacted from console, logs and audit events
+		secrets *secrets.Store
+
+		// args and envAllow are the arguments and the environment
+		// variables visible to scripts through @process
+		args     []string
+		envAllow []string
+		process  *process.Module
+
+		// locked is true after Lockdown
+		locked bool
+
+		isWorker bool
+		// workerOutput serializes the writes of e and its
+		// workers to stdout and stderr
+		workerOutput sync.Mutex
 	}
 
 	noInput struct{}
@@ -60,11 +126,21 @@ func New() (*E, error) {
 		stderr:  ioutil.Discard,
 		stdout:  ioutil.Discard,
 		logger:  zerolog.Nop(),
+
+		consoleLevel: zerolog.TraceLevel,
+		secrets:      &secrets.Store{},
+
+		programs: NewProgramCache(),
 	}
 	err := e.protectGlobals()
 	if err != nil {
 		return nil, err
 	}
+	e.loop = newEventLoop(e)
+	err = e.loop.defineGlobals()
+	if err != nil {
+		return nil, err
+	}
 	err = e.registerGlobal("console", &console{e: e})
 	if err != nil {
 		return nil, err
@@ -95,16 +171,66 @@ func New() (*E, error) {
 		Stdout: func() io.Writer { return e.stdout },
 		Stderr: func() io.Writer { return e.stderr },
 		Stdin:  func() io.Reader { return e.stdin },
+		Colors: func(stderr bool) bool {
+			if stderr {
+				return e.colors[1]
+			}
+			return e.colors[0]
+		},
 	}); err != nil {
 		return nil, err
 	}
 
-	if err := e.AddBuiltin("@sleep", false, &sleep.Module{}); err != nil {
+	e.process = &process.Module{
+		Args:   func() []string { return e.args },
+		Env:    func() []string { return e.envAllow },
+		Anchor: func() string { return e.require.anchor },
+		Logger: func() zerolog.Logger { return e.logger.With().Str("module", "@process").Logger() },
+	}
+	if err := e.AddBuiltin("@process", false, e.process); err != nil {
+		return nil, err
+	}
+
+	if err := e.AddBuiltin("@sleep", false, &sleep.Module{Loop: e.loop}); err != nil {
+		return nil, err
+	}
+
+	secretsModule := &secrets.Module{
+		Store:  func() *secrets.Store { return e.secrets },
+		Anchor: func() string { return e.require.anchor },
+		Audit:  e.emitAudit,
+	}
+	if err := e.AddBuiltin("@secrets", true, secretsModule); err != nil {
+		return nil, err
+	}
+
+	e.exec = &rawexec.Module{
+		Logger: func() zerolog.Logger { return e.logger.With().Str("module", "@rawexec").Logger() },
+		Audit:  e.emitAudit,
+		Loop:   e.loop,
+		Anchor: func() string { return e.require.anchor },
+		Stdout: func() io.Writer { return e.stdout },
+		Stderr: func() io.Writer { return e.stderr },
+
+		Secrets: secretsModule,
+	}
+	if err := e.AddBuiltin("@rawexec", true, e.exec); err != nil {
+		return nil, err
+	}
+
+	if err := e.AddBuiltin("@rawfetch", true, &rawfetch.Module{
+		Logger: func() zerolog.Logger { return e.logger.With().Str("module", "@rawfetch").Logger() },
+		Loop:   e.loop,
+		Audit:  e.emitAudit,
+
+		Secrets: secretsModule,
+	}); err != nil {
 		return nil, err
 	}
 
-	if err := e.AddBuiltin("@rawexec", true, &rawexec.Module{
-		Logger: e.logger.With().Str("module", "@rawexec").Logger(),
+	if err := e.AddBuiltin("@workers", false, &workers.Module{
+		Spawn: e.spawnWorker,
+		Loop:  e.loop,
 	}); err != nil {
 		return nil, err
 	}
@@ -122,9 +248,21 @@ func New() (*E, error) {
 //
 // If an entry is nil, the one already configured in the engine is kept
 func (e *E) ConnectStdio(in io.Reader, out, err io.Writer) {
-	e.stdin = in
-	e.stdout = out
-	e.stderr = err
+	if in != nil {
+		e.stdin = in
+	}
+	if out != nil {
+		e.stdout = e.lockOutput(out)
+	}
+	if err != nil {
+		e.stderr = e.lockOutput(err)
+	}
+}
+
+// UseColors enables colored output in the structured writers of @stdio,
+// usually because stdout or stderr is a terminal. Colors are disabled by default.
+func (e *E) UseColors(stdout, stderr bool) {
+	e.colors = [2]bool{stdout, stderr}
 }
 
 // AddBuiltin module, if the module is marked as sensitve, the module will be marked as
@@ -162,16 +300,38 @@ func (e *E) AddRemoteBuiltin(name string, module moduleDefiner) error {
 	return nil
 }
 
+// UseProgramCache makes the engine share compiled modules with any other
+// engine using the same cache. By default each engine has its own cache
+// which is shared only with its workers.
+//
+// Modules that were already loaded are not affected by this call.
+func (e *E) UseProgramCache(cache *ProgramCache) {
+	if cache == nil {
+		cache = NewProgramCache()
+	}
+	e.programs = cache
+}
+
 // Unrestrict the given module and allows access to it from local sources or
 // other trusted sources.
 func (e *E) Unrestrict(name string) {
 	e.require.markAsRestricted(name, false)
 }
 
+// InteractiveEval runs the given code and waits until all timers and async
+// operations scheduled by it are done.
+//
+// If code evaluates to a Promise, the value it resolves to is returned.
+// If the script calls exit from @process, an ExitError is returned.
 func (e *E) InteractiveEval(code string) (interface{}, error) {
 	e.interactiveEval++
 	val, err := e.runtime.RunScript(fmt.Sprintf("__eval_statement_%v.js", e.interactiveEval), code)
 	if err != nil {
+		e.loop.reset()
+		return nil, e.exitStatus(err)
+	}
+	val, err = e.loop.drain(val)
+	if err = e.exitStatus(err); err != nil {
 		return nil, err
 	}
 	if val == nil {
@@ -182,11 +342,14 @@ func (e *E) InteractiveEval(code string) (interface{}, error) {
 
 func (e *E) SetStderr(buf io.Writer) error {
 	err := e.closeAll(e.stderr)
-	e.stderr = buf
+	e.stderr = e.lockOutput(buf)
 	return err
 }
 
 func (e *E) Close() error {
+	e.KillProcesses()
+	e.loop.close()
+	e.require.closeRealms()
 	return e.closeAll(e.stdin, e.stdout, e.stderr)
 }
 
@@ -213,25 +376,27 @@ func (e *E) closeAll(objs ...interface{}) error {
 	return firstErr
 }
 
+// logError sends err to the logger and returns the id of the log entry
 func (e *E) logError(tag string, err error) string {
 	e.errCount++
-	e.logger.Error().Err(err).Str("tag", tag).Int64("errCount", e.errCount).Send()
-	return strconv.FormatInt(e.errCount, 16)
+	id := newErrorID()
+	e.logger.Error().Str(zerolog.ErrorFieldName, e.Redact(err.Error())).Str("tag", tag).Str(ErrorIDField, id).Int64("errCount", e.errCount).Send()
+	return id
 }
 
 func (e *E) freeze(gojaValue goja.Value) (goja.Value, error) {
-	fn, err := e.runtime.RunScript("__goja__freeze.js", `(function(obj){
-		Object.freeze(obj);
-		return obj;
-	})`)
-	if err != nil {
-		return nil, err
-	}
-	callable, ok := goja.AssertFunction(fn)
-	if !ok {
-		panic("All bets are off and there is something reall really weird with goja! It is not safe to proceed!")
+	if e.freezeFn == nil {
+		fn, err := e.runtime.RunProgram(freezeProgram)
+		if err != nil {
+			return nil, err
+		}
+		callable, ok := goja.AssertFunction(fn)
+		if !ok {
+			panic("All bets are off and there is something reall really weird with goja! It is not safe to proceed!")
+		}
+		e.freezeFn = callable
 	}
-	obj, err := callable(e.runtime.GlobalObject(), gojaValue)
+	obj, err := e.freezeFn(e.runtime.GlobalObject(), gojaValue)
 	if err != nil {
 		panic("All bets are off and there is something really really weird with Object.freeze or function evaluation! It is not safe to proceed!")
 	}
@@ -239,17 +404,27 @@ func (e *E) freeze(gojaValue goja.Value) (goja.Value, error) {
 }
 
 func (e *E) protectGlobals() error {
-	_, err := e.runtime.RunScript("__goja__boot.js", `
-	Object.freeze(Object);
-	Object.freeze(Array);
-	Object.freeze(String);
-	Object.freeze(Number);
-	Object.freeze(Date);
-	Object.freeze(Function);
-	`)
+	_, err := e.runtime.RunProgram(bootProgram)
 	return err
 }
 
+// compileModule transpiles (if needed) and compiles the code of a module,
+// code that was already compiled for the same path is reused.
+//
+// sourceFile is used by source maps and should be relative to name.
+func (e *E) compileModule(modulePath string, name string, sourceFile string, code []byte) (*goja.Program, error) {
+	if needsTranspile(modulePath, code) {
+		out, err := e.programs.transpile(modulePath, sourceFile, code, func() (*transpiled, error) {
+			return transpile(name, modulePath, sourceFile, code)
+		})
+		if err != nil {
+			return nil, err
+		}
+		code = append(append(append([]byte(nil), out.code...), '\n'), sourceMapComment(out.sourceMap)...)
+	}
+	return e.programs.compile(modulePath, name, string(code))
+}
+
 func (e *E) registerGlobal(name string, value toValue) error {
 	obj, err := e.freeze(value.ToValue())
 	if err != nil {
@@ -257,3 +432,8 @@ func (e *E) registerGlobal(name string, value toValue) error {
 	}
 	return e.runtime.GlobalObject().Set(name, obj)
 }
+
+// registerGlobalFunc defines fn as a read-only global function
+func (e *E) registerGlobalFunc(name string, fn func(goja.FunctionCall) goja.Value) error {
+	return e.runtime.GlobalObject().DefineDataProperty(name, e.runtime.ToValue(fn), goja.FLAG_FALSE, goja.FLAG_FALSE, goja.FLAG_TRUE)
+}
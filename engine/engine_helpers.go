@@ -1,19 +1,34 @@
 package engine
 
-import "github.com/dop251/goja"
+import (
+	"errors"
+
+	"github.com/dop251/goja"
+)
 
 func (e *E) IsRestrictedModule(err error) (error, bool) {
-	ex, ok := err.(*goja.Exception)
+	_, ok := thrownGoValue(err).(errModuleIsRestricted)
 	if !ok {
 		return nil, false
 	}
-	value := ex.Value().ToObject(e.runtime).Get("value")
-	if value == nil {
-		return nil, false
+	return err, ok
+}
+
+// thrownGoValue returns the go value wrapped by the javascript error in
+// err (see goja.Runtime.NewGoError) or nil if err doesn't have one,
+// eg.: when a script throws undefined or a plain value.
+func thrownGoValue(err error) interface{} {
+	var ex *goja.Exception
+	if !errors.As(err, &ex) {
+		return nil
 	}
-	_, ok = value.Export().(errModuleIsRestricted)
+	obj, ok := ex.Value().(*goja.Object)
 	if !ok {
-		return nil, false
+		return nil
 	}
-	return err, ok
+	value := obj.Get("value")
+	if value == nil || goja.IsUndefined(value) || goja.IsNull(value) {
+		return nil
+	}
+	return value.Export()
 }
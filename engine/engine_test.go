@@ -2,9 +2,23 @@ package engine
 
 import (
 	"bytes"
+	"encoding/json"
+	"errors"
 	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
 	"path/filepath"
+	"reflect"
+	"regexp"
+	goruntime "runtime"
+	"strings"
+	"sync/atomic"
 	"testing"
+	"time"
+
+	"github.com/rs/zerolog"
 )
 
 func TestBasicRuntime(t *testing.T) {
@@ -199,3 +213,1601 @@ func TestLocalFilesAreProtected(t *testing.T) {
 		t.Fatalf("A remote module should never be able to download a local fil")
 	}
 }
+
+func TestPoolSharesCompiledPrograms(t *testing.T) {
+	pool := NewPool(2, func(e *E) error {
+		return e.AnchorModules(filepath.Join("testdata", "imports"))
+	})
+	defer pool.Close()
+
+	for i := 0; i < 3; i++ {
+		e, err := pool.Get()
+		if err != nil {
+			t.Fatal(err)
+		}
+		_, err = e.InteractiveEval(`
+			let mymod = require("mymod.js");
+			if (mymod.grandchildren.parent.blah != "123") { throw new Error("parent is incorrect");}
+		`)
+		e.Close()
+		if err != nil {
+			t.Fatalf("Should load mymod.js from a pooled engine, but got %v", err)
+		}
+		if pool.Programs().Len() != 4 {
+			t.Fatalf("Cache should have exactly 4 programs but got %v", pool.Programs().Len())
+		}
+	}
+}
+
+func TestWorkersShareAudit(t *testing.T) {
+	e, err := New()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer e.Close()
+	e.Unrestrict("@rawexec")
+	// events is not protected, the engine must serialize the calls
+	var events []AuditEvent
+	e.SetAudit(func(ev AuditEvent) { events = append(events, ev) })
+	if err := e.AnchorModules(filepath.Join("testdata", "workers")); err != nil {
+		t.Fatal(err)
+	}
+	mustEval(t, e, `
+		let auditing = setInterval(() => require("@rawexec"), 0);
+		require("@workers").mapAsync([1, 2, 3, 4], "./worker.js", "audited", { workers: 4 }).then(() => {
+			clearInterval(auditing);
+		});
+	`)
+	workers := 0
+	for _, ev := range events {
+		if ev.Kind == AuditRequire && strings.HasSuffix(ev.Module, "worker.js") {
+			workers++
+		}
+	}
+	if workers != 80 {
+		t.Fatalf("Every audit event from workers should be received, got %v", workers)
+	}
+}
+
+func TestWorkersShareOutput(t *testing.T) {
+	e, err := New()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer e.Close()
+	var stderr bytes.Buffer
+	e.ConnectStdio(nil, nil, &stderr)
+	if err := e.AnchorModules(filepath.Join("testdata", "workers")); err != nil {
+		t.Fatal(err)
+	}
+	mustEval(t, e, `
+		let printing = setInterval(() => console.info("parent"), 0);
+		require("@workers").mapAsync([1, 2, 3, 4], "./worker.js", "print", { workers: 4 }).then(() => {
+			clearInterval(printing);
+			console.info("parent");
+		});
+	`)
+	workers := 0
+	for _, line := range strings.Split(strings.TrimSuffix(stderr.String(), "\n"), "\n") {
+		if strings.HasPrefix(line, `"worker" `) {
+			workers++
+		} else if line != `"parent"` {
+			t.Fatalf("Output from the engine and its workers should not interleave: %q", line)
+		}
+	}
+	if workers != 80 {
+		t.Fatalf("Expecting 80 lines from workers, got %v", workers)
+	}
+}
+
+func TestLocalModulesRequireBuiltins(t *testing.T) {
+	e, err := New()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer e.Close()
+	var events []AuditEvent
+	e.SetAudit(func(ev AuditEvent) { events = append(events, ev) })
+	if err := e.AnchorModules(filepath.Join("testdata", "builtins")); err != nil {
+		t.Fatal(err)
+	}
+	if val := mustEval(t, e, `require("./main.js").version`); val != jtbVersion {
+		t.Fatalf("Local modules should be able to require builtins, got %v", val)
+	}
+	if _, err := e.InteractiveEval(`require("./main.js").exec()`); err == nil || !strings.Contains(err.Error(), "restricted") {
+		t.Fatalf("Restricted builtins should not be available to local modules: %v", err)
+	}
+	e.Unrestrict("@rawexec")
+	if val := mustEval(t, e, `require("./main.js").exec()`); val != "function" {
+		t.Fatalf("Unrestricted builtins should be available to local modules, got %v", val)
+	}
+	if len(events) != 1 || !strings.HasSuffix(events[0].Module, "main.js") {
+		t.Fatalf("The require should be audited with the local module as caller: %v", events)
+	}
+
+	remote, done := serveRemoteModules(t, filepath.Join("testdata", "remote"), "/mods/")
+	defer done()
+	if _, err := e.InteractiveEval(fmt.Sprintf(`require("./main.js").remote("%v/mods/invalid.js")`, remote)); err == nil {
+		t.Fatal("Remote modules required by local modules should not get restricted builtins")
+	}
+}
+
+func TestPoolRetriesWarmup(t *testing.T) {
+	var calls int32
+	pool := NewPool(1, func(e *E) error {
+		if atomic.AddInt32(&calls, 1) <= 3 {
+			return errors.New("setup failed")
+		}
+		return nil
+	})
+	defer pool.Close()
+	deadline := time.Now().Add(5 * time.Second)
+	for len(pool.ready) == 0 {
+		if time.Now().After(deadline) {
+			t.Fatalf("The pool should keep warming up after failures, setup was called %v times", atomic.LoadInt32(&calls))
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+	e, err := pool.Get()
+	if err != nil {
+		t.Fatal(err)
+	}
+	e.Close()
+}
+
+func TestEventLoop(t *testing.T) {
+	e, err := New()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer e.Close()
+
+	val, err := e.InteractiveEval(`
+		let calls = [];
+		setTimeout(function(v) { calls.push(v); }, 5, "timeout");
+		let id = setTimeout(function() { calls.push("cleared"); }, 1);
+		clearTimeout(id);
+		let ticks = 0;
+		let interval = setInterval(function() {
+			ticks++;
+			if (ticks == 3) {
+				clearInterval(interval);
+				calls.push("interval");
+			}
+		}, 1);
+		queueMicrotask(function() { calls.push("microtask"); });
+		(async function() {
+			let value = await require("@sleep").after("1ms", "slept");
+			calls.push(value);
+			return calls;
+		})();
+	`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	calls, ok := val.([]interface{})
+	if !ok {
+		t.Fatalf("Promise should resolve to an array but got %#v", val)
+	}
+	seen := map[interface{}]bool{}
+	for _, v := range calls {
+		seen[v] = true
+	}
+	if calls[0] != "microtask" || !seen["slept"] || seen["cleared"] {
+		t.Fatalf("Unexpected calls: %v", calls)
+	}
+
+	_, err = e.InteractiveEval(`
+		setTimeout(function() { calls.push("late"); }, 10);
+	`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	val, err = e.InteractiveEval(`calls[calls.length - 1]`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if val != "late" {
+		t.Fatalf("Should wait for all timers before returning, but got %v", val)
+	}
+	for _, code := range []string{`queueMicrotask(1)`, `setTimeout("code", 1)`} {
+		if val := mustEval(t, e, `try { `+code+`; "no error" } catch (e) { e instanceof TypeError }`); val != true {
+			t.Fatalf("%v should throw a TypeError, got %v", code, val)
+		}
+	}
+
+	for i := 0; i < 20; i++ {
+		val := mustEval(t, e, `(function() {
+			const order = [];
+			setTimeout(() => order.push("late"), 50);
+			for (let i = 0; i < 10; i++) {
+				setTimeout(() => order.push(i), 0);
+			}
+			clearTimeout(setTimeout(() => order.push("cleared"), 0));
+			setTimeout(() => order.push("zero"), 0);
+			setTimeout(() => order.push("last"), 50);
+			return new Promise((resolve) => setTimeout(() => resolve(order.join(",")), 60));
+		})()`)
+		if val != "0,1,2,3,4,5,6,7,8,9,zero,late,last" {
+			t.Fatalf("Timers should fire in the order they were scheduled: %v", val)
+		}
+	}
+}
+
+func TestEventLoopErrors(t *testing.T) {
+	e, err := New()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer e.Close()
+
+	_, err = e.InteractiveEval(`setTimeout(function() { throw new Error("boom"); }, 1)`)
+	if err == nil {
+		t.Fatal("Errors from timers should be reported")
+	}
+	_, err = e.InteractiveEval(`Promise.reject(new Error("unhandled"))`)
+	if err == nil {
+		t.Fatal("A rejected promise should be reported")
+	}
+	_, err = e.InteractiveEval(`new Promise(function(_, reject) { setTimeout(reject, 1); }); undefined`)
+	if err == nil {
+		t.Fatal("Unhandled rejections should be reported")
+	}
+	_, err = e.InteractiveEval(`Promise.reject(new Error("handled")).catch(function(){})`)
+	if err != nil {
+		t.Fatalf("Handled rejections should not be reported, got %v", err)
+	}
+}
+
+func TestWorkers(t *testing.T) {
+	e, err := New()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer e.Close()
+
+	err = e.AnchorModules(filepath.Join("testdata", "workers"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	_, err = e.InteractiveEval(`
+		let workers = require("@workers");
+		let utf8 = require("@encoding/utf8");
+		let items = [];
+		for (let i = 0; i < 20; i++) {
+			items.push({value: i});
+		}
+		let results = workers.map(items, "./worker.js", "double", {workers: 4});
+		for (let i = 0; i < items.length; i++) {
+			if (results[i].value !== i * 2) {
+				throw new Error("Results are out of order: " + JSON.stringify(results));
+			}
+			if (utf8.decode(results[i].label) !== "item-" + i) {
+				throw new Error("Byte arrays should be copied");
+			}
+		}
+		workers.mapAsync([1, 2, 3], "./worker.js", "later").then(function(results) {
+			if (results.join(",") !== "10,20,30") {
+				throw new Error("Async workers returned: " + results);
+			}
+		});
+	`)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	_, err = e.InteractiveEval(`require("@workers").map([1], "./worker.js", "fail")`)
+	if err == nil {
+		t.Fatal("Errors from workers should be reported to the caller")
+	}
+	_, err = e.InteractiveEval(`require("@workers").map([function(){}], "./worker.js", "double")`)
+	if err == nil {
+		t.Fatal("Functions cannot be sent to workers")
+	}
+}
+
+func TestCircularRequire(t *testing.T) {
+	e, err := New()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer e.Close()
+
+	err = e.AnchorModules(filepath.Join("testdata", "cycles"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	_, err = e.InteractiveEval(`
+		let a = require("a.js");
+		if (a.fromB !== "b" || a.bSawA !== "a") {
+			throw new Error("Cyclic modules should see partial exports: " + JSON.stringify(a));
+		}
+		if (!Object.isFrozen(a)) {
+			throw new Error("Exports should be frozen after loading");
+		}
+		let info = require("lib/fn.js")();
+		if (info.filename !== "lib/fn.js" || info.dirname !== "lib" || info.id !== "lib/fn.js") {
+			throw new Error("Invalid module information: " + JSON.stringify(info));
+		}
+	`)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	_, err = e.InteractiveEval(`require("unsafeA.js")`)
+	if err == nil {
+		t.Fatal("Replacing module.exports after a cyclic require used the partial exports should fail")
+	}
+}
+
+func TestModuleResolution(t *testing.T) {
+	e, err := New()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer e.Close()
+
+	err = e.AnchorModules(filepath.Join("testdata", "resolve"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	remote, done := serveRemoteModules(t, filepath.Join("testdata", "resolve"), "/mods/")
+	defer done()
+
+	for _, name := range []string{"main", fmt.Sprintf("%v/mods/main", remote)} {
+		_, err = e.InteractiveEval(fmt.Sprintf(`(function() {
+			let main = require(%q);
+			if (main.lib !== "lib" || main.util !== "util") {
+				throw new Error("Extensionless paths were not resolved: " + JSON.stringify(main));
+			}
+			if (main.config.name !== "config" || main.config.replicas !== 3 || main.config.nested.list[2] !== "three") {
+				throw new Error("Invalid JSON module: " + JSON.stringify(main.config));
+			}
+			if (main.values.image.tag !== "1.0" || main.values.ports[1] !== 443) {
+				throw new Error("Invalid YAML module: " + JSON.stringify(main.values));
+			}
+			if (!Object.isFrozen(main.config.nested.list) || !Object.isFrozen(main.values.image)) {
+				throw new Error("Data modules should be deeply frozen");
+			}
+		})()`, name))
+		if err != nil {
+			t.Fatalf("Unable to resolve modules from %v: %v", name, err)
+		}
+	}
+
+	_, err = e.InteractiveEval(`require("./missing")`)
+	if err == nil {
+		t.Fatal("Missing modules should fail")
+	}
+}
+
+func TestESModules(t *testing.T) {
+	e, err := New()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer e.Close()
+
+	err = e.AnchorModules(filepath.Join("testdata", "esm"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	remote, done := serveRemoteModules(t, filepath.Join("testdata"), "/mods/")
+	defer done()
+
+	for _, name := range []string{"main.mjs", fmt.Sprintf("%v/mods/esm/main.mjs", remote)} {
+		_, err = e.InteractiveEval(fmt.Sprintf(`(function() {
+			let main = require(%q);
+			if (main.result !== "hello jtb" || main.libName !== "lib") {
+				throw new Error("Invalid ES module imports: " + JSON.stringify(main));
+			}
+			if (main.legacyName !== "legacy" || main.fromCJS !== "hello cjs from lib" || !main.sameVersion) {
+				throw new Error("Invalid CommonJS interop: " + JSON.stringify(main));
+			}
+		})()`, name))
+		if err != nil {
+			t.Fatalf("Unable to load %v: %v", name, err)
+		}
+	}
+
+	_, err = e.InteractiveEval(fmt.Sprintf(`require("%v/mods/remote/invalidESM.js")`, remote))
+	if err == nil {
+		t.Fatal("Remote ES modules should not be able to import restricted builtins")
+	}
+}
+
+func TestCommonJSIsNotTranspiled(t *testing.T) {
+	for _, code := range []string{
+		"exports.x = 1",
+		"exports = module.exports = {}",
+		"  exports.importer = require('./lib')",
+		"const imported = import('./lib.mjs')",
+		"module.exports.exporter = 1",
+	} {
+		if needsTranspile("main.js", []byte(code)) {
+			t.Errorf("CommonJS code %q should not be transpiled", code)
+		}
+	}
+	for _, code := range []string{
+		"import lib from './lib.mjs'",
+		"import './lib.mjs'",
+		"import {name} from './lib.mjs'",
+		"import * as lib from './lib.mjs'",
+		"export const x = 1",
+		"export {x}",
+		"export * from './lib.mjs'",
+		"export default 1",
+	} {
+		if !needsTranspile("main.js", []byte(code)) {
+			t.Errorf("ES module code %q should be transpiled", code)
+		}
+	}
+}
+
+func TestTypeScriptModules(t *testing.T) {
+	e, err := New()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer e.Close()
+
+	err = e.AnchorModules(filepath.Join("testdata", "ts"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	_, err = e.InteractiveEval(`
+		let helper = require("./helper");
+		let msg = helper.greet({name: "jtb"}, helper.Level.High);
+		if (msg !== "hello jtb (2)") {
+			throw new Error("Invalid message: " + msg);
+		}
+		if (helper.version.major !== 1) {
+			throw new Error("Invalid version");
+		}
+		let counter = new (require("./modern.mjs").Counter)();
+		counter.inc();
+		if (counter.inc() !== 2) {
+			throw new Error("Invalid counter");
+		}
+	`)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	_, err = e.InteractiveEval(`require("./helper.ts").fail()`)
+	if err == nil {
+		t.Fatal("Should have failed")
+	}
+	if !strings.Contains(err.Error(), "helper.ts:19:") {
+		t.Fatalf("Stack trace should point to the original TypeScript line, got %v", err)
+	}
+}
+
+func TestErrorPositions(t *testing.T) {
+	e, err := New()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer e.Close()
+
+	err = e.AnchorModules(filepath.Join("testdata", "errors"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	remote, done := serveRemoteModules(t, filepath.Join("testdata", "errors"), "/mods/")
+	defer done()
+
+	_, err = e.InteractiveEval(`require("./main.js").run()`)
+	if err == nil {
+		t.Fatal("Should have failed")
+	}
+	stack := FormatError(err)
+	for _, frame := range []string{"at lib/fail.js:1:35\n", "at lib/fail.js:5:21\n", "at main.js:4:12\n"} {
+		if !strings.Contains(stack, frame) {
+			t.Fatalf("Stack should contain %q but got:\n%v", frame, stack)
+		}
+	}
+	for _, frame := range []string{"(native)", "__eval_statement_"} {
+		if strings.Contains(stack, frame) {
+			t.Fatalf("Stack should not contain %q but got:\n%v", frame, stack)
+		}
+	}
+
+	_, err = e.InteractiveEval(fmt.Sprintf(`require("%v/mods/main.js").run()`, remote))
+	if err == nil {
+		t.Fatal("Should have failed")
+	}
+	stack = FormatError(err)
+	if frame := fmt.Sprintf("at %v/mods/lib/fail.js:1:35\n", remote); !strings.Contains(stack, frame) {
+		t.Fatalf("Stack should contain %q but got:\n%v", frame, stack)
+	}
+
+	if val := mustEval(t, e, `require("./early.js")`); val != "early" {
+		t.Fatalf("Top-level return should stop the module, got %v", val)
+	}
+	if _, err := compileModuleCode("broken.js", "let a = ;"); err == nil || !strings.Contains(err.Error(), "Line 1:9 ") {
+		t.Fatalf("Syntax errors should point to the original column, got %v", err)
+	}
+}
+
+func TestLoadedModules(t *testing.T) {
+	e, err := New()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer e.Close()
+	e.Unrestrict("@rawexec")
+
+	err = e.AnchorModules(filepath.Join("testdata", "imports"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	remote, done := serveRemoteModules(t, filepath.Join("testdata", "remote"), "/mods/")
+	defer done()
+
+	_, err = e.InteractiveEval(fmt.Sprintf(`
+		require("mymod.js");
+		require("@rawexec");
+		require("%v/mods/valid.js");
+	`, remote))
+	if err != nil {
+		t.Fatal(err)
+	}
+	modules := map[string]ModuleInfo{}
+	for _, m := range e.LoadedModules() {
+		modules[m.Resolved] = m
+	}
+	grandchildren := modules["children/grandchildren/index.js"]
+	if grandchildren.Trust != TrustLocal || grandchildren.Specifier != "./children/grandchildren/index.js" ||
+		grandchildren.Hash == "" || grandchildren.Importers[0] != "mymod.js" {
+		t.Fatalf("Invalid local module info: %#v", grandchildren)
+	}
+	if rawexec := modules["@rawexec"]; rawexec.Trust != TrustBuiltin || !rawexec.Dangerous {
+		t.Fatalf("Invalid builtin module info: %#v", rawexec)
+	}
+	other := modules[remote+"/mods/other.js"]
+	if other.Trust != TrustRemote || other.Importers[0] != remote+"/mods/submod/index.js" {
+		t.Fatalf("Invalid remote module info: %#v", other)
+	}
+	if uuid := modules["@uuid"]; uuid.Importers[0] != remote+"/mods/valid.js" {
+		t.Fatalf("Builtins required by remote modules should be tracked: %#v", uuid)
+	}
+}
+
+func TestDependencies(t *testing.T) {
+	remote, done := serveRemoteModules(t, filepath.Join("testdata", "remote"), "/mods/")
+	defer done()
+
+	for _, script := range []string{"mymod.js", remote + "/mods/valid.js"} {
+		e, err := New()
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer e.Close()
+		err = e.AnchorModules(filepath.Join("testdata", "imports"))
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		deps, diags := e.Dependencies(script)
+		if len(diags) != 0 {
+			t.Fatalf("Unexpected diagnostics for %v: %v", script, diags)
+		}
+		if len(e.LoadedModules()) != 0 {
+			t.Fatal("Dependencies should not load any module")
+		}
+		if _, err := e.InteractiveEval(fmt.Sprintf("require(%q)", script)); err != nil {
+			t.Fatal(err)
+		}
+		if loaded := e.LoadedModules(); !reflect.DeepEqual(deps, loaded) {
+			t.Fatalf("Dependencies of %v should match the loaded modules\ngot:  %#v\nwant: %#v", script, deps, loaded)
+		}
+	}
+}
+
+func TestCheck(t *testing.T) {
+	e, err := New()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer e.Close()
+
+	err = e.AnchorModules(filepath.Join("testdata", "check"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if diags := e.Check("./ok.js"); len(diags) != 0 {
+		t.Fatalf("Valid script should not have problems: %v", diags)
+	}
+
+	kinds := map[DiagnosticKind]Diagnostic{}
+	diags := e.Check("./main.js")
+	for _, d := range diags {
+		kinds[d.Kind] = d
+	}
+	if !HasErrors(diags) || len(diags) != 5 {
+		t.Fatalf("Unexpected diagnostics: %v", diags)
+	}
+	if d := kinds[DiagnosticSyntax]; d.Module != "lib/broken.js" {
+		t.Fatalf("Syntax error not reported: %v", diags)
+	}
+	if d := kinds[DiagnosticRestricted]; d.Position != "main.js:2:14" {
+		t.Fatalf("Restricted builtin not reported: %v", diags)
+	}
+	if d := kinds[DiagnosticUnresolved]; d.Position != "main.js:4:17" {
+		t.Fatalf("Missing module not reported: %v", diags)
+	}
+	if d := kinds[DiagnosticAnchorEscape]; d.Position != "main.js:5:17" {
+		t.Fatalf("Anchor escape not reported: %v", diags)
+	}
+	if d := kinds[DiagnosticDynamic]; d.Severity != SeverityWarning {
+		t.Fatalf("Dynamic require should be a warning: %v", diags)
+	}
+	if len(e.LoadedModules()) != 0 {
+		t.Fatal("Check should not load any module")
+	}
+
+	remote, done := serveRemoteModules(t, filepath.Join("testdata", "remote"), "/mods/")
+	defer done()
+	diags = e.Check(remote + "/mods/invalid.js")
+	if len(diags) != 1 || diags[0].Kind != DiagnosticRestricted {
+		t.Fatalf("Remote modules should not be able to use @rawexec: %v", diags)
+	}
+	if diags := e.Check(remote + "/mods/valid.js"); len(diags) != 0 {
+		t.Fatalf("Valid remote script should not have problems: %v", diags)
+	}
+}
+
+func TestPermissions(t *testing.T) {
+	code, err := ioutil.ReadFile(filepath.Join("testdata", "permissions", "script.js"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	perms, err := ParseManifest(code)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if perms.String() != "@rawexec: echo\n@stdio" {
+		t.Fatalf("Unexpected permissions: %q", perms)
+	}
+	sidecar, err := ioutil.ReadFile(filepath.Join("testdata", "permissions", "script.permissions.yaml"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if filePerms, err := ParseManifestFile(sidecar); err != nil {
+		t.Fatal(err)
+	} else if filePerms.String() != "@rawexec: echo, ls\n@stdio" {
+		t.Fatalf("Unexpected permissions: %q", filePerms)
+	}
+
+	e, err := New()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer e.Close()
+	err = e.AnchorModules(filepath.Join("testdata", "permissions"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := e.Grant(Permissions{"@fs/write": []string{"out/"}}); err == nil {
+		t.Fatal("Unknown capabilities should not be granted")
+	}
+	if err := e.Grant(Permissions{"@stdio": []string{"stdout"}, "@rawexec": nil}); err == nil {
+		t.Fatal("@stdio does not support scopes")
+	}
+	if _, err := e.InteractiveEval(`require("./script.js")`); err == nil {
+		t.Fatal("Failed grants should not unrestrict any module")
+	}
+	if err := e.Grant(perms); err != nil {
+		t.Fatal(err)
+	}
+	val, err := e.InteractiveEval(`require("./script.js").echo("hello")`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if val != int64(0) {
+		t.Fatalf("Unexpected exit code: %v", val)
+	}
+	_, err = e.InteractiveEval(`require("./script.js").list()`)
+	if err == nil || !strings.Contains(err.Error(), "command ls is not allowed") {
+		t.Fatalf("Commands outside of the scope should fail: %v", err)
+	}
+}
+
+func TestLockdown(t *testing.T) {
+	e, err := New()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer e.Close()
+	if err := e.Lockdown(); err != nil {
+		t.Fatal(err)
+	}
+	err = e.AnchorModules(filepath.Join("testdata", "lockdown"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	remote, done := serveRemoteModules(t, filepath.Join("testdata", "lockdown"), "/mods/")
+	defer done()
+
+	val, err := e.InteractiveEval(fmt.Sprintf(`require("%v/mods/tamper.js").results`, remote))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for name, result := range val.(map[string]interface{}) {
+		if result != "blocked" {
+			t.Errorf("%v should be blocked for remote modules but got %v", name, result)
+		}
+	}
+
+	val, err = e.InteractiveEval(`JSON.stringify(require("./local.js").check())`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := `{"map":"2,4","polluted":true,"json":"{\"a\":1}","errorName":"CustomError: custom",` +
+		`"typeErrorMessage":"ok","override":"overridden","point":true,"functionCtor":2,"eval":2}`
+	if val != expected {
+		t.Fatalf("Local modules should see an untouched environment, got %v", val)
+	}
+}
+
+func TestRealmIsolation(t *testing.T) {
+	e, err := New()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer e.Close()
+	e.IsolateRemote(true)
+
+	remote, done := serveRemoteModules(t, filepath.Join("testdata", "realm"), "/mods/")
+	defer done()
+
+	val, err := e.InteractiveEval(fmt.Sprintf(`
+		let mod = require("%v/mods/module.js");
+		let secret = { secret: "original" };
+		let callback = function(v) { return v * 2; };
+		JSON.stringify({
+			cached: mod === require("%v/mods/module.js"),
+			frozen: Object.isFrozen(mod),
+			localArray: Object.getPrototypeOf(mod.data.list) === Array.prototype,
+			poisoned: [].poisoned === undefined,
+			list: mod.data.list,
+			when: mod.data.when instanceof Date && mod.data.when.getTime(),
+			add: mod.add(1, 2),
+			steal: mod.steal(secret),
+			secret: secret.secret,
+			stolen: globalThis.stolen === undefined,
+			callback: mod.callback(callback),
+			identity: mod.identity(callback) === callback,
+			fail: (function() {
+				try { mod.fail(); } catch (e) { return e instanceof Error && e.message; }
+			})(),
+		});
+	`, remote, remote))
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := `{"cached":true,"frozen":true,"localArray":true,"poisoned":true,` +
+		`"list":[1,2,{"nested":true}],"when":0,"add":3,"steal":"string","secret":"original",` +
+		`"stolen":true,"callback":41,"identity":true,"fail":"remote failure"}`
+	if val != expected {
+		t.Fatalf("Unexpected result:\n%v\n%v", val, expected)
+	}
+
+	val, err = e.InteractiveEval(fmt.Sprintf(`require("%v/mods/module.js").later(21)`, remote))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if val != int64(42) {
+		t.Fatalf("Promises should be settled by the realm, got %v", val)
+	}
+
+	modules := e.LoadedModules()
+	if len(modules) != 1 || modules[0].Trust != TrustRemote || modules[0].Hash == "" {
+		t.Fatalf("Realm modules should be tracked: %#v", modules)
+	}
+}
+
+func TestRedactedErrors(t *testing.T) {
+	e, err := New()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer e.Close()
+	logs := &bytes.Buffer{}
+	e.SetLogger(zerolog.New(logs))
+
+	remote, done := serveRemoteModules(t, filepath.Join("testdata", "redact"), "/mods/")
+	defer done()
+	remote = strings.Replace(remote, "http://", "http://user:secret@", 1)
+
+	val, err := e.InteractiveEval(fmt.Sprintf(`require("%v/mods/main.js")`, remote))
+	if err != nil {
+		t.Fatal(err)
+	}
+	idPattern := regexp.MustCompile(`\(error id: ([0-9a-f]{16})\)$`)
+	for name, msg := range val.(map[string]interface{}) {
+		msg := msg.(string)
+		match := idPattern.FindStringSubmatch(msg)
+		if match == nil {
+			t.Fatalf("%v: error should only contain a generic message and an id, got %q", name, msg)
+		}
+		if strings.Contains(msg, "secret") || strings.Contains(msg, "refused") || strings.Contains(msg, "cause") {
+			t.Fatalf("%v: error leaks private information: %q", name, msg)
+		}
+		if !strings.Contains(logs.String(), fmt.Sprintf(`"%v":"%v"`, ErrorIDField, match[1])) {
+			t.Fatalf("%v: error %v should be in the log: %v", name, match[1], logs.String())
+		}
+	}
+}
+
+func TestAudit(t *testing.T) {
+	e, err := New()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer e.Close()
+	var events []AuditEvent
+	e.SetAudit(func(ev AuditEvent) { events = append(events, ev) })
+	if err := e.Grant(Permissions{"@rawexec": []string{"echo"}}); err != nil {
+		t.Fatal(err)
+	}
+	err = e.AnchorModules(filepath.Join("testdata", "audit"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	remote, done := serveRemoteModules(t, filepath.Join("testdata", "remote"), "/mods/")
+	defer done()
+
+	_, err = e.InteractiveEval(fmt.Sprintf(`
+		require("./main.js").run();
+		require("%v/mods/other.js");
+	`, remote))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(events) != 4 {
+		t.Fatalf("Unexpected events: %#v", events)
+	}
+	if ev := events[0]; ev.Kind != AuditRequire || ev.Module != "main.js" || ev.Details["builtin"] != "@rawexec" {
+		t.Fatalf("Invalid require event: %#v", ev)
+	}
+	if ev := events[1]; ev.Kind != AuditExec || ev.Module != "main.js" || ev.Details["exitCode"] != 0 ||
+		len(ev.CallStack) == 0 || !strings.HasSuffix(ev.Details["binary"].(string), "echo") {
+		t.Fatalf("Invalid exec event: %#v", ev)
+	}
+	if ev := events[2]; ev.Kind != AuditExec || ev.Details["binary"] != "ls" || ev.Details["denied"] != true {
+		t.Fatalf("Invalid denied exec event: %#v", ev)
+	}
+	if ev := events[3]; ev.Kind != AuditNetwork || ev.Details["url"] != remote+"/mods/other.js" || ev.Details["status"] != 200 {
+		t.Fatalf("Invalid network event: %#v", ev)
+	}
+
+	logs := &bytes.Buffer{}
+	AuditToLogger(zerolog.New(logs))(events[1])
+	if !strings.Contains(logs.String(), `"kind":"exec"`) || !strings.Contains(logs.String(), `"args":["echo","hello"]`) {
+		t.Fatalf("Unexpected audit log: %v", logs.String())
+	}
+}
+
+func TestExecOptions(t *testing.T) {
+	e, err := New()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer e.Close()
+	stdout := &bytes.Buffer{}
+	e.ConnectStdio(nil, stdout, nil)
+	e.Unrestrict("@rawexec")
+	err = e.AnchorModules(filepath.Join("testdata", "exec"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if val := mustEval(t, e, `require("./main.js").env()`); val != "bar-\n" {
+		t.Fatalf("Environment should be explicit, got %q", val)
+	}
+	if val := mustEval(t, e, `require("./main.js").cwd("sub")`); !strings.HasSuffix(val.(string), filepath.Join("exec", "sub")) {
+		t.Fatalf("Process should run inside sub, got %v", val)
+	}
+	if val := mustEval(t, e, `require("./main.js").cwd(undefined)`); !strings.HasSuffix(val.(string), "exec") {
+		t.Fatalf("Process should run in the anchor, got %v", val)
+	}
+	for _, dir := range []string{"..", "/tmp", "missing"} {
+		if _, err := e.InteractiveEval(fmt.Sprintf(`require("./main.js").cwd(%q)`, dir)); err == nil {
+			t.Fatalf("cwd %v should be rejected", dir)
+		}
+	}
+	if val := mustEval(t, e, `require("./main.js").timeout()`).(map[string]interface{}); val["timedOut"] != true {
+		t.Fatalf("Process should time out: %v", val)
+	}
+	if val := mustEval(t, e, `require("./main.js").truncated()`).(map[string]interface{}); val["stdout"] != "0123" || val["truncated"] != true {
+		t.Fatalf("Output should be truncated: %v", val)
+	}
+	if val := fmt.Sprint(mustEval(t, e, `require("./main.js").stream()`)); !strings.Contains(val, "out:a") || !strings.Contains(val, "err:b") || !strings.Contains(val, "out:c") {
+		t.Fatalf("Lines should be streamed: %v", val)
+	}
+	if val := fmt.Sprint(mustEval(t, e, `require("./main.js").streamAsync()`)); val != "[a b]" {
+		t.Fatalf("Lines should be streamed from async calls: %v", val)
+	}
+	mustEval(t, e, `require("./main.js").forward()`)
+	if stdout.String() != "forwarded\n" {
+		t.Fatalf("Output should be forwarded: %q", stdout.String())
+	}
+	start := time.Now()
+	if _, err := e.InteractiveEval(`require("./main.js").failingCallback()`); err == nil || !strings.Contains(err.Error(), "stop") {
+		t.Fatalf("Callback errors should be reported: %v", err)
+	} else if time.Since(start) > 4*time.Second {
+		t.Fatal("Callback errors should kill the process")
+	}
+}
+
+func TestExecPolicy(t *testing.T) {
+	e, err := New()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer e.Close()
+	e.Unrestrict("@rawexec")
+	err = e.AnchorModules(filepath.Join("testdata", "exec"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, invalid := range [][]ExecRule{
+		{{Binary: "jtb-binary-that-does-not-exist"}},
+		{{Binary: "echo", Args: []string{"("}}},
+		{{Binary: "echo", Forbidden: []string{"bad"}}},
+	} {
+		if err := e.SetExecPolicy(invalid); err == nil {
+			t.Fatalf("Policy %v should be rejected", invalid)
+		}
+	}
+	rules, err := ParseExecPolicy([]byte(`
+- binary: echo
+  args: ["hello|world"]
+  forbidden: [--bad]
+`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := e.SetExecPolicy(rules); err != nil {
+		t.Fatal(err)
+	}
+	if val, err := e.InteractiveEval(`require("./main.js").run("echo", ["hello", "there"])`); err != nil || val != "hello there\n" {
+		t.Fatalf("Command should be allowed: %v / %v", val, err)
+	}
+	for args, reason := range map[string]string{
+		`"echo", ["bye"]`:              "argument 1 (bye) does not match hello|world",
+		`"echo", []`:                   "argument 1 is required",
+		`"echo", ["hello", "--bad=1"]`: "flag --bad is forbidden",
+		`"ls", []`:                     "is not in the allowlist",
+	} {
+		_, err := e.InteractiveEval(fmt.Sprintf(`require("./main.js").run(%v)`, args))
+		if !e.IsRestrictedCommand(err) || !strings.Contains(err.Error(), reason) {
+			t.Fatalf("run(%v) should be restricted with %q: %v", args, reason, err)
+		}
+	}
+	for _, code := range []string{"throw undefined", "throw null", `throw "ls"`, "throw {value: 1}", "undefinedFunction()"} {
+		_, err := e.InteractiveEval(code)
+		if err == nil || e.IsRestrictedCommand(err) {
+			t.Fatalf("%v should fail without a restricted command: %v", code, err)
+		}
+		if _, ok := e.IsRestrictedModule(err); ok {
+			t.Fatalf("%v should fail without a restricted module: %v", code, err)
+		}
+	}
+	if e.IsRestrictedCommand(nil) {
+		t.Fatal("nil is not a restricted command")
+	}
+	if err := e.SetExecPolicy(nil); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := e.InteractiveEval(`require("./main.js").run("echo", ["bye"])`); err != nil {
+		t.Fatalf("Removing the policy should allow any command: %v", err)
+	}
+}
+
+func TestExecPipeline(t *testing.T) {
+	e, err := New()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer e.Close()
+	var events []AuditEvent
+	e.SetAudit(func(ev AuditEvent) { events = append(events, ev) })
+	e.Unrestrict("@rawexec")
+	dir := t.TempDir()
+	if err := e.AnchorModules(dir); err != nil {
+		t.Fatal(err)
+	}
+	code, err := ioutil.ReadFile(filepath.Join("testdata", "exec", "main.js"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(filepath.Join(dir, "main.js"), code, 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	if val := fmt.Sprint(mustEval(t, e, `require("./main.js").pipeline()`)); val != "map[stages:[printf:0 sort:0 head:0] stdout:a\nb\n]" {
+		t.Fatalf("Unexpected pipeline result: %v", val)
+	}
+	if val := fmt.Sprint(mustEval(t, e, `require("./main.js").pipelineFailure(false)`)); val != "map[exitCode:0 stages:[3 0] stderr:oops\n]" {
+		t.Fatalf("Every stage should report its exit code: %v", val)
+	}
+	if _, err := e.InteractiveEval(`require("./main.js").pipelineFailure(true)`); err == nil || !strings.Contains(err.Error(), "stage 1 (sh) failed with status code 3") {
+		t.Fatalf("Strict pipelines should fail if any stage fails: %v", err)
+	}
+	events = nil
+	if val := mustEval(t, e, `require("./main.js").redirect("out.txt")`); val != "first\nSECOND\n" {
+		t.Fatalf("Output should be redirected to the file: %q", val)
+	}
+	if ev := events[0]; ev.Kind != AuditFileWrite || ev.Details["path"] != filepath.Join(dir, "out.txt") || ev.Details["append"] != false {
+		t.Fatalf("Redirects should be audited: %#v", ev)
+	}
+	for _, file := range []string{"../out.txt", "/tmp/out.txt"} {
+		if _, err := e.InteractiveEval(fmt.Sprintf(`require("./main.js").redirect(%q)`, file)); err == nil || !strings.Contains(err.Error(), "anchor") {
+			t.Fatalf("Redirects outside of the anchor should be rejected: %v", err)
+		}
+	}
+	if err := os.Symlink(os.TempDir(), filepath.Join(dir, "link")); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := e.InteractiveEval(`require("./main.js").redirect("link/out.txt")`); err == nil || !strings.Contains(err.Error(), "outside of the anchor") {
+		t.Fatalf("Redirects should not follow symlinks out of the anchor: %v", err)
+	}
+}
+
+func mustEval(t *testing.T, e *E, code string) interface{} {
+	t.Helper()
+	val, err := e.InteractiveEval(code)
+	if err != nil {
+		t.Fatalf("%v: %v", code, err)
+	}
+	return val
+}
+
+func TestExecLimits(t *testing.T) {
+	if goruntime.GOOS != "linux" {
+		t.Skip("resource limits and process groups are only supported on Linux")
+	}
+	e, err := New()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer e.Close()
+	e.Unrestrict("@rawexec")
+	err = e.AnchorModules(filepath.Join("testdata", "exec"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if val := mustEval(t, e, `require("./main.js").limits({ cpu: 1.5, files: 32, memory: 512 * 1024 * 1024 })`); val != "2\n32\n524288\n" {
+		t.Fatalf("Limits should be applied: %q", val)
+	}
+	if _, err := e.InteractiveEval(`require("./main.js").limits({ disk: 1 })`); err == nil || !strings.Contains(err.Error(), "unknown limit disk") {
+		t.Fatalf("Unknown limits should be rejected: %v", err)
+	}
+
+	pid := mustEval(t, e, `require("./main.js").orphan()`).(string)
+	deadline := time.Now().Add(time.Second)
+	for alive(pid) {
+		if time.Now().After(deadline) {
+			t.Fatalf("Process %v should be killed with its process group", pid)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	go func() {
+		time.Sleep(200 * time.Millisecond)
+		e.KillProcesses()
+	}()
+	start := time.Now()
+	if val := mustEval(t, e, `require("./main.js").sleep()`); val != int64(-1) || time.Since(start) > 5*time.Second {
+		t.Fatalf("Processes should be killed by KillProcesses: %v", val)
+	}
+	start = time.Now()
+	if val := mustEval(t, e, `require("./main.js").sleep()`); val != int64(-1) || time.Since(start) > 5*time.Second {
+		t.Fatalf("Processes cannot start after KillProcesses: %v", val)
+	}
+}
+
+// alive returns true if pid is running and is not a zombie
+func alive(pid string) bool {
+	stat, err := ioutil.ReadFile(filepath.Join("/proc", pid, "stat"))
+	if err != nil {
+		return false
+	}
+	fields := strings.Fields(string(stat[bytes.LastIndexByte(stat, ')')+1:]))
+	return len(fields) > 0 && fields[0] != "Z"
+}
+
+func TestStdioRead(t *testing.T) {
+	e, err := New()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer e.Close()
+	read := func(input string, code string) string {
+		t.Helper()
+		e.ConnectStdio(strings.NewReader(input), ioutil.Discard, ioutil.Discard)
+		val, err := e.InteractiveEval(`(function() {
+			const stdio = require("@stdio");
+			` + code + `
+		})()`)
+		if err != nil {
+			t.Fatalf("%v: %v", code, err)
+		}
+		return fmt.Sprint(val)
+	}
+	if val := read("first\r\nsecond\nrest\nof input", `
+		return [stdio.readLine(), stdio.readLine(), stdio.readAll(), stdio.readLine()].join("|");
+	`); val != "first|second|rest\nof input|" {
+		t.Fatalf("Unexpected lines: %q", val)
+	}
+	if val := read("a\nb\n\nc", `
+		const out = [];
+		for (const line of stdio.lines()) { out.push(line); }
+		return out.join(",");
+	`); val != "a,b,,c" {
+		t.Fatalf("Unexpected lines: %q", val)
+	}
+	if val := read(`{"a": 1} [2] "three"`, `
+		return JSON.stringify(Array.from(stdio.readJSON()));
+	`); val != `[{"a":1},[2],"three"]` {
+		t.Fatalf("Unexpected JSON values: %v", val)
+	}
+	if val := read(`{"kind": "List", "metadata": {"x": [1]}, "items": [{"name": "a"}, {"name": "b"}], "after": true}
+		{"items": []} {"other": [1]} {"items": [{"name": "c"}]}`, `
+		const names = [];
+		for (const item of stdio.readJSON({ path: ["items"] })) { names.push(item.name); }
+		return names.join(",");
+	`); val != "a,b,c" {
+		t.Fatalf("Unexpected items: %v", val)
+	}
+	if val := read(`[1, 2, 3]`, `
+		return Array.from(stdio.readJSON({ path: [] })).join(",");
+	`); val != "1,2,3" {
+		t.Fatalf("Unexpected elements: %v", val)
+	}
+	if val := read("{\"a\": 1}\n\n{\"a\": 2}\n", `
+		return Array.from(stdio.readNDJSON()).map((v) => v.a).join(",");
+	`); val != "1,2" {
+		t.Fatalf("Unexpected NDJSON values: %v", val)
+	}
+	if val := read("name: first\n---\nname: second\nlist: [1, 2]\n", `
+		return JSON.stringify(Array.from(stdio.readYAML()));
+	`); val != `[{"name":"first"},{"list":[1,2],"name":"second"}]` {
+		t.Fatalf("Unexpected YAML documents: %v", val)
+	}
+	for input, code := range map[string]string{
+		"{\"a\": 1}\nnot json\n": `Array.from(stdio.readNDJSON())`,
+		`{"items": {}}`:          `Array.from(stdio.readJSON({ path: ["items"] }))`,
+		"a: [":                   `Array.from(stdio.readYAML())`,
+	} {
+		e.ConnectStdio(strings.NewReader(input), ioutil.Discard, ioutil.Discard)
+		if _, err := e.InteractiveEval(`(function() { const stdio = require("@stdio"); ` + code + `})()`); err == nil {
+			t.Fatalf("%v should fail for %q", code, input)
+		}
+	}
+}
+
+func TestStdioWrite(t *testing.T) {
+	e, err := New()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer e.Close()
+	write := func(code string) (string, string) {
+		t.Helper()
+		var stdout, stderr bytes.Buffer
+		e.ConnectStdio(strings.NewReader(""), &stdout, &stderr)
+		if _, err := e.InteractiveEval(`(function() {
+			const stdio = require("@stdio");
+			` + code + `
+		})()`); err != nil {
+			t.Fatalf("%v: %v", code, err)
+		}
+		return stdout.String(), stderr.String()
+	}
+	if out, _ := write(`stdio.writeJSON({ b: 1, a: ["<x>", null], f: () => 1 });`); out != "{\n  \"b\": 1,\n  \"a\": [\n    \"<x>\",\n    null\n  ]\n}\n" {
+		t.Fatalf("Unexpected JSON: %q", out)
+	}
+	if out, _ := write(`stdio.writeJSON({ b: 1, a: { d: 2, c: 3 } }, { indent: 0, sortKeys: true });`); out != `{"a":{"c":3,"d":2},"b":1}`+"\n" {
+		t.Fatalf("Unexpected sorted JSON: %q", out)
+	}
+	if out, _ := write(`stdio.writeNDJSON(new Set([{ b: 1, a: 2 }, "two"]), { indent: 4 });`); out != "{\"b\":1,\"a\":2}\n\"two\"\n" {
+		t.Fatalf("Unexpected NDJSON: %q", out)
+	}
+	if _, errOut := write(`stdio.writeYAML({ name: "x", tags: ["true", 1], nested: { z: 1, a: 2 } }, { stderr: true });`); errOut != "name: x\ntags:\n  - \"true\"\n  - 1\nnested:\n  z: 1\n  a: 2\n" {
+		t.Fatalf("Unexpected YAML: %q", errOut)
+	}
+	if out, _ := write(`stdio.writeYAML({ z: 1, a: 2 }, { sortKeys: true });`); out != "a: 2\nz: 1\n" {
+		t.Fatalf("Unexpected sorted YAML: %q", out)
+	}
+	if out, _ := write(`stdio.writeTable([{ name: "web", ready: true }, { name: "database", extra: { a: 1 } }]);`); out != "name      ready  extra\nweb       true   \ndatabase         {\"a\":1}\n" {
+		t.Fatalf("Unexpected table: %q", out)
+	}
+	if out, _ := write(`stdio.writeTable([{ name: "web", replicas: 3 }], ["replicas", { key: "name", title: "NAME" }]);`); out != "replicas  NAME\n3         web\n" {
+		t.Fatalf("Unexpected table with columns: %q", out)
+	}
+	if out, _ := write(`stdio.writeJSON({ a: 1 }, { indent: 0 });`); strings.Contains(out, "\x1b[") {
+		t.Fatalf("Output should not be colored: %q", out)
+	}
+	e.UseColors(true, false)
+	if out, _ := write(`stdio.writeJSON({ a: "b" }, { indent: 0 });`); out != "{\x1b[34m\"a\"\x1b[0m:\x1b[32m\"b\"\x1b[0m}\n" {
+		t.Fatalf("Unexpected colored JSON: %q", out)
+	}
+	if out, _ := write(`stdio.writeJSON({ a: 1 }, { indent: 0, color: false });`); out != "{\"a\":1}\n" {
+		t.Fatalf("Color should be disabled: %q", out)
+	}
+	for _, code := range []string{
+		`stdio.writeJSON(undefined)`,
+		`const a = {}; a.self = a; stdio.writeJSON(a)`,
+		`stdio.writeNDJSON(1)`,
+		`stdio.writeTable([1])`,
+	} {
+		if _, err := e.InteractiveEval(`(function() { const stdio = require("@stdio"); ` + code + `})()`); err == nil {
+			t.Fatalf("%v should fail", code)
+		}
+	}
+}
+
+func TestConsole(t *testing.T) {
+	e, err := New()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer e.Close()
+	var stderr bytes.Buffer
+	e.ConnectStdio(strings.NewReader(""), ioutil.Discard, &stderr)
+	print := func(code string) string {
+		t.Helper()
+		stderr.Reset()
+		if _, err := e.InteractiveEval(code); err != nil {
+			t.Fatalf("%v: %v", code, err)
+		}
+		return stderr.String()
+	}
+	if out := print(`console.log("hello", 1, { a: true }); console.warn("w"); console.error("e"); console.debug("d")`); out != "\"hello\" 1 {\"a\":true}\n\"w\"\n\"e\"\n\"d\"\n" {
+		t.Fatalf("Unexpected output: %q", out)
+	}
+	if out := print(`console.assert(true, "never"); console.assert(1 > 2, "math")`); out != "\"Assertion failed\" \"math\"\n" {
+		t.Fatalf("Unexpected assert output: %q", out)
+	}
+	if out := print(`console.assert()`); out != "\"Assertion failed\"\n" {
+		t.Fatalf("Assert without arguments should fail without a message: %q", out)
+	}
+	if out := print(`console.count(); console.count(); console.count("x"); console.countReset(); console.count()`); out != "\"default: 1\"\n\"default: 2\"\n\"x: 1\"\n\"default: 1\"\n" {
+		t.Fatalf("Unexpected count output: %q", out)
+	}
+	if out := print(`console.group("outer"); console.info("a"); console.group(); console.info("b"); console.groupEnd(); console.groupEnd(); console.groupEnd(); console.info("c")`); out != "\"outer\"\n  \"a\"\n    \"b\"\n\"c\"\n" {
+		t.Fatalf("Unexpected group output: %q", out)
+	}
+	if out := print(`console.table([{ name: "a", n: 1 }, { name: "bb" }]); console.table(42)`); out != "name  n\na     1\nbb    \n42\n" {
+		t.Fatalf("Unexpected table output: %q", out)
+	}
+	if out := print(`console.time("t"); console.timeEnd("t"); console.timeEnd("t")`); !strings.HasPrefix(out, "\"t: ") || !strings.HasSuffix(out, "\"Timer 't' does not exist\"\n") {
+		t.Fatalf("Unexpected timer output: %q", out)
+	}
+	if out := print(`(function traced() { console.trace("here") })()`); !strings.HasPrefix(out, "\"here\"\n    at traced @ ") {
+		t.Fatalf("Unexpected trace output: %q", out)
+	}
+
+	e.SetConsoleLevel(zerolog.WarnLevel)
+	if out := print(`console.trace("t"); console.debug("d"); console.log("l"); console.table([{ a: 1 }]); console.warn("w"); console.error("e")`); out != "\"w\"\n\"e\"\n" {
+		t.Fatalf("Messages below warn should be hidden: %q", out)
+	}
+
+	var logs bytes.Buffer
+	e.SetLogger(zerolog.New(&logs))
+	e.ConsoleToLogger(true)
+	if err := e.AnchorModules(filepath.Join("testdata", "console")); err != nil {
+		t.Fatal(err)
+	}
+	if out := print(`require("./main.js")`); out != "" {
+		t.Fatalf("Console should go to the logger, got %q", out)
+	}
+	var ev map[string]interface{}
+	if err := json.Unmarshal(logs.Bytes(), &ev); err != nil {
+		t.Fatalf("Unexpected log %q: %v", logs.String(), err)
+	}
+	if ev["level"] != "error" || ev["message"] != `"from module" 1` || ev["source"] != "console" || !strings.HasSuffix(fmt.Sprint(ev["module"]), "main.js") {
+		t.Fatalf("Unexpected log event: %v", ev)
+	}
+}
+
+func TestConsolePlainText(t *testing.T) {
+	e, err := New()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer e.Close()
+	var stderr bytes.Buffer
+	e.ConnectStdio(strings.NewReader(""), ioutil.Discard, &stderr)
+	print := func(code string) string {
+		t.Helper()
+		stderr.Reset()
+		if _, err := e.InteractiveEval(code); err != nil {
+			t.Fatalf("%v: %v", code, err)
+		}
+		return stderr.String()
+	}
+	if out := print(`console.log("a b", function named() {})`); out != "\"a b\" [Function: named]\n" {
+		t.Fatalf("Functions should not be printed as Go values: %q", out)
+	}
+
+	e.ConsolePlainText(true)
+	for code, expected := range map[string]string{
+		`console.log("hello", 1, { a: true }); console.warn("w")`:                                              "hello 1 {\"a\":true}\nw\n",
+		`console.assert(1 > 2, "math")`:                                                                        "Assertion failed math\n",
+		`console.count(); console.count("x")`:                                                                  "default: 1\nx: 1\n",
+		`console.group("outer"); console.info("a"); console.groupEnd()`:                                        "outer\n  a\n",
+		`console.log(undefined, null, [1, "x"], function named() {}, () => 1, new Error("boom"), Symbol("s"))`: "undefined null [1,\"x\"] [Function: named] [Function (anonymous)] Error: boom Symbol(s)\n",
+		`const cyclic = { a: 1 }; cyclic.self = cyclic; console.log(cyclic, new Date(0))`:                      "[object Object] 1970-01-01T00:00:00.000Z\n",
+	} {
+		if out := print(code); out != expected {
+			t.Fatalf("%v should print %q, got %q", code, expected, out)
+		}
+	}
+	if out := print(`console.time("t"); console.timeEnd("t")`); !strings.HasPrefix(out, "t: ") {
+		t.Fatalf("Unexpected timer output: %q", out)
+	}
+}
+
+func TestSecrets(t *testing.T) {
+	const secret = "s3cr3t-value"
+	os.Setenv("JTB_TEST_SECRET", secret)
+	defer os.Unsetenv("JTB_TEST_SECRET")
+
+	e, err := New()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer e.Close()
+	var stderr, logs bytes.Buffer
+	var events []AuditEvent
+	e.ConnectStdio(strings.NewReader(""), ioutil.Discard, &stderr)
+	e.SetLogger(zerolog.New(e.RedactWriter(&logs)))
+	e.SetAudit(func(ev AuditEvent) { events = append(events, ev) })
+	if err := e.AnchorModules(filepath.Join("testdata", "secrets")); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := e.InteractiveEval(`require("@secrets")`); err == nil {
+		t.Fatal("@secrets should be restricted by default")
+	}
+	e.Unrestrict("@secrets")
+	e.Unrestrict("@rawexec")
+
+	if val := mustEval(t, e, `require("./main.js").print("JTB_TEST_SECRET")`); val != `{"token":"[secret JTB_TEST_SECRET]"}` {
+		t.Fatalf("Handles should not expose the value: %v", val)
+	}
+	if out := stderr.String(); out != "\"token:\" {\"name\":\"JTB_TEST_SECRET\",\"source\":\"env\"} \"[secret JTB_TEST_SECRET]\" true false\n\"[REDACTED]\"\n" {
+		t.Fatalf("Unexpected console output: %q", out)
+	}
+	stderr.Reset()
+	if val := mustEval(t, e, `require("./main.js").file("token.txt")`); val != int64(len("file-secret-123")) {
+		t.Fatalf("The file secret should be passed to the process: %v", val)
+	}
+	if out := stderr.String(); out != "\"file:\" \"[REDACTED]\"\n" {
+		t.Fatalf("Unexpected console output: %q", out)
+	}
+	if _, err := e.InteractiveEval(`require("@secrets").file("../engine_test.go")`); err == nil || !strings.Contains(err.Error(), "outside of the anchor") {
+		t.Fatalf("Secrets cannot be loaded from outside of the anchor: %v", err)
+	}
+	if _, err := e.InteractiveEval(`require("@secrets").env("JTB_MISSING_SECRET")`); err == nil || !strings.Contains(err.Error(), "is not set") {
+		t.Fatalf("Missing variables should fail: %v", err)
+	}
+
+	_, err = e.InteractiveEval(`throw new Error("leaked ` + secret + `")`)
+	e.logError("test", err)
+	if strings.Contains(logs.String(), secret) || !strings.Contains(logs.String(), "leaked [REDACTED]") {
+		t.Fatalf("Logs should be redacted: %v", logs.String())
+	}
+	if got := e.Redact(FormatError(err)); strings.Contains(got, secret) {
+		t.Fatalf("Errors should be redacted: %v", got)
+	}
+	var loaded []string
+	for _, ev := range events {
+		if ev.Kind == AuditSecret {
+			loaded = append(loaded, fmt.Sprintf("%v:%v", ev.Details["source"], ev.Details["name"]))
+		}
+		if strings.Contains(fmt.Sprint(ev.Details), secret) {
+			t.Fatalf("Audit events should not contain secrets: %v", ev)
+		}
+	}
+	if strings.Join(loaded, ",") != "env:JTB_TEST_SECRET,file:token.txt" {
+		t.Fatalf("Unexpected audit events: %v", loaded)
+	}
+
+	if err := e.Grant(Permissions{"@secrets": {"JTB_*"}}); err != nil {
+		t.Fatal(err)
+	}
+	mustEval(t, e, `require("@secrets").env("JTB_TEST_SECRET")`)
+	if _, err := e.InteractiveEval(`require("@secrets").file("token.txt")`); err == nil || !strings.Contains(err.Error(), "not allowed") {
+		t.Fatalf("Secrets outside of the granted scopes should fail: %v", err)
+	}
+}
+
+func TestProcess(t *testing.T) {
+	os.Setenv("JTB_VISIBLE_VAR", "visible")
+	os.Setenv("JTB_HIDDEN_VAR", "hidden")
+	defer os.Unsetenv("JTB_VISIBLE_VAR")
+	defer os.Unsetenv("JTB_HIDDEN_VAR")
+
+	e, err := New()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer e.Close()
+	var stderr bytes.Buffer
+	e.ConnectStdio(strings.NewReader(""), ioutil.Discard, &stderr)
+	e.SetArgs([]string{"a", "b"})
+	e.AllowEnv("JTB_VISIBLE_*")
+	if val := mustEval(t, e, `const p = require("@process"); JSON.stringify([p.argv, p.env.JTB_VISIBLE_VAR, p.env.JTB_HIDDEN_VAR, p.env.PATH])`); val != `[["a","b"],"visible",null,null]` {
+		t.Fatalf("Unexpected argv and env: %v", val)
+	}
+
+	for _, tc := range []struct {
+		anchor string
+		cwd    interface{}
+	}{
+		{".", "."},
+		{"..", "engine"},
+		{filepath.Join("testdata", "process"), nil},
+	} {
+		if err := e.AnchorModules(tc.anchor); err != nil {
+			t.Fatal(err)
+		}
+		if val := mustEval(t, e, `require("@process").cwd()`); val != tc.cwd {
+			t.Fatalf("cwd should be %v with anchor %v, got %v", tc.cwd, tc.anchor, val)
+		}
+	}
+
+	var exit *ExitError
+	_, err = e.InteractiveEval(`require("./main.js").run(3); console.info("after run")`)
+	if !errors.As(err, &exit) || exit.Code != 3 {
+		t.Fatalf("exit should return an ExitError with code 3, got %v", err)
+	}
+	if out := stderr.String(); out != "\"hook\" 3\n" {
+		t.Fatalf("exit should run the hooks and stop the script: %q", out)
+	}
+	if val := mustEval(t, e, `1 + 1`); val != int64(2) {
+		t.Fatalf("The engine should be usable after exit: %v", val)
+	}
+	for code, script := range map[int]string{
+		0: `require("@process").exit()`,
+		4: `setTimeout(() => require("@process").exit(4), 1)`,
+		5: `new Promise((resolve) => setTimeout(resolve, 1)).then(() => require("@process").exit(5))`,
+	} {
+		_, err := e.InteractiveEval(script)
+		if !errors.As(err, &exit) || exit.Code != code {
+			t.Fatalf("%v should exit with %v, got %v", script, code, err)
+		}
+	}
+	if out := stderr.String(); out != "\"hook\" 3\n" {
+		t.Fatalf("Hooks should only run once: %q", out)
+	}
+	if _, err := e.InteractiveEval(`require("@process").exit(256)`); err == nil || errors.As(err, &exit) {
+		t.Fatalf("Invalid exit codes should fail: %v", err)
+	}
+
+	stderr.Reset()
+	other, err := New()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer other.Close()
+	other.ConnectStdio(strings.NewReader(""), ioutil.Discard, &stderr)
+	mustEval(t, other, `require("@process").onExit((code) => console.info("done", code))`)
+	if err := other.RunExitHooks(1); err != nil {
+		t.Fatal(err)
+	}
+	if err := other.RunExitHooks(1); err != nil {
+		t.Fatal(err)
+	}
+	if out := stderr.String(); out != "\"done\" 1\n" {
+		t.Fatalf("Unexpected hook output: %q", out)
+	}
+
+	remote, done := serveRemoteModules(t, filepath.Join("testdata", "remote"), "/mods/")
+	defer done()
+	if _, err := e.InteractiveEval(fmt.Sprintf(`require("%v/mods/process.js")`, remote)); err == nil {
+		t.Fatal("Remote modules should not be able to require @process")
+	}
+	for _, isolate := range []bool{false, true} {
+		e.IsolateRemote(isolate)
+		for _, fn := range []string{"builtin", "local", "later"} {
+			code := fmt.Sprintf(`require("%v/mods/globalRequire.js").%v()`, remote, fn)
+			if _, err := e.InteractiveEval(code); err == nil || !strings.Contains(err.Error(), "not allowed from remote hosts") {
+				t.Fatalf("Remote modules should not be able to use globalThis.require (%v, isolated: %v): %v", fn, isolate, err)
+			}
+		}
+	}
+	if val := mustEval(t, e, `JSON.stringify(globalThis.require("@process").argv)`); val != `["a","b"]` {
+		t.Fatalf("The global require should still work for local code: %v", val)
+	}
+}
+
+func TestFetch(t *testing.T) {
+	var tokens []string
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		tokens = append(tokens, r.Header.Values("X-Token")...)
+		switch r.URL.Path {
+		case "/json":
+			fmt.Fprintf(w, `{"method": %q, "token": %q}`, r.Method, r.Header.Get("X-Token"))
+		default:
+			w.WriteHeader(http.StatusTeapot)
+			fmt.Fprint(w, "not json")
+		}
+	}))
+	defer server.Close()
+
+	e, err := New()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer e.Close()
+	var events []AuditEvent
+	e.SetAudit(func(ev AuditEvent) { events = append(events, ev) })
+	if _, err := e.InteractiveEval(`require("@rawfetch")`); err == nil {
+		t.Fatal("@rawfetch should be restricted by default")
+	}
+	e.Unrestrict("@rawfetch")
+
+	url := server.URL
+	if val := mustEval(t, e, `const v = require("@rawfetch").getJSON("`+url+`/json"); v.method + ":" + v.token`); val != "GET:" {
+		t.Fatalf("Unexpected getJSON result: %v", val)
+	}
+	if val := mustEval(t, e, `require("@rawfetch").getJSON_async("`+url+`/json").then((v) => v.method)`); val != "GET" {
+		t.Fatalf("Unexpected getJSON_async result: %v", val)
+	}
+	if val := mustEval(t, e, `require("@rawfetch").doHTTP_async("`+url+`/other", { Method: "POST", Headers: { "X-Token": "abc" } })
+		.then((res) => res.statusCode + " " + String.fromCharCode(...res.bytes))`); val != "418 not json" {
+		t.Fatalf("Unexpected doHTTP_async result: %v", val)
+	}
+	if val := mustEval(t, e, `require("@rawfetch").getJSON_async("`+url+`/other").then(() => "resolved", (e) => e.message)`); !strings.Contains(fmt.Sprint(val), "Unable to fetch resources") {
+		t.Fatalf("Invalid JSON should reject the promise: %v", val)
+	}
+	var requests []AuditEvent
+	for _, ev := range events {
+		if ev.Kind == AuditNetwork {
+			requests = append(requests, ev)
+		}
+	}
+	if len(requests) != 4 || requests[2].Details["method"] != "POST" || requests[2].Details["status"] != http.StatusTeapot {
+		t.Fatalf("Every request should be audited: %v", requests)
+	}
+
+	const secret = "fetch-s3cr3t"
+	os.Setenv("JTB_TEST_FETCH_SECRET", secret)
+	defer os.Unsetenv("JTB_TEST_FETCH_SECRET")
+	var stderr bytes.Buffer
+	e.ConnectStdio(nil, nil, &stderr)
+	e.Unrestrict("@secrets")
+	tokens = nil
+	mustEval(t, e, `(function() {
+		const token = require("@secrets").env("JTB_TEST_FETCH_SECRET");
+		const fetch = require("@rawfetch");
+		fetch.doHTTP("`+url+`/other", { Headers: { "X-Token": token } });
+		const res = fetch.doHTTP("`+url+`/json", { Headers: { "X-Token": [token, "plain"] } });
+		console.info("sent", token, String.fromCharCode(...res.bytes));
+	})()`)
+	if fmt.Sprint(tokens) != "["+secret+" "+secret+" plain]" {
+		t.Fatalf("Secret handles should be revealed in headers, got %v", tokens)
+	}
+	if out := stderr.String(); strings.Contains(out, secret) || !strings.Contains(out, `"sent" {"name":"JTB_TEST_FETCH_SECRET","source":"env"}`) {
+		t.Fatalf("Secrets should never be printed: %q", out)
+	}
+	for _, ev := range events {
+		if strings.Contains(fmt.Sprint(ev.Details), secret) {
+			t.Fatalf("Secrets should not be audited: %v", ev)
+		}
+	}
+}
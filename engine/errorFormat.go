@@ -0,0 +1,62 @@
+package engine
+
+import (
+	"errors"
+	"regexp"
+	"strings"
+
+	"github.com/dop251/goja"
+)
+
+var (
+	// goja appends the program counter to every frame, eg.: main.js:1:10(3)
+	framePC = regexp.MustCompile(`\(\d+\)$`)
+	// hiddenFrame matches frames that don't point to javascript code written
+	// by the user: go functions exposed to javascript and the synthetic
+	// scripts created by InteractiveEval
+	hiddenFrame = regexp.MustCompile(`\(native\)$|^at (\S+ \()?__eval_statement_\d+\.js:`)
+)
+
+// FormatError returns a readable multi-line description of err.
+//
+// Every javascript exception in the chain of errors is printed with its
+// own stack, so errors raised inside required modules can be traced back
+// to the original file, line and column.
+func FormatError(err error) string {
+	var b strings.Builder
+	for depth := 0; err != nil; depth++ {
+		var ex *goja.Exception
+		if !errors.As(err, &ex) {
+			if depth == 0 {
+				b.WriteString(err.Error())
+				b.WriteString("\n")
+			}
+			break
+		}
+		if depth > 0 {
+			b.WriteString("caused by: ")
+		}
+		writeException(&b, ex)
+		err = ex.Unwrap()
+	}
+	return b.String()
+}
+
+func writeException(b *strings.Builder, ex *goja.Exception) {
+	stack := ex.String()
+	if ex.Value() != nil {
+		msg := ex.Value().String()
+		b.WriteString(msg)
+		b.WriteString("\n")
+		stack = strings.TrimPrefix(stack, msg+"\n")
+	}
+	for _, l := range strings.Split(stack, "\n") {
+		l = strings.TrimSpace(l)
+		if !strings.HasPrefix(l, "at ") || hiddenFrame.MatchString(l) {
+			continue
+		}
+		b.WriteString("    ")
+		b.WriteString(framePC.ReplaceAllString(l, ""))
+		b.WriteString("\n")
+	}
+}
@@ -0,0 +1,392 @@
+package engine
+
+import (
+	"container/heap"
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/andrebq/jtb/internal/modules/modutils"
+	"github.com/dop251/goja"
+)
+
+type (
+	// eventLoop runs timers and async work scheduled by scripts.
+	//
+	// Callbacks are always executed from the goroutine that is evaluating code,
+	// other goroutines only push functions to queue and wake the loop up.
+	// Timers are kept in a queue ordered by their deadline and then by the
+	// order they were scheduled, so timers with the same deadline fire in
+	// the order they were created.
+	eventLoop struct {
+		e *E
+
+		mu     sync.Mutex
+		queue  []func()
+		closed bool
+
+		wakeup chan struct{}
+
+		// fields below are only accessed from the runtime goroutine
+		generation int
+		pending    int
+		nextTimer  int64
+		nextSeq    int64
+		timers     map[int64]*loopTimer
+		timerQueue timerQueue
+		err        error
+		rejected   []*goja.Promise
+
+		queueMicrotask goja.Callable
+	}
+
+	loopTimer struct {
+		id       int64
+		deadline time.Time
+		seq      int64
+		callback goja.Callable
+		args     []goja.Value
+		interval time.Duration
+		// index in the timer queue, -1 if the timer is not queued
+		index int
+	}
+
+	// timerQueue implements heap.Interface
+	timerQueue []*loopTimer
+)
+
+var (
+	queueMicrotaskProgram = goja.MustCompile("__goja__queueMicrotask.js", `(function(fn){
+		Promise.resolve().then(function() { fn(); });
+	})`, true)
+)
+
+func newEventLoop(e *E) *eventLoop {
+	l := &eventLoop{
+		e:      e,
+		wakeup: make(chan struct{}, 1),
+		timers: make(map[int64]*loopTimer),
+	}
+	e.runtime.SetPromiseRejectionTracker(l.trackRejection)
+	return l
+}
+
+func (l *eventLoop) defineGlobals() error {
+	fn, err := l.e.runtime.RunProgram(queueMicrotaskProgram)
+	if err != nil {
+		return err
+	}
+	l.queueMicrotask, _ = goja.AssertFunction(fn)
+
+	for name, fn := range map[string]func(goja.FunctionCall) goja.Value{
+		"setTimeout":     l.setTimeout,
+		"setInterval":    l.setInterval,
+		"clearTimeout":   l.clearTimer,
+		"clearInterval":  l.clearTimer,
+		"queueMicrotask": l.jsQueueMicrotask,
+	} {
+		if err := l.e.registerGlobalFunc(name, fn); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Async implements modutils.Loop
+func (l *eventLoop) Async(work func() modutils.Settle) goja.Value {
+	promise, resolve, reject := l.e.runtime.NewPromise()
+	l.pending++
+	generation := l.generation
+	go func() {
+		settle := work()
+		l.enqueue(func() {
+			if generation != l.generation {
+				// the loop was reset while work was running
+				return
+			}
+			l.pending--
+			val, err := settle()
+			var ex *goja.Exception
+			if errors.As(err, &ex) {
+				// javascript errors are rejected as they were thrown
+				reject(ex.Value())
+				return
+			} else if err != nil {
+				reject(modutils.NewGoError(l.e.runtime, err))
+				return
+			}
+			resolve(val)
+		})
+	}()
+	return l.e.runtime.ToValue(promise)
+}
+
+// Scheduler implements modutils.Loop
+func (l *eventLoop) Scheduler() func(fn func()) {
+	generation := l.generation
+	return func(fn func()) {
+		l.enqueue(func() {
+			if generation != l.generation {
+				return
+			}
+			fn()
+		})
+	}
+}
+
+// drain blocks until there are no more timers or async operations pending,
+// or until a callback fails.
+//
+// If result is a promise, drain returns the value it was settled with.
+func (l *eventLoop) drain(result goja.Value) (goja.Value, error) {
+	for l.err == nil && l.pending > 0 {
+		l.runQueued()
+		l.runTimers()
+		if l.err != nil || l.pending == 0 {
+			break
+		}
+		l.wait()
+	}
+	if l.err != nil {
+		err := l.err
+		l.reset()
+		return nil, err
+	}
+	var promise *goja.Promise
+	if result != nil {
+		promise, _ = result.Export().(*goja.Promise)
+	}
+	if promise != nil {
+		// the caller handles the result
+		l.forgetRejection(promise)
+	}
+	if err := l.unhandledRejection(); err != nil {
+		return nil, err
+	}
+	if promise == nil {
+		return result, nil
+	}
+	switch promise.State() {
+	case goja.PromiseStateFulfilled:
+		return promise.Result(), nil
+	case goja.PromiseStateRejected:
+		return nil, fmt.Errorf("promise rejected: %v", promise.Result())
+	}
+	return nil, errors.New("promise is still pending but there is nothing left to run on the event loop")
+}
+
+// wait blocks until work is enqueued or the next timer expires
+func (l *eventLoop) wait() {
+	if len(l.timerQueue) == 0 {
+		<-l.wakeup
+		return
+	}
+	timer := time.NewTimer(time.Until(l.timerQueue[0].deadline))
+	defer timer.Stop()
+	select {
+	case <-l.wakeup:
+	case <-timer.C:
+	}
+}
+
+// runTimers fires every timer that expired, in order
+func (l *eventLoop) runTimers() {
+	now := time.Now()
+	for l.err == nil && len(l.timerQueue) > 0 && !l.timerQueue[0].deadline.After(now) {
+		l.fire(heap.Pop(&l.timerQueue).(*loopTimer))
+	}
+}
+
+func (l *eventLoop) runQueued() {
+	l.mu.Lock()
+	queue := l.queue
+	l.queue = nil
+	l.mu.Unlock()
+	for _, fn := range queue {
+		if l.err != nil {
+			return
+		}
+		fn()
+	}
+}
+
+func (l *eventLoop) enqueue(fn func()) {
+	l.mu.Lock()
+	if l.closed {
+		l.mu.Unlock()
+		return
+	}
+	l.queue = append(l.queue, fn)
+	l.mu.Unlock()
+	select {
+	case l.wakeup <- struct{}{}:
+	default:
+	}
+}
+
+// reset cancels all timers, async work that is still running
+// will be ignored once it finishes.
+func (l *eventLoop) reset() {
+	for id := range l.timers {
+		delete(l.timers, id)
+	}
+	l.timerQueue = nil
+	l.mu.Lock()
+	l.queue = nil
+	l.mu.Unlock()
+	l.generation++
+	l.pending = 0
+	l.err = nil
+	l.rejected = nil
+}
+
+func (l *eventLoop) close() {
+	l.reset()
+	l.mu.Lock()
+	l.closed = true
+	l.mu.Unlock()
+}
+
+func (l *eventLoop) trackRejection(p *goja.Promise, op goja.PromiseRejectionOperation) {
+	switch op {
+	case goja.PromiseRejectionReject:
+		l.rejected = append(l.rejected, p)
+	case goja.PromiseRejectionHandle:
+		l.forgetRejection(p)
+	}
+}
+
+func (l *eventLoop) forgetRejection(p *goja.Promise) {
+	for i, v := range l.rejected {
+		if v == p {
+			l.rejected = append(l.rejected[:i], l.rejected[i+1:]...)
+			return
+		}
+	}
+}
+
+func (l *eventLoop) unhandledRejection() error {
+	if len(l.rejected) == 0 {
+		return nil
+	}
+	reason := l.rejected[0].Result()
+	l.rejected = nil
+	return fmt.Errorf("unhandled promise rejection: %v", reason)
+}
+
+func (l *eventLoop) setTimeout(call goja.FunctionCall) goja.Value {
+	return l.schedule(call, false)
+}
+
+func (l *eventLoop) setInterval(call goja.FunctionCall) goja.Value {
+	return l.schedule(call, true)
+}
+
+func (l *eventLoop) schedule(call goja.FunctionCall, repeat bool) goja.Value {
+	callback, ok := goja.AssertFunction(call.Argument(0))
+	if !ok {
+		panic(l.e.runtime.NewTypeError("callback must be a function"))
+	}
+	delay := time.Duration(call.Argument(1).ToFloat() * float64(time.Millisecond))
+	if delay < 0 {
+		delay = 0
+	}
+	var args []goja.Value
+	if len(call.Arguments) > 2 {
+		args = append(args, call.Arguments[2:]...)
+	}
+	l.nextTimer++
+	t := &loopTimer{
+		id:       l.nextTimer,
+		callback: callback,
+		args:     args,
+	}
+	if repeat {
+		t.interval = delay
+		if t.interval < time.Millisecond {
+			t.interval = time.Millisecond
+		}
+	}
+	l.timers[t.id] = t
+	l.pending++
+	l.queueTimer(t, delay)
+	return l.e.runtime.ToValue(t.id)
+}
+
+// queueTimer adds t to the timer queue to fire after delay
+func (l *eventLoop) queueTimer(t *loopTimer, delay time.Duration) {
+	l.nextSeq++
+	t.seq = l.nextSeq
+	t.deadline = time.Now().Add(delay)
+	heap.Push(&l.timerQueue, t)
+}
+
+func (l *eventLoop) fire(t *loopTimer) {
+	if t.interval == 0 {
+		delete(l.timers, t.id)
+		l.pending--
+	} else {
+		l.queueTimer(t, t.interval)
+	}
+	_, err := t.callback(goja.Undefined(), t.args...)
+	if err != nil {
+		l.err = err
+	}
+}
+
+func (l *eventLoop) clearTimer(call goja.FunctionCall) goja.Value {
+	id := call.Argument(0).ToInteger()
+	if t := l.timers[id]; t != nil {
+		if t.index >= 0 {
+			heap.Remove(&l.timerQueue, t.index)
+		}
+		delete(l.timers, id)
+		l.pending--
+	}
+	return goja.Undefined()
+}
+
+func (q timerQueue) Len() int { return len(q) }
+
+func (q timerQueue) Less(i, j int) bool {
+	if q[i].deadline.Equal(q[j].deadline) {
+		return q[i].seq < q[j].seq
+	}
+	return q[i].deadline.Before(q[j].deadline)
+}
+
+func (q timerQueue) Swap(i, j int) {
+	q[i], q[j] = q[j], q[i]
+	q[i].index = i
+	q[j].index = j
+}
+
+func (q *timerQueue) Push(x interface{}) {
+	t := x.(*loopTimer)
+	t.index = len(*q)
+	*q = append(*q, t)
+}
+
+func (q *timerQueue) Pop() interface{} {
+	old := *q
+	t := old[len(old)-1]
+	old[len(old)-1] = nil
+	t.index = -1
+	*q = old[:len(old)-1]
+	return t
+}
+
+func (l *eventLoop) jsQueueMicrotask(call goja.FunctionCall) goja.Value {
+	if _, ok := goja.AssertFunction(call.Argument(0)); !ok {
+		panic(l.e.runtime.NewTypeError("callback must be a function"))
+	}
+	_, err := l.queueMicrotask(goja.Undefined(), call.Argument(0))
+	var ex *goja.Exception
+	if errors.As(err, &ex) {
+		panic(ex)
+	} else if err != nil {
+		panic(l.e.runtime.NewGoError(err))
+	}
+	return goja.Undefined()
+}
@@ -0,0 +1,76 @@
+package engine
+
+import (
+	"errors"
+
+	"github.com/andrebq/jtb/internal/modules/rawexec"
+)
+
+type (
+	// ExecRule allows local scripts to run a binary with @rawexec,
+	// optionally limiting its arguments
+	ExecRule = rawexec.Rule
+)
+
+// ExecLimitsHelper must be called at the start of main by binaries that
+// want the limits of @rawexec applied before the command runs. The binary
+// is executed again as a helper that sets the limits and then executes the
+// command, in that case ExecLimitsHelper never returns.
+//
+// Binaries that don't call it get the limits applied right after the
+// process starts.
+func ExecLimitsHelper() {
+	rawexec.LimitsHelper()
+}
+
+// ParseExecPolicy reads a list of rules from a YAML document:
+//
+//   - binary: kubectl
+//     args: ["get|apply|diff"]
+//     forbidden: [--kubeconfig, --token]
+func ParseExecPolicy(content []byte) ([]ExecRule, error) {
+	return rawexec.ParsePolicy(content)
+}
+
+// SetExecPolicy limits @rawexec to the binaries listed in rules, they are
+// resolved to absolute paths (using PATH) by this call, so scripts cannot
+// change which files are executed.
+//
+// An empty list denies every binary, while nil removes the policy.
+// The policy applies together with the commands granted to the script.
+func (e *E) SetExecPolicy(rules []ExecRule) error {
+	if rules == nil {
+		e.useExecPolicy(nil)
+		return nil
+	}
+	policy, err := rawexec.NewPolicy(rules)
+	if err != nil {
+		return err
+	}
+	e.useExecPolicy(policy)
+	return nil
+}
+
+func (e *E) useExecPolicy(policy *rawexec.Policy) {
+	e.execPolicy = policy
+	e.exec.Policy = policy
+}
+
+// KillProcesses kills every process started by @rawexec that is still
+// running (including their children), and prevents new ones from starting.
+//
+// Unlike other methods of E, it can be called from any goroutine,
+// eg.: when jtb receives a signal.
+func (e *E) KillProcesses() {
+	e.exec.Close()
+}
+
+// IsRestrictedCommand returns true if err was thrown because
+// a script tried to run a command that is not allowed
+func (e *E) IsRestrictedCommand(err error) bool {
+	var restricted rawexec.RestrictedError
+	if value, ok := thrownGoValue(err).(error); ok {
+		return errors.As(value, &restricted)
+	}
+	return false
+}
@@ -3,9 +3,15 @@ package engine
 import (
 	"net/http"
 	"net/http/httptest"
+	"os"
 	"testing"
 )
 
+func TestMain(m *testing.M) {
+	ExecLimitsHelper()
+	os.Exit(m.Run())
+}
+
 func serveRemoteModules(t *testing.T, folder string, urlContext string) (string, func()) {
 	handler := http.StripPrefix(urlContext, http.FileServer(http.Dir(folder)))
 	server := httptest.NewServer(handler)
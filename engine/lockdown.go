@@ -0,0 +1,161 @@
+package engine
+
+import (
+	"net/url"
+	"strings"
+
+	"github.com/dop251/goja"
+)
+
+var (
+	// lockdownProgram freezes every intrinsic reachable from the global object
+	// (and the ones that are only reachable from syntax, like the prototype of
+	// async functions), and makes all global bindings read-only.
+	//
+	// Constructors that evaluate code are replaced by versions that call guard
+	// first, so they can be denied to untrusted code.
+	lockdownProgram = goja.MustCompile("__goja__lockdown.js", `(function(guard) {
+		"use strict";
+		var global = globalThis;
+		var seen = new WeakSet();
+		seen.add(global);
+
+		function tame(original) {
+			var tamed = function() {
+				guard();
+				return original.apply(undefined, arguments);
+			};
+			Object.defineProperty(tamed, "name", { value: original.name });
+			tamed.prototype = original.prototype;
+			Object.defineProperty(original.prototype, "constructor", { value: tamed });
+			return tamed;
+		}
+		global.Function = tame(Function);
+		tame(Object.getPrototypeOf(async function() {}).constructor);
+		tame(Object.getPrototypeOf(function*() {}).constructor);
+		var originalEval = eval;
+		global.eval = function(src) {
+			guard();
+			return originalEval(src);
+		};
+		Object.defineProperty(global.eval, "name", { value: "eval" });
+
+		// freezing prototypes prevents instances from defining their own
+		// version of inherited properties by assignment (eg.: err.name = "x"),
+		// those are converted to accessors that define the property on the instance.
+		var overridable = ["constructor", "name", "message", "toString", "valueOf", "toLocaleString", "toJSON"];
+		function enableOverride(obj, key) {
+			var desc = Object.getOwnPropertyDescriptor(obj, key);
+			if (!desc || !("value" in desc) || !desc.configurable) {
+				return;
+			}
+			var value = desc.value;
+			Object.defineProperty(obj, key, {
+				get: function() { return value; },
+				set: function(newValue) {
+					if (this === obj) {
+						throw new TypeError("Cannot assign to read only property '" + key + "' of a locked down object");
+					}
+					Object.defineProperty(this, key, { value: newValue, writable: true, enumerable: true, configurable: true });
+				},
+				enumerable: desc.enumerable,
+				configurable: false,
+			});
+		}
+		Reflect.ownKeys(global).forEach(function(name) {
+			var ctor = global[name];
+			if (typeof ctor === "function" && ctor.prototype) {
+				overridable.forEach(function(key) { enableOverride(ctor.prototype, key); });
+			}
+		});
+
+		function harden(obj) {
+			if (obj === null || (typeof obj !== "object" && typeof obj !== "function") || seen.has(obj)) {
+				return;
+			}
+			seen.add(obj);
+			Object.freeze(obj);
+			harden(Object.getPrototypeOf(obj));
+			Reflect.ownKeys(obj).forEach(function(key) {
+				var desc = Object.getOwnPropertyDescriptor(obj, key);
+				if ("value" in desc) {
+					harden(desc.value);
+				} else {
+					harden(desc.get);
+					harden(desc.set);
+				}
+			});
+		}
+		[
+			function*() {},
+			async function() {},
+			[][Symbol.iterator](),
+			""[Symbol.iterator](),
+			new Map().entries(),
+			new Set().entries(),
+			/x/[Symbol.matchAll]("x"),
+			(function*() {})(),
+		].forEach(harden);
+
+		Reflect.ownKeys(global).forEach(function(name) {
+			var desc = Object.getOwnPropertyDescriptor(global, name);
+			if ("value" in desc) {
+				harden(desc.value);
+				Object.defineProperty(global, name, { writable: false, configurable: false });
+			} else {
+				harden(desc.get);
+				harden(desc.set);
+				Object.defineProperty(global, name, { configurable: false });
+			}
+		});
+	})`, true)
+)
+
+// Lockdown freezes all javascript intrinsics (constructors, their prototypes,
+// Math, JSON, Reflect, ...) and makes every existing global binding read-only,
+// so no module can change the environment seen by other modules.
+//
+// Dynamic code evaluation (eval, the Function constructor and its async and
+// generator variants) is denied to remote modules. Local code can still use
+// them, but eval always behaves as an indirect eval (global scope).
+//
+// Lockdown cannot be undone and should be called before running any script.
+func (e *E) Lockdown() error {
+	if e.locked {
+		return nil
+	}
+	fn, err := e.runtime.RunProgram(lockdownProgram)
+	if err != nil {
+		return err
+	}
+	lockdown, _ := goja.AssertFunction(fn)
+	_, err = lockdown(goja.Undefined(), e.runtime.ToValue(e.guardDynamicCode))
+	if err != nil {
+		return err
+	}
+	e.locked = true
+	return nil
+}
+
+// guardDynamicCode throws a TypeError if the code calling eval/Function
+// comes from a remote module
+func (e *E) guardDynamicCode(call goja.FunctionCall) goja.Value {
+	if remote, _ := e.remoteCaller(); remote {
+		panic(e.runtime.NewTypeError("dynamic code evaluation is not allowed for remote modules"))
+	}
+	return goja.Undefined()
+}
+
+// remoteCaller reports if the innermost javascript frame comes from a
+// remote module, found is false if there is no javascript frame
+func (e *E) remoteCaller() (remote bool, found bool) {
+	for _, frame := range e.runtime.CaptureCallStack(0, nil) {
+		name := frame.SrcName()
+		if name == "<native>" || strings.HasPrefix(name, "__goja__") {
+			continue
+		}
+		u, err := url.Parse(name)
+		return err != nil || u.Scheme != "", true
+	}
+	return false, false
+}
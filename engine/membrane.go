@@ -0,0 +1,191 @@
+package engine
+
+import (
+	"errors"
+	"fmt"
+	"reflect"
+	"time"
+
+	"github.com/dop251/goja"
+)
+
+var (
+	promiseType = reflect.TypeOf((*goja.Promise)(nil))
+)
+
+type (
+	// membrane copies values from one engine to another.
+	//
+	// Data (primitives, arrays, plain objects, dates and array buffers) is
+	// copied, functions are replaced by proxies that copy their arguments
+	// (using reverse) and results. Objects from one engine are never
+	// reachable from the other, which also means prototypes, getters and
+	// class methods do not cross the membrane.
+	membrane struct {
+		from, to *E
+		reverse  *membrane
+
+		// proxies maps functions from the source engine to the proxies
+		// created in the target engine, originals is the inverse map
+		proxies   map[*goja.Object]*goja.Object
+		originals map[*goja.Object]*goja.Object
+	}
+)
+
+// newMembranes returns the membranes used to move values between a and b
+func newMembranes(a, b *E) (aToB *membrane, bToA *membrane) {
+	aToB = &membrane{from: a, to: b, proxies: map[*goja.Object]*goja.Object{}, originals: map[*goja.Object]*goja.Object{}}
+	bToA = &membrane{from: b, to: a, proxies: map[*goja.Object]*goja.Object{}, originals: map[*goja.Object]*goja.Object{}}
+	aToB.reverse, bToA.reverse = bToA, aToB
+	return
+}
+
+// wrap returns a copy of v that belongs to the target engine.
+//
+// Exceptions thrown by the source engine while reading v (eg.: by getters)
+// are returned as plain Go errors, so no value from the source engine leaks.
+func (m *membrane) wrap(v goja.Value) (copied goja.Value, err error) {
+	defer func() {
+		if r := recover(); r != nil {
+			ex, ok := r.(*goja.Exception)
+			if !ok {
+				panic(r)
+			}
+			copied, err = nil, errors.New(errorMessage(ex))
+		}
+	}()
+	return m.copy(v, map[*goja.Object]goja.Value{}), nil
+}
+
+// mustWrap works like wrap but throws errors as exceptions of the target engine
+func (m *membrane) mustWrap(v goja.Value) goja.Value {
+	copied, err := m.wrap(v)
+	if err != nil {
+		panic(m.newError(err.Error()))
+	}
+	return copied
+}
+
+func (m *membrane) copy(v goja.Value, seen map[*goja.Object]goja.Value) goja.Value {
+	rt := m.to.runtime
+	switch {
+	case v == nil || goja.IsUndefined(v):
+		return goja.Undefined()
+	case goja.IsNull(v):
+		return goja.Null()
+	}
+	if sym, ok := v.(*goja.Symbol); ok {
+		return goja.NewSymbol(sym.String())
+	}
+	obj, ok := v.(*goja.Object)
+	if !ok {
+		return rt.ToValue(v.Export())
+	}
+	if copied, ok := seen[obj]; ok {
+		return copied
+	}
+	if fn, ok := goja.AssertFunction(obj); ok {
+		return m.proxy(obj, fn)
+	}
+	if obj.ExportType() == promiseType {
+		return m.copyPromise(obj, obj.Export().(*goja.Promise))
+	}
+	switch obj.ClassName() {
+	case "Array":
+		arr := rt.NewArray()
+		seen[obj] = arr
+		length := obj.Get("length").ToInteger()
+		for i := int64(0); i < length; i++ {
+			arr.Set(fmt.Sprint(i), m.copy(obj.Get(fmt.Sprint(i)), seen))
+		}
+		return arr
+	case "ArrayBuffer":
+		buf := obj.Export().(goja.ArrayBuffer).Bytes()
+		return rt.ToValue(rt.NewArrayBuffer(append([]byte(nil), buf...)))
+	case "Date":
+		if t, ok := obj.Export().(time.Time); ok {
+			date, err := rt.New(rt.Get("Date"), rt.ToValue(t.UnixNano()/int64(time.Millisecond)))
+			if err != nil {
+				panic(err)
+			}
+			return date
+		}
+	case "Error":
+		return m.newError(obj.String())
+	}
+	copied := rt.NewObject()
+	seen[obj] = copied
+	for _, key := range obj.Keys() {
+		copied.Set(key, m.copy(obj.Get(key), seen))
+	}
+	return copied
+}
+
+// copyPromise waits until p settles, running the event loop of the source
+// engine, and returns a promise settled with a copy of its result
+func (m *membrane) copyPromise(obj *goja.Object, promise *goja.Promise) goja.Value {
+	copied, resolve, reject := m.to.runtime.NewPromise()
+	_, err := m.from.loop.drain(obj)
+	switch {
+	case promise.State() == goja.PromiseStateFulfilled:
+		resolve(m.copy(promise.Result(), map[*goja.Object]goja.Value{}))
+	case promise.State() == goja.PromiseStateRejected:
+		reject(m.copy(promise.Result(), map[*goja.Object]goja.Value{}))
+	default:
+		reject(m.newError(err.Error()))
+	}
+	return m.to.runtime.ToValue(copied)
+}
+
+// proxy returns a function of the target engine that calls fn
+func (m *membrane) proxy(obj *goja.Object, fn goja.Callable) goja.Value {
+	if original, ok := m.reverse.originals[obj]; ok {
+		// fn is a proxy that is going back to its own engine
+		return original
+	}
+	if proxy, ok := m.proxies[obj]; ok {
+		return proxy
+	}
+	proxy := m.to.runtime.ToValue(func(call goja.FunctionCall) goja.Value {
+		args := make([]goja.Value, len(call.Arguments))
+		for i, arg := range call.Arguments {
+			args[i] = m.reverse.copy(arg, map[*goja.Object]goja.Value{})
+		}
+		res, err := fn(goja.Undefined(), args...)
+		if err != nil {
+			panic(m.newError(errorMessage(err)))
+		}
+		return m.mustWrap(res)
+	}).ToObject(m.to.runtime)
+	m.proxies[obj] = proxy
+	m.originals[proxy] = obj
+	return proxy
+}
+
+// newError returns an Error object from the target engine
+func (m *membrane) newError(msg string) *goja.Object {
+	err, e := m.to.runtime.New(m.to.runtime.Get("Error"), m.to.runtime.ToValue(msg))
+	if e != nil {
+		panic(e)
+	}
+	return err
+}
+
+// errorMessage returns the message of err, formatting a goja.Exception can
+// run code from the engine that threw it, so exceptions raised while
+// doing so are ignored
+func errorMessage(err error) (msg string) {
+	defer func() {
+		if r := recover(); r != nil {
+			msg = "exception thrown while formatting an error from another engine"
+		}
+	}()
+	var ex *goja.Exception
+	if !errors.As(err, &ex) {
+		return err.Error()
+	}
+	if obj, ok := ex.Value().(*goja.Object); ok && obj.ClassName() == "Error" {
+		return obj.Get("message").String()
+	}
+	return ex.Value().String()
+}
@@ -0,0 +1,83 @@
+package engine
+
+type (
+	// TrustLevel indicates which rules were applied when loading a module
+	TrustLevel string
+
+	// ModuleInfo describes a module loaded by the engine
+	ModuleInfo struct {
+		// Specifier used by the first require call that loaded the module
+		Specifier string `json:"specifier"`
+		// Resolved is the builtin name, the path relative to the anchor
+		// or the URL (without credentials) of the module
+		Resolved string     `json:"resolved"`
+		Trust    TrustLevel `json:"trust"`
+		// Hash is the sha256 of the module content, empty for builtins
+		Hash string `json:"hash,omitempty"`
+		// Importers lists the resolved name of every module that required
+		// this one, an empty string means it was required by the engine itself
+		Importers []string `json:"importers"`
+		// Dangerous is true for builtins that are restricted by default
+		Dangerous bool `json:"dangerous,omitempty"`
+	}
+)
+
+const (
+	TrustBuiltin = TrustLevel("builtin")
+	TrustLocal   = TrustLevel("local")
+	TrustRemote  = TrustLevel("remote")
+)
+
+// LoadedModules returns every module loaded by the engine in the order
+// they were first required
+func (e *E) LoadedModules() []ModuleInfo {
+	var out []ModuleInfo
+	for _, resolved := range e.require.loadOrder {
+		info := *e.require.loaded[resolved]
+		info.Importers = append([]string(nil), info.Importers...)
+		out = append(out, info)
+	}
+	for _, rl := range e.require.realmsInOrder() {
+		for _, info := range rl.e.LoadedModules() {
+			if _, ok := e.require.loaded[info.Resolved]; ok {
+				// the module required by this engine, or a builtin also used by it
+				continue
+			}
+			out = append(out, info)
+		}
+	}
+	return out
+}
+
+// trackModule records that importer required the module identified by resolved,
+// info is used only if this is the first time resolved was required.
+func (r *rootRequire) trackModule(importer string, info ModuleInfo) {
+	r.init()
+	existing := r.loaded[info.Resolved]
+	if existing == nil {
+		existing = &info
+		existing.Importers = nil
+		r.loaded[info.Resolved] = existing
+		r.loadOrder = append(r.loadOrder, info.Resolved)
+	}
+	for _, v := range existing.Importers {
+		if v == importer {
+			return
+		}
+	}
+	existing.Importers = append(existing.Importers, importer)
+}
+
+// untrackModule removes a module that failed to load
+func (r *rootRequire) untrackModule(resolved string) {
+	if _, ok := r.loaded[resolved]; !ok {
+		return
+	}
+	delete(r.loaded, resolved)
+	for i, v := range r.loadOrder {
+		if v == resolved {
+			r.loadOrder = append(r.loadOrder[:i], r.loadOrder[i+1:]...)
+			return
+		}
+	}
+}
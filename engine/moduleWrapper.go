@@ -0,0 +1,201 @@
+package engine
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"path"
+	"strings"
+
+	"github.com/dop251/goja"
+	"github.com/dop251/goja/ast"
+	"github.com/dop251/goja/parser"
+	"github.com/go-sourcemap/sourcemap"
+)
+
+var (
+	moduleParameters = []string{"exports", "require", "module", "__filename", "__dirname"}
+
+	// modulePrefix and moduleSuffix wrap the module code so it is parsed as
+	// the body of a function
+	modulePrefix = "(function(" + strings.Join(moduleParameters, ", ") + ") {"
+	moduleSuffix = "\n})"
+)
+
+// compileModuleCode compiles code as the body of a function that receives
+// the same arguments as a CommonJS module.
+func compileModuleCode(name string, code string) (*goja.Program, error) {
+	prg, err := parseModuleCode(name, code)
+	if err != nil {
+		return nil, err
+	}
+	return goja.CompileAST(prg, true)
+}
+
+// parseModuleCode parses code as the body of a CommonJS module function.
+//
+// The code is parsed inside a function wrapper (so top-level return statements
+// are valid) and the file of the returned program has a source map that
+// removes the wrapper from the reported positions, so errors and stack traces
+// refer to the original line and column.
+//
+// Code with an inline source map (eg.: transpiled modules) starts on the line
+// after the wrapper prefix and its source map is moved down by one line,
+// otherwise the prefix shares the first line with the code and only the
+// columns of that line are mapped back.
+func parseModuleCode(name string, code string) (*ast.Program, error) {
+	body := code
+	if strings.HasPrefix(body, "#!") {
+		// the hashbang is only valid at the start of the source,
+		// turning it into a comment keeps every position unchanged
+		body = "//" + body[2:]
+	}
+	sm, err := inlineSourceMap(name, code)
+	if err != nil {
+		return nil, err
+	}
+	prefix := modulePrefix
+	if sm != nil {
+		prefix += "\n"
+	} else {
+		sm, err = firstLineSourceMap(name, body)
+		if err != nil {
+			return nil, err
+		}
+	}
+	prg, err := parser.ParseFile(nil, name, prefix+body+moduleSuffix, 0, parser.WithDisableSourceMaps)
+	if err != nil {
+		return nil, moduleSyntaxError(err, prefix)
+	}
+	var fn *ast.FunctionLiteral
+	if len(prg.Body) == 1 {
+		if stmt, ok := prg.Body[0].(*ast.ExpressionStatement); ok {
+			fn, _ = stmt.Expression.(*ast.FunctionLiteral)
+		}
+	}
+	if fn == nil || int(fn.Body.RightBrace) != len(prefix)+len(code)+2 {
+		// code closed the wrapper function, eg.: "}); (function() {"
+		return nil, &goja.CompilerSyntaxError{CompilerError: goja.CompilerError{
+			Message: name + ": Unexpected } outside of the module body",
+		}}
+	}
+	prg.File.SetSourceMap(sm)
+	return prg, nil
+}
+
+// moduleSyntaxError removes the wrapper prefix from the positions of errors
+// reported by the parser.
+func moduleSyntaxError(err error, prefix string) error {
+	var list parser.ErrorList
+	if !errors.As(err, &list) {
+		return err
+	}
+	lines := strings.Count(prefix, "\n")
+	for _, e := range list {
+		switch {
+		case lines > 0 && e.Position.Line > lines:
+			e.Position.Line -= lines
+		case lines == 0 && e.Position.Line == 1 && e.Position.Column > len(prefix):
+			e.Position.Column -= len(prefix)
+		}
+	}
+	return &goja.CompilerSyntaxError{CompilerError: goja.CompilerError{
+		Message: list.Error(),
+	}}
+}
+
+// inlineSourceMap parses the source map embedded as a data URL in the last
+// line of code, other source map URLs are ignored. The mappings are moved down
+// by one line, as the code is placed after the line of the wrapper prefix.
+func inlineSourceMap(name string, code string) (*sourcemap.Consumer, error) {
+	code = strings.TrimRight(code, "\n")
+	line := code[strings.LastIndexByte(code, '\n')+1:]
+	const prefix = "//# sourceMappingURL=data:application/json"
+	if !strings.HasPrefix(line, prefix) {
+		return nil, nil
+	}
+	data, err := base64.StdEncoding.DecodeString(line[strings.IndexByte(line, ',')+1:])
+	if err != nil {
+		return nil, err
+	}
+	var sm map[string]interface{}
+	if err := json.Unmarshal(data, &sm); err != nil {
+		return nil, err
+	}
+	mappings, ok := sm["mappings"].(string)
+	if !ok {
+		return nil, fmt.Errorf("%v: inline source map without mappings", name)
+	}
+	sm["mappings"] = ";" + mappings
+	if data, err = json.Marshal(sm); err != nil {
+		return nil, err
+	}
+	return sourcemap.Parse(name, data)
+}
+
+// firstLineSourceMap returns a source map that moves the columns of the first
+// line of code back by the size of the wrapper prefix. Every position where a
+// token may start has its own segment, since a lookup between two segments
+// returns the column of the first one. Positions after the first line have no
+// segments and are reported as they are.
+func firstLineSourceMap(name string, code string) (*sourcemap.Consumer, error) {
+	line := code
+	if i := strings.IndexByte(line, '\n'); i >= 0 {
+		line = line[:i]
+	}
+	var mappings strings.Builder
+	gen, src := 0, 0
+	for i := 0; i <= len(line); i++ {
+		if i < len(line) && (line[i] == ' ' || line[i] == '\t' ||
+			(i > 0 && isIdentByte(line[i-1]) && isIdentByte(line[i]))) {
+			continue
+		}
+		if mappings.Len() > 0 {
+			mappings.WriteByte(',')
+		}
+		// goja looks up columns starting at 1 and segments start at 0,
+		// the original column is stored starting at 1 to match
+		writeVLQ(&mappings, len(modulePrefix)+i+1-gen)
+		writeVLQ(&mappings, 0)
+		writeVLQ(&mappings, 0)
+		writeVLQ(&mappings, i+1-src)
+		gen, src = len(modulePrefix)+i+1, i+1
+	}
+	data, err := json.Marshal(map[string]interface{}{
+		"version":  3,
+		"sources":  []string{path.Base(name)},
+		"names":    []string{},
+		"mappings": mappings.String(),
+	})
+	if err != nil {
+		return nil, err
+	}
+	return sourcemap.Parse(name, data)
+}
+
+func isIdentByte(b byte) bool {
+	return b == '_' || b == '$' || b >= 0x80 ||
+		('a' <= b && b <= 'z') || ('A' <= b && b <= 'Z') || ('0' <= b && b <= '9')
+}
+
+const vlqChars = "ABCDEFGHIJKLMNOPQRSTUVWXYZabcdefghijklmnopqrstuvwxyz0123456789+/"
+
+// writeVLQ writes v as a base64 VLQ, as used in the mappings of a source map.
+func writeVLQ(w *strings.Builder, v int) {
+	u := v << 1
+	if v < 0 {
+		u = (-v << 1) | 1
+	}
+	for {
+		digit := u & 0x1f
+		u >>= 5
+		if u > 0 {
+			digit |= 0x20
+		}
+		w.WriteByte(vlqChars[digit])
+		if u == 0 {
+			return
+		}
+	}
+}
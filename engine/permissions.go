@@ -0,0 +1,214 @@
+package engine
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"sort"
+	"strings"
+
+	"gopkg.in/yaml.v3"
+)
+
+type (
+	// Permissions maps builtin modules to the scopes they are granted with,
+	// a module without scopes is granted without any further restriction.
+	//
+	// eg.: {"@rawexec": ["kubectl"]} allows a script to use @rawexec
+	// but only to call kubectl.
+	Permissions map[string][]string
+
+	// scopedModule is implemented by builtins that can be granted
+	// to scripts with a narrower scope
+	scopedModule interface {
+		// Restrict the module to the given scopes, it is never called with an empty list
+		Restrict(scopes []string) error
+	}
+)
+
+const (
+	manifestHeader = "permissions:"
+)
+
+// ParseManifest reads the permissions declared in the header of a script.
+//
+// The header is a comment block at the top of the file:
+//
+//	// permissions:
+//	//   @rawexec: [kubectl, helm]
+//	//   @stdio
+//
+// Scripts without a header do not require any permission.
+func ParseManifest(code []byte) (Permissions, error) {
+	perms := Permissions{}
+	scanner := bufio.NewScanner(bytes.NewBuffer(code))
+	inHeader := false
+	for lineNo := 1; scanner.Scan(); lineNo++ {
+		line := strings.TrimSpace(scanner.Text())
+		if lineNo == 1 && strings.HasPrefix(line, "#!") {
+			continue
+		}
+		if !strings.HasPrefix(line, "//") {
+			if line == "" && !inHeader {
+				continue
+			}
+			break
+		}
+		line = strings.TrimSpace(strings.TrimPrefix(line, "//"))
+		if !inHeader {
+			inHeader = line == manifestHeader
+			continue
+		}
+		if !strings.HasPrefix(line, "@") {
+			break
+		}
+		name, value := line, ""
+		if idx := strings.Index(line, ":"); idx >= 0 {
+			name, value = strings.TrimSpace(line[:idx]), line[idx+1:]
+		}
+		scopes, err := parseScopes(value)
+		if err != nil {
+			return nil, fmt.Errorf("invalid permission at line %v: %w", lineNo, err)
+		}
+		perms.add(name, scopes)
+	}
+	return perms, scanner.Err()
+}
+
+// ParseManifestFile reads permissions from a YAML document, usually
+// stored next to the script. The leading @ can be omitted from module names,
+// as it must be quoted in YAML.
+//
+//	rawexec: [kubectl]
+//	stdio:
+func ParseManifestFile(content []byte) (Permissions, error) {
+	var doc map[string]yaml.Node
+	if err := yaml.Unmarshal(content, &doc); err != nil {
+		return nil, err
+	}
+	perms := Permissions{}
+	for name, node := range doc {
+		var scopes []string
+		switch node.Kind {
+		case yaml.ScalarNode:
+			if node.Tag != "!!null" {
+				scopes = []string{node.Value}
+			}
+		default:
+			if err := node.Decode(&scopes); err != nil {
+				return nil, fmt.Errorf("invalid scopes for %v: %w", name, err)
+			}
+		}
+		if !strings.HasPrefix(name, "@") {
+			name = "@" + name
+		}
+		perms.add(name, scopes)
+	}
+	return perms, nil
+}
+
+func parseScopes(value string) ([]string, error) {
+	value = strings.TrimSpace(value)
+	if value == "" {
+		return nil, nil
+	}
+	var node yaml.Node
+	if err := yaml.Unmarshal([]byte(value), &node); err != nil {
+		return nil, err
+	}
+	var scopes []string
+	if len(node.Content) > 0 && node.Content[0].Kind == yaml.ScalarNode {
+		return []string{node.Content[0].Value}, nil
+	}
+	if err := node.Decode(&scopes); err != nil {
+		return nil, err
+	}
+	return scopes, nil
+}
+
+func (p Permissions) add(name string, scopes []string) {
+	if current, ok := p[name]; ok && (current == nil || scopes == nil) {
+		// one of the declarations grants the whole module
+		p[name] = nil
+		return
+	}
+	current := p[name]
+	for _, scope := range scopes {
+		if !containsString(current, scope) {
+			current = append(current, scope)
+		}
+	}
+	p[name] = current
+}
+
+func containsString(list []string, v string) bool {
+	for _, item := range list {
+		if item == v {
+			return true
+		}
+	}
+	return false
+}
+
+// Merge adds all permissions from other to p
+func (p Permissions) Merge(other Permissions) {
+	for name, scopes := range other {
+		p.add(name, scopes)
+	}
+}
+
+// Names returns the sorted list of modules in p
+func (p Permissions) Names() []string {
+	names := make([]string, 0, len(p))
+	for name := range p {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+func (p Permissions) String() string {
+	var lines []string
+	for _, name := range p.Names() {
+		if len(p[name]) == 0 {
+			lines = append(lines, name)
+			continue
+		}
+		lines = append(lines, fmt.Sprintf("%v: %v", name, strings.Join(p[name], ", ")))
+	}
+	return strings.Join(lines, "\n")
+}
+
+// Grant the given permissions to local scripts, modules are unrestricted
+// and scoped builtins are restricted to the listed scopes.
+//
+// Nothing is granted if any of the permissions refer to an unknown builtin
+// or use scopes with a builtin that does not support them.
+func (e *E) Grant(perms Permissions) error {
+	e.require.init()
+	for _, name := range perms.Names() {
+		def := e.require.builtins[name]
+		if def == nil {
+			return fmt.Errorf("unknown capability %v", name)
+		}
+		if len(perms[name]) == 0 {
+			continue
+		}
+		if _, ok := def.definer.(scopedModule); !ok {
+			return fmt.Errorf("capability %v cannot be limited to %v", name, strings.Join(perms[name], ", "))
+		}
+	}
+	for _, name := range perms.Names() {
+		if scopes := perms[name]; len(scopes) > 0 {
+			if err := e.require.builtins[name].definer.(scopedModule).Restrict(scopes); err != nil {
+				return fmt.Errorf("unable to grant %v: %w", name, err)
+			}
+		}
+		e.Unrestrict(name)
+		if e.grants == nil {
+			e.grants = Permissions{}
+		}
+		e.grants[name] = perms[name]
+	}
+	return nil
+}
@@ -0,0 +1,137 @@
+package engine
+
+import (
+	"errors"
+	"sync"
+	"time"
+)
+
+type (
+	// Pool keeps a set of pre-warmed engines ready to be used.
+	//
+	// Engines are never reused, once an engine is taken from the pool
+	// it belongs to the caller (who should call Close on it), and the pool
+	// starts preparing a new one in the background. This keeps every
+	// request isolated while still avoiding the cost of New on the hot path.
+	//
+	// All engines created by the pool share the same ProgramCache.
+	Pool struct {
+		setup    func(*E) error
+		programs *ProgramCache
+
+		ready chan *E
+		done  chan struct{}
+
+		closeOnce sync.Once
+		wg        sync.WaitGroup
+	}
+)
+
+const (
+	minWarmupBackoff = 10 * time.Millisecond
+	maxWarmupBackoff = time.Second
+)
+
+var (
+	errPoolClosed = errors.New("engine pool is closed")
+)
+
+// NewPool returns a pool that keeps up to size engines ready to use.
+//
+// setup is called for every engine created by the pool and should be used
+// to configure it (eg.: AnchorModules, Unrestrict, ConnectStdio), it might be nil.
+func NewPool(size int, setup func(*E) error) *Pool {
+	if size <= 0 {
+		size = 1
+	}
+	p := &Pool{
+		setup:    setup,
+		programs: NewProgramCache(),
+		ready:    make(chan *E, size),
+		done:     make(chan struct{}),
+	}
+	p.wg.Add(1)
+	go p.warmup()
+	return p
+}
+
+// Programs returns the cache shared by all engines of this pool
+func (p *Pool) Programs() *ProgramCache {
+	return p.programs
+}
+
+// Get returns an engine ready to be used, if no pre-warmed engine is
+// available a new one is created.
+func (p *Pool) Get() (*E, error) {
+	select {
+	case <-p.done:
+		return nil, errPoolClosed
+	case e := <-p.ready:
+		return e, nil
+	default:
+		return p.newEngine()
+	}
+}
+
+// Close stops the pool and closes any engine that was not taken yet
+func (p *Pool) Close() error {
+	p.closeOnce.Do(func() {
+		close(p.done)
+	})
+	p.wg.Wait()
+	var firstErr error
+	for {
+		select {
+		case e := <-p.ready:
+			if err := e.Close(); err != nil && firstErr == nil {
+				firstErr = err
+			}
+		default:
+			return firstErr
+		}
+	}
+}
+
+// warmup keeps the pool full, failures (eg.: a setup error) are retried
+// with an exponential backoff, meanwhile Get creates engines itself and
+// reports the error to its caller
+func (p *Pool) warmup() {
+	defer p.wg.Done()
+	backoff := minWarmupBackoff
+	for {
+		e, err := p.newEngine()
+		if err != nil {
+			select {
+			case <-p.done:
+				return
+			case <-time.After(backoff):
+			}
+			if backoff *= 2; backoff > maxWarmupBackoff {
+				backoff = maxWarmupBackoff
+			}
+			continue
+		}
+		backoff = minWarmupBackoff
+		select {
+		case <-p.done:
+			e.Close()
+			return
+		case p.ready <- e:
+		}
+	}
+}
+
+func (p *Pool) newEngine() (*E, error) {
+	e, err := New()
+	if err != nil {
+		return nil, err
+	}
+	e.UseProgramCache(p.programs)
+	if p.setup != nil {
+		if err := p.setup(e); err != nil {
+			e.Close()
+			return nil, err
+		}
+	}
+	return e, nil
+}
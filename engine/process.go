@@ -0,0 +1,44 @@
+package engine
+
+import (
+	"github.com/andrebq/jtb/internal/modules/process"
+)
+
+type (
+	// ExitError is returned when a script calls exit from @process,
+	// after its exit hooks ran
+	ExitError = process.ExitError
+)
+
+// SetArgs changes the arguments given to scripts (argv in @process)
+func (e *E) SetArgs(args []string) {
+	e.args = append([]string{}, args...)
+}
+
+// AllowEnv makes the environment variables matching the given
+// patterns (see path.Match) visible to scripts (env in @process),
+// by default scripts cannot see any variable.
+func (e *E) AllowEnv(patterns ...string) {
+	e.envAllow = append(e.envAllow, patterns...)
+}
+
+// RunExitHooks calls the functions registered by scripts with onExit,
+// callers should use it when the script finishes without calling exit
+// (hooks never run twice).
+//
+// If a hook calls exit, an ExitError is returned.
+func (e *E) RunExitHooks(code int) error {
+	return e.exitStatus(e.process.RunExitHooks(code))
+}
+
+// exitStatus returns an ExitError if the script called exit,
+// otherwise err is returned as is
+func (e *E) exitStatus(err error) error {
+	code, ok := e.process.Exited()
+	if !ok {
+		return err
+	}
+	e.runtime.ClearInterrupt()
+	e.loop.reset()
+	return &ExitError{Code: code}
+}
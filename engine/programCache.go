@@ -0,0 +1,91 @@
+package engine
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"path"
+	"sync"
+
+	"github.com/dop251/goja"
+)
+
+type (
+	// ProgramCache keeps compiled programs so multiple engines can skip
+	// calling goja.Compile for modules that were already loaded.
+	//
+	// Programs are keyed by module path/URL and the hash of their content,
+	// so a module that changes on disk (or on the remote server) is compiled
+	// again. It is safe for concurrent use.
+	ProgramCache struct {
+		mu         sync.RWMutex
+		programs   map[programKey]*goja.Program
+		transpiled map[string]*transpiled
+	}
+
+	programKey struct {
+		path string
+		hash string
+	}
+)
+
+// NewProgramCache returns an empty cache that can be shared by
+// multiple engines (see E.UseProgramCache)
+func NewProgramCache() *ProgramCache {
+	return &ProgramCache{
+		programs:   make(map[programKey]*goja.Program),
+		transpiled: make(map[string]*transpiled),
+	}
+}
+
+// Len returns how many programs are cached
+func (c *ProgramCache) Len() int {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	return len(c.programs)
+}
+
+func (c *ProgramCache) compile(modulePath string, name string, code string) (*goja.Program, error) {
+	key := programKey{path: modulePath, hash: contentHash([]byte(code))}
+	c.mu.RLock()
+	program := c.programs[key]
+	c.mu.RUnlock()
+	if program != nil {
+		return program, nil
+	}
+	program, err := compileModuleCode(name, code)
+	if err != nil {
+		return nil, err
+	}
+	c.mu.Lock()
+	// another engine might have compiled the same code in the meantime,
+	// it doesn't matter which one is kept as they are equivalent
+	c.programs[key] = program
+	c.mu.Unlock()
+	return program, nil
+}
+
+// transpile returns the cached output of fn, the cache is keyed by
+// the hash of the code, its extension and the source map file name
+func (c *ProgramCache) transpile(modulePath string, sourceFile string, code []byte, fn func() (*transpiled, error)) (*transpiled, error) {
+	key := contentHash([]byte(fmt.Sprintf("%v\x00%v\x00%s", path.Ext(modulePath), sourceFile, code)))
+	c.mu.RLock()
+	out := c.transpiled[key]
+	c.mu.RUnlock()
+	if out != nil {
+		return out, nil
+	}
+	out, err := fn()
+	if err != nil {
+		return nil, err
+	}
+	c.mu.Lock()
+	c.transpiled[key] = out
+	c.mu.Unlock()
+	return out, nil
+}
+
+func contentHash(content []byte) string {
+	sum := sha256.Sum256(content)
+	return hex.EncodeToString(sum[:])
+}
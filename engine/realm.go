@@ -0,0 +1,157 @@
+package engine
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"net/url"
+	"sort"
+
+	"github.com/dop251/goja"
+	"github.com/spf13/afero"
+)
+
+type (
+	// realm is a child engine that runs every module from a single remote origin
+	realm struct {
+		e *E
+		// out copies values from the realm to its owner, in does the opposite
+		out, in *membrane
+	}
+)
+
+// IsolateRemote controls if remote modules run in the same runtime as
+// local code or if each origin gets its own runtime (realm).
+//
+// Modules from a realm are exposed to their importers through a membrane:
+// data is copied and functions are replaced by proxies that copy their
+// arguments and results, so untrusted code can never reach objects
+// (or intrinsics) from the importer. As a consequence, prototypes and
+// getters are lost when values cross the membrane, and promises are
+// settled (running the realm event loop) before being copied.
+//
+// Changing isolation only affects modules that were not loaded yet.
+func (e *E) IsolateRemote(isolate bool) {
+	e.require.isolate = isolate
+}
+
+// realmFor returns the realm used by modules from origin,
+// creating it if needed
+func (r *rootRequire) realmFor(origin *url.URL) (*realm, error) {
+	key := origin.String()
+	if rl := r.realms[key]; rl != nil {
+		return rl, nil
+	}
+	child, err := New()
+	if err != nil {
+		return nil, err
+	}
+	child.isWorker = true
+	child.require.isolate = true
+	child.require.realmOrigin = key
+	// remote modules cannot load local files
+	child.fs = afero.NewReadOnlyFs(afero.NewMemMapFs())
+	child.logger = r.e.logger
+	child.consoleLevel = r.e.consoleLevel
+	child.consoleToLogger = r.e.consoleToLogger
+	child.consolePlainText = r.e.consolePlainText
+	child.secrets = r.e.secrets
+	child.audit = r.e.audit
+	child.UseProgramCache(r.e.programs)
+	// the child must not close the streams of its owner
+	child.ConnectStdio(noInput{}, struct{ io.Writer }{r.e.stdout}, struct{ io.Writer }{r.e.stderr})
+	if r.e.locked {
+		if err := child.Lockdown(); err != nil {
+			child.Close()
+			return nil, err
+		}
+	}
+	rl := &realm{e: child}
+	rl.out, rl.in = newMembranes(child, r.e)
+	if r.realms == nil {
+		r.realms = make(map[string]*realm)
+	}
+	r.realms[key] = rl
+	return rl, nil
+}
+
+// requireIsolated loads the remote module name in the realm of its origin
+// and returns a copy of its exports
+func (r *rootRequire) requireIsolated(name string, importer string) goja.Value {
+	target, err := url.Parse(name)
+	if err != nil || target.Scheme == "" {
+		panic(r.e.runtime.NewGoError(fmt.Errorf("module %v cannot be parsed as a valid module path", name)))
+	}
+	key := "realm:" + target.String()
+	if def := r.hasModule(key); def != nil {
+		r.trackModule(importer, ModuleInfo{Resolved: r.realmModules[key]})
+		return def.exports
+	}
+	rl, err := r.realmFor(computeOrigin(target))
+	if err != nil {
+		panic(r.e.runtime.NewGoError(err))
+	}
+	exports, info, err := rl.require(name)
+	if err != nil {
+		panic(r.e.runtime.NewGoError(err))
+	}
+	exports, err = r.e.freeze(exports)
+	if err != nil {
+		panic(r.e.runtime.NewGoError(err))
+	}
+	r.saveModule(key, &moduleDef{exports: exports})
+	if r.realmModules == nil {
+		r.realmModules = make(map[string]string)
+	}
+	r.realmModules[key] = info.Resolved
+	r.trackModule(importer, info)
+	return exports
+}
+
+// require loads name inside the realm, errors never contain
+// values from the realm runtime
+func (rl *realm) require(name string) (goja.Value, ModuleInfo, error) {
+	rt := rl.e.runtime
+	require, _ := goja.AssertFunction(rt.Get("require"))
+	exports, err := require(goja.Undefined(), rt.ToValue(name))
+	if err != nil {
+		rl.e.loop.reset()
+		return nil, ModuleInfo{}, errors.New(errorMessage(err))
+	}
+	var info ModuleInfo
+	if target, err := url.Parse(name); err == nil {
+		for _, candidate := range (&untrustedRemoteRequire{}).candidates(target) {
+			if loaded := rl.e.require.loaded[publicURL(candidate)]; loaded != nil {
+				info = *loaded
+				info.Importers = nil
+				break
+			}
+		}
+	}
+	copied, err := rl.out.wrap(exports)
+	if err != nil {
+		return nil, ModuleInfo{}, err
+	}
+	return copied, info, nil
+}
+
+// realmsInOrder returns every realm sorted by origin
+func (r *rootRequire) realmsInOrder() []*realm {
+	keys := make([]string, 0, len(r.realms))
+	for k := range r.realms {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	out := make([]*realm, 0, len(keys))
+	for _, k := range keys {
+		out = append(out, r.realms[k])
+	}
+	return out
+}
+
+func (r *rootRequire) closeRealms() {
+	for _, rl := range r.realms {
+		rl.e.Close()
+	}
+	r.realms = nil
+}
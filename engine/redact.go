@@ -0,0 +1,53 @@
+package engine
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+
+	"github.com/rs/zerolog"
+)
+
+const (
+	// ErrorIDField is the log field with the id of an error
+	ErrorIDField = "error_id"
+)
+
+type (
+	// RedactedError is the only kind of error shown to untrusted code
+	// when the engine fails on its behalf, the cause is sent to the logger
+	// and can be found using ID.
+	RedactedError struct {
+		Message string
+		ID      string
+	}
+)
+
+func (r *RedactedError) Error() string {
+	return fmt.Sprintf("%v (error id: %v)", r.Message, r.ID)
+}
+
+// SetLogger changes the logger used by the engine and its builtin modules,
+// errors hidden from untrusted code are only reported here.
+func (e *E) SetLogger(logger zerolog.Logger) {
+	e.logger = logger
+}
+
+// redact logs err and returns an error that only contains msg
+// and the id of the log entry, so it can be shown to untrusted code
+func (e *E) redact(tag string, msg string, err error) error {
+	return &RedactedError{
+		Message: msg,
+		ID:      e.logError(tag, err),
+	}
+}
+
+// newErrorID returns a random identifier, ids must be unique across
+// engines (workers, realms) and runs sharing the same log
+func newErrorID() string {
+	var buf [8]byte
+	if _, err := rand.Read(buf[:]); err != nil {
+		panic(fmt.Sprintf("unable to generate error id: %v", err))
+	}
+	return hex.EncodeToString(buf[:])
+}
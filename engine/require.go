@@ -4,9 +4,9 @@ import (
 	"errors"
 	"fmt"
 	"net/url"
-	"path"
 	"strings"
 
+	"github.com/andrebq/jtb/internal/modules/modutils"
 	"github.com/dop251/goja"
 )
 
@@ -22,13 +22,44 @@ type (
 		builtins map[string]*moduleDef
 		modules  map[string]*moduleDef
 
+		loaded    map[string]*ModuleInfo
+		loadOrder []string
+
 		dangerous               map[string]struct{}
 		builtinsAllowedOnRemote map[string]struct{}
 		restricted              map[string]struct{}
+
+		// isolate remote modules in realms, see E.IsolateRemote
+		isolate bool
+		// realmOrigin is the origin of the modules loaded by this engine,
+		// if it is the child engine of a realm
+		realmOrigin string
+		realms      map[string]*realm
+		// realmModules maps the key used to cache the exports of
+		// a realm module to its resolved name
+		realmModules map[string]string
+
+		// remoteCode is true once a remote module ran in this runtime
+		remoteCode bool
 	}
 
 	moduleDef struct {
 		exports goja.Value
+
+		// module is the CommonJS module object, it is nil for builtins
+		module *goja.Object
+		// initialExports is the exports object created before the module runs
+		initialExports *goja.Object
+
+		// loading is true while the module code is running, any require
+		// made during that time is part of a cycle and gets partial exports
+		loading bool
+		// partialExports is set when a cyclic require received
+		// the exports of this module before it finished loading
+		partialExports goja.Value
+
+		// definer is the module used to define a builtin
+		definer moduleDefiner
 	}
 
 	moduleDefiner interface {
@@ -62,19 +93,54 @@ func (r *rootRequire) mustNotBeRestricted(name string) {
 func (r *rootRequire) require(call goja.FunctionCall) goja.Value {
 	r.init()
 	name := call.Argument(0).ToString().Export().(string)
+	if r.calledFromRemote() {
+		return r.requireFromRemoteCaller(name)
+	}
 	r.mustNotBeRestricted(name)
 	return r.doRequire(name)
 }
 
-func (r *rootRequire) requireFromRemote(name string) goja.Value {
+// calledFromRemote reports if the global require was called by a remote
+// module (eg.: globalThis.require), which must get the same modules as
+// from its own require.
+//
+// Realms only run remote modules. Otherwise, the innermost javascript frame
+// tells who called require, if there is none (eg.: require was passed to a
+// promise or a timer) any remote module that ran in this runtime could be
+// the caller.
+func (r *rootRequire) calledFromRemote() bool {
+	if r.realmOrigin != "" {
+		return true
+	}
+	remote, found := r.e.remoteCaller()
+	if !found {
+		return r.remoteCode
+	}
+	return remote
+}
+
+// requireFromRemoteCaller applies the rules of remote modules to name, local
+// files cannot be loaded as there is no remote module to resolve them from
+func (r *rootRequire) requireFromRemoteCaller(name string) goja.Value {
+	switch {
+	case r.isBuiltin(name):
+		return r.requireFromRemote(name, modutils.CallerModule(r.e.runtime))
+	case r.isRemote(name):
+		return r.requireRemote(name)
+	default:
+		panic(r.e.runtime.NewGoError(errModuleIsRestricted(fmt.Sprintf("Module %v is not allowed from remote hosts", name))))
+	}
+}
+
+func (r *rootRequire) requireFromRemote(name string, importer string) goja.Value {
 	r.mustBeSafeForRemote(name)
-	return r.doRequire(name)
+	return r.requireBuiltin(name, importer)
 }
 
 func (r *rootRequire) doRequire(name string) goja.Value {
 	switch {
 	case r.isBuiltin(name):
-		return r.requireBuiltin(name)
+		return r.requireBuiltin(name, "")
 	case r.isLocal(name):
 		return r.requireLocal(name)
 	case r.isRemote(name):
@@ -84,11 +150,25 @@ func (r *rootRequire) doRequire(name string) goja.Value {
 	}
 }
 
-func (r *rootRequire) requireBuiltin(name string) goja.Value {
+func (r *rootRequire) requireBuiltin(name string, importer string) goja.Value {
 	def := r.builtins[name]
 	if def == nil {
 		panic(r.e.runtime.NewGoError(fmt.Errorf("Module %v not defined", name)))
 	}
+	r.trackModule(importer, ModuleInfo{
+		Specifier: name,
+		Resolved:  name,
+		Trust:     TrustBuiltin,
+		Dangerous: r.isDangerous(name),
+	})
+	if r.isDangerous(name) {
+		ev := modutils.NewAuditEvent(r.e.runtime, AuditRequire)
+		if importer != "" {
+			ev.Module = importer
+		}
+		ev.Details["builtin"] = name
+		r.e.emitAudit(ev)
+	}
 	return def.exports
 }
 
@@ -98,6 +178,11 @@ func (r *rootRequire) requireLocal(name string) goja.Value {
 }
 
 func (r *rootRequire) requireRemote(name string) goja.Value {
+	if r.isolate {
+		if u, err := url.Parse(name); err == nil && computeOrigin(u).String() != r.realmOrigin {
+			return r.requireIsolated(name, "")
+		}
+	}
 	remote, err := newRemote(r, name)
 	if err != nil {
 		panic(r.e.runtime.NewGoError(errors.New("unable to create a untrusted remote")))
@@ -157,6 +242,7 @@ func (r *rootRequire) registerBuiltin(name string, definer moduleDefiner) error
 	exports := r.e.runtime.CreateObject(nil)
 	df := &moduleDef{
 		exports: exports,
+		definer: definer,
 	}
 	err := definer.DefineModule(exports, r.e.runtime)
 	if err != nil {
@@ -177,7 +263,7 @@ func (r *rootRequire) isLocal(name string) bool {
 	if err != nil {
 		return false
 	}
-	return u.Scheme == "" && path.Ext(path.Clean(u.Path)) == ".js"
+	return u.Scheme == "" && u.Path != ""
 }
 
 func (r *rootRequire) isRemote(name string) bool {
@@ -185,7 +271,7 @@ func (r *rootRequire) isRemote(name string) bool {
 	if err != nil {
 		return false
 	}
-	return u.Scheme != "" && path.Ext(path.Clean(u.Path)) == ".js"
+	return u.Scheme != "" && u.Path != ""
 }
 func (r *rootRequire) hasModule(name string) *moduleDef {
 	r.init()
@@ -202,6 +288,7 @@ func (r *rootRequire) init() {
 	r.builtins = make(map[string]*moduleDef)
 	r.dangerous = make(map[string]struct{})
 	r.modules = make(map[string]*moduleDef)
+	r.loaded = make(map[string]*ModuleInfo)
 	r.restricted = make(map[string]struct{})
 	r.builtinsAllowedOnRemote = make(map[string]struct{})
 	r.initDone = true
@@ -212,6 +299,74 @@ func (r *rootRequire) saveModule(name string, md *moduleDef) {
 	r.modules[name] = md
 }
 
+func (r *rootRequire) forgetModule(name string) {
+	r.init()
+	delete(r.modules, name)
+}
+
+// newModuleDef returns a module that is ready to be executed,
+// it should be saved before running its code so cyclic requires can find it.
+func (r *rootRequire) newModuleDef(id string) *moduleDef {
+	exports := r.e.runtime.NewObject()
+	module := r.e.runtime.NewObject()
+	module.Set("id", id)
+	module.Set("filename", id)
+	module.Set("exports", exports)
+	module.Set("loaded", false)
+	return &moduleDef{
+		module:         module,
+		initialExports: exports,
+		exports:        exports,
+		loading:        true,
+	}
+}
+
+// exportsOf returns the exports of md, if md is still loading,
+// the caller is part of a cycle and gets whatever was exported so far.
+func (r *rootRequire) exportsOf(md *moduleDef) goja.Value {
+	if !md.loading {
+		return md.exports
+	}
+	md.partialExports = md.module.Get("exports")
+	return md.partialExports
+}
+
+// runModule executes the module wrapper compiled from program and
+// freezes its exports once it returns.
+func (r *rootRequire) runModule(md *moduleDef, name string, program *goja.Program, requireFn goja.Value, filename, dirname string) {
+	moduleOutput, err := r.e.runtime.RunProgram(program)
+	if err != nil {
+		panic(r.e.runtime.NewGoError(fmt.Errorf("Unable to load %v, cause %w", name, err)))
+	}
+	loader, ok := goja.AssertFunction(moduleOutput)
+	if !ok {
+		panic("This should never ever happen! There something really really wrong with jtb!!!")
+	}
+	requireFn, err = r.e.freeze(requireFn)
+	if err != nil {
+		panic(r.e.runtime.NewGoError(err))
+	}
+	this := r.e.runtime.NewObject()
+	this.Set("require", requireFn)
+	this.Set("exports", md.initialExports)
+	_, err = loader(this, md.initialExports, requireFn, md.module, r.e.runtime.ToValue(filename), r.e.runtime.ToValue(dirname))
+	if err != nil {
+		// err is a GoError
+		panic(err)
+	}
+	exports := md.module.Get("exports")
+	if md.partialExports != nil && !exports.SameAs(md.partialExports) {
+		panic(r.e.runtime.NewGoError(fmt.Errorf("Circular dependency detected: %v replaced module.exports after its partial exports were used by a cyclic require", name)))
+	}
+	md.exports, err = r.e.freeze(exports)
+	if err != nil {
+		panic(r.e.runtime.NewGoError(err))
+	}
+	md.module.Set("loaded", true)
+	r.e.freeze(md.module)
+	md.loading = false
+}
+
 func (e *rootRequire) canRegisterBuiltin(name string) error {
 	if !strings.HasPrefix(name, "@") {
 		return errors.New("builtin modules must start with @")
@@ -0,0 +1,37 @@
+package engine
+
+import (
+	"io"
+)
+
+// Redact returns text without the values of the secrets loaded by
+// scripts (using @secrets) in this engine or in its workers.
+//
+// console, the logger and audit events are already redacted by the engine,
+// Redact is useful for errors and output produced by the application.
+func (e *E) Redact(text string) string {
+	return e.secrets.Redact(text)
+}
+
+// RedactWriter returns a writer that redacts every call to Write before
+// sending it to w, eg.: to create loggers that never store secrets.
+func (e *E) RedactWriter(w io.Writer) io.Writer {
+	return e.secrets.Writer(w)
+}
+
+// redactValue removes secrets from the strings in v
+func (e *E) redactValue(v interface{}) interface{} {
+	switch v := v.(type) {
+	case string:
+		return e.Redact(v)
+	case []string:
+		out := make([]string, len(v))
+		for i, s := range v {
+			out[i] = e.Redact(s)
+		}
+		return out
+	case error:
+		return e.Redact(v.Error())
+	}
+	return v
+}
@@ -0,0 +1,10 @@
+const exec = require("@rawexec");
+
+exports.run = function() {
+	exec.call("echo", { args: ["hello"] });
+	try {
+		exec.call("ls");
+	} catch (e) {
+		// denied by the scope of @rawexec
+	}
+};
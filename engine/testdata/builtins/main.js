@@ -0,0 +1,9 @@
+exports.version = require("@jtb").version;
+
+exports.exec = function() {
+    return typeof require("@rawexec").call;
+};
+
+exports.remote = function(url) {
+    return require(url);
+};
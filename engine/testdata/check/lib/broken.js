@@ -0,0 +1 @@
+exports.value = function( {
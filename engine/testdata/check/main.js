@@ -0,0 +1,11 @@
+const lib = require("./lib");
+const exec = require("@rawexec");
+const broken = require("./lib/broken.js");
+const missing = require("./missing.js");
+const outside = require("../shouldNeverBeImported.js");
+
+function dynamic(name) {
+	return require(name);
+}
+
+exports.lib = lib;
@@ -0,0 +1,5 @@
+const lib = require("./lib");
+const data = require("./lib/data.json");
+if (!lib.greet) return;
+
+exports.msg = lib.greet(data.name);
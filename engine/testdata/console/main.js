@@ -0,0 +1,2 @@
+console.info("hidden");
+console.error("from module", 1);
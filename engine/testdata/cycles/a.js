@@ -0,0 +1,4 @@
+exports.name = "a";
+let b = require("./b.js");
+exports.fromB = b.name;
+exports.bSawA = b.sawA;
@@ -0,0 +1,4 @@
+let a = require("./a.js");
+// a is still loading, so only what it exported so far is visible
+exports.sawA = a.name;
+exports.name = "b";
@@ -0,0 +1,3 @@
+module.exports = function() {
+	return { filename: __filename, dirname: __dirname, id: module.id };
+};
@@ -0,0 +1,2 @@
+let b = require("./unsafeB.js");
+module.exports = function() { return b; };
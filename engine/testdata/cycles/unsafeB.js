@@ -0,0 +1,2 @@
+let a = require("./unsafeA.js");
+exports.a = a;
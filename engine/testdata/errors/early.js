@@ -0,0 +1,3 @@
+module.exports = "early";
+if (true) return;
+module.exports = "late";
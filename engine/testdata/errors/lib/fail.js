@@ -0,0 +1,6 @@
+exports.fail = function() { throw new Error("boom"); };
+
+exports.nested = function() {
+	let value = 1;
+	return exports.fail(value);
+};
@@ -0,0 +1,5 @@
+let lib = require("./lib/fail.js");
+
+exports.run = function() {
+	lib.nested();
+};
@@ -0,0 +1,5 @@
+export const name = "lib";
+
+export default function greet(who) {
+	return "hello " + who;
+}
@@ -0,0 +1,11 @@
+import jtb from "@jtb";
+import { version } from "@jtb";
+import greet, { name } from "./lib.js";
+import legacy from "./legacy.js";
+import * as usesESM from "./usesESM.js";
+
+export const result = greet("jtb");
+export const libName = name;
+export const legacyName = legacy.name;
+export const fromCJS = usesESM.greeting;
+export const sameVersion = jtb.version === version;
@@ -0,0 +1,2 @@
+let lib = require("./lib.js");
+exports.greeting = lib.default("cjs") + " from " + lib.name;
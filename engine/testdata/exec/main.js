@@ -0,0 +1,97 @@
+const exec = require("@rawexec");
+const { decode } = require("@encoding/utf8");
+
+function sh(script, opts) {
+	return exec.call("sh", Object.assign({ args: ["-c", script] }, opts || {}));
+}
+
+exports.env = function() {
+	return decode(sh('echo "$FOO-$HOME"', { env: { FOO: "bar" } }).stdout);
+};
+
+exports.cwd = function(dir) {
+	return decode(sh("pwd", { cwd: dir }).stdout).trim();
+};
+
+exports.timeout = function() {
+	return sh("sleep 5", { timeout: "100ms" });
+};
+
+exports.truncated = function() {
+	const res = sh("printf 0123456789", { maxOutput: 4 });
+	return { stdout: decode(res.stdout), truncated: res.truncated };
+};
+
+exports.stream = function() {
+	const lines = [];
+	sh("echo a; echo b >&2; printf c", {
+		onStdout: (line) => lines.push("out:" + line),
+		onStderr: (line) => lines.push("err:" + line),
+	});
+	return lines;
+};
+
+exports.streamAsync = async function() {
+	const lines = [];
+	await exec.call_async("sh", {
+		args: ["-c", "echo a; echo b"],
+		onStdout: (line) => lines.push(line),
+	});
+	return lines;
+};
+
+exports.forward = function() {
+	sh("echo forwarded", { forward: true });
+};
+
+exports.failingCallback = function() {
+	sh("echo a; sleep 5", {
+		timeout: "10s",
+		onStdout: () => { throw new Error("stop"); },
+	});
+};
+
+exports.run = function(binary, args) {
+	return decode(exec.call_strict(binary, { args: args }).stdout);
+};
+
+exports.pipeline = function() {
+	const res = exec.pipeline([
+		{ command: "printf", args: ["b\na\nc\n"] },
+		{ command: "sort" },
+		{ command: "head", args: ["-n", "2"] },
+	]);
+	return { stdout: decode(res.stdout), stages: res.stages.map((s) => s.command + ":" + s.exitCode) };
+};
+
+exports.pipelineFailure = function(strict) {
+	const stages = [
+		{ command: "sh", args: ["-c", "echo oops >&2; exit 3"] },
+		{ command: "cat" },
+	];
+	if (strict) {
+		return exec.pipeline_strict(stages);
+	}
+	const res = exec.pipeline(stages);
+	return { exitCode: res.exitCode, stderr: decode(res.stderr), stages: res.stages.map((s) => s.exitCode) };
+};
+
+exports.redirect = async function(file) {
+	await exec.pipeline_strict_async([{ command: "echo", args: ["first"] }], { stdout: file });
+	await exec.pipeline_strict_async([{ command: "tr", args: ["a-z", "A-Z"] }], { input: "second\n", stdout: file, append: true });
+	return decode(exec.pipeline_strict([{ command: "cat" }], { stdin: file }).stdout);
+};
+
+exports.limits = function(limits) {
+	return decode(sh("ulimit -t; ulimit -n; ulimit -v", { limits: limits }).stdout);
+};
+
+exports.orphan = function() {
+	// the background sleep keeps running after sh is killed,
+	// unless the whole process group is killed
+	return decode(sh("sleep 30 & echo $!; wait", { timeout: "200ms" }).stdout).trim();
+};
+
+exports.sleep = function() {
+	return sh("sleep 30").exitCode;
+};
@@ -0,0 +1,26 @@
+"use strict";
+
+class Point {
+	constructor(x, y) {
+		this.x = x;
+		this.y = y;
+	}
+}
+
+exports.check = function() {
+	const err = new Error("custom");
+	err.name = "CustomError";
+	const obj = {};
+	obj.toString = function() { return "overridden"; };
+	return {
+		map: [1, 2].map(function(v) { return v * 2; }).join(","),
+		polluted: ({}).polluted === undefined,
+		json: JSON.stringify(JSON.parse('{"a":1}')),
+		errorName: err.name + ": " + err.message,
+		typeErrorMessage: new TypeError("ok").message,
+		override: String(obj),
+		point: new Point(1, 2).constructor === Point,
+		functionCtor: Function("a", "return a + 1")(1),
+		eval: eval("1 + 1"),
+	};
+};
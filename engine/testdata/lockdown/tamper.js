@@ -0,0 +1,33 @@
+"use strict";
+
+function attempt(fn) {
+	try {
+		fn();
+		return "tampered";
+	} catch (e) {
+		return "blocked";
+	}
+}
+
+exports.results = {
+	arrayMap: attempt(function() { Array.prototype.map = function() { return "poisoned"; }; }),
+	arrayMapDefine: attempt(function() { Object.defineProperty(Array.prototype, "map", { value: null }); }),
+	objectPrototype: attempt(function() { Object.prototype.polluted = true; }),
+	protoSetter: attempt(function() { ({}).__proto__.polluted = true; }),
+	toString: attempt(function() { Object.prototype.toString = function() { return "poisoned"; }; }),
+	json: attempt(function() { JSON.parse = function() { return {}; }; }),
+	math: attempt(function() { Math.random = function() { return 4; }; }),
+	regexp: attempt(function() { RegExp.prototype.test = function() { return true; }; }),
+	promise: attempt(function() { Promise.prototype.then = null; }),
+	map: attempt(function() { Map.prototype.get = null; }),
+	error: attempt(function() { TypeError.prototype.message = "poisoned"; }),
+	iterator: attempt(function() { Object.getPrototypeOf([][Symbol.iterator]()).next = null; }),
+	globalBinding: attempt(function() { globalThis.JSON = {}; }),
+	timers: attempt(function() { globalThis.setTimeout = null; }),
+	functionCtor: attempt(function() { Function("return 1")(); }),
+	eval: attempt(function() { eval("1"); }),
+	indirectEval: attempt(function() { (0, globalThis.eval)("1"); }),
+	constructorChain: attempt(function() { [].map.constructor("return 1")(); }),
+	asyncFunction: attempt(function() { (async function() {}).constructor("return 1"); }),
+	generatorFunction: attempt(function() { (function*() {}).constructor("yield 1"); }),
+};
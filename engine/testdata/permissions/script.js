@@ -0,0 +1,14 @@
+#!/usr/bin/env jtb
+// permissions:
+//   @rawexec: [echo]
+//   @stdio
+
+const exec = require("@rawexec");
+
+exports.echo = function(msg) {
+	return exec.call("echo", { args: [msg] }).exitCode;
+};
+
+exports.list = function() {
+	return exec.call("ls").exitCode;
+};
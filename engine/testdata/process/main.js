@@ -0,0 +1,14 @@
+const process = require("@process");
+
+process.onExit((code) => console.info("hook", code));
+
+exports.run = function(code) {
+    try {
+        process.exit(code);
+    } catch (e) {
+        console.info("caught", e);
+    } finally {
+        console.info("finally");
+    }
+    console.info("after exit");
+};
@@ -0,0 +1,39 @@
+"use strict";
+
+// changes to intrinsics only affect the realm of this module
+Array.prototype.poisoned = true;
+
+exports.data = { list: [1, 2, { nested: true }], text: "hi", when: new Date(0) };
+
+exports.add = function(a, b) {
+	return a + b;
+};
+
+// tries to reach the global object of whoever calls it
+exports.steal = function(value) {
+	try {
+		value.constructor.constructor("return this")().stolen = true;
+	} catch (e) {
+		// ignore
+	}
+	value.secret = "changed";
+	return typeof value.secret;
+};
+
+exports.callback = function(fn) {
+	return fn(20) + 1;
+};
+
+exports.identity = function(v) {
+	return v;
+};
+
+exports.fail = function() {
+	throw new Error("remote failure");
+};
+
+exports.later = function(v) {
+	return new Promise(function(resolve) {
+		setTimeout(function() { resolve(v * 2); }, 1);
+	});
+};
@@ -0,0 +1,12 @@
+function attempt(name) {
+	try {
+		require(name);
+	} catch (e) {
+		return e.message;
+	}
+	return "loaded";
+}
+
+exports.missing = attempt("./missing.js");
+exports.unreachable = attempt("http://127.0.0.1:1/private.js");
+exports.invalid = attempt("./invalid.json");
@@ -0,0 +1,13 @@
+// globalThis.require is the require used by the interactive evaluator,
+// it must not give remote modules more than their own require
+exports.builtin = function () {
+	return globalThis.require("@process").argv;
+};
+
+exports.local = function () {
+	return globalThis.require("./main.js");
+};
+
+exports.later = function () {
+	return Promise.resolve("@process").then(globalThis.require);
+};
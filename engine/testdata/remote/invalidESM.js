@@ -0,0 +1,3 @@
+import exec from "@rawexec";
+
+export const msg = "hello";
@@ -0,0 +1 @@
+exports.name = "lib";
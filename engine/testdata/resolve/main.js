@@ -0,0 +1,9 @@
+let lib = require("./lib");
+let util = require("./util");
+let config = require("./config.json");
+let values = require("./values.yaml");
+
+exports.lib = lib.name;
+exports.util = util.name;
+exports.config = config;
+exports.values = values;
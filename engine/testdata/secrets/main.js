@@ -0,0 +1,17 @@
+const secrets = require("@secrets");
+const exec = require("@rawexec");
+
+exports.print = function(name) {
+    const token = secrets.env(name);
+    console.info("token:", token, String(token), secrets.isSecret(token), secrets.isSecret("x"));
+    const res = exec.call("printenv", { args: [name], env: { [name]: token } });
+    console.info(res.stdoutText().trim());
+    return JSON.stringify({ token });
+};
+
+exports.file = function(path) {
+    const token = secrets.file(path);
+    const res = exec.call("printenv", { args: ["TOKEN"], env: { TOKEN: token } });
+    console.error("file:", res.stdoutText().trim());
+    return res.stdoutText().trim().length;
+};
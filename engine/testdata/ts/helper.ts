@@ -0,0 +1,20 @@
+import { Version } from "./types";
+
+interface Named {
+	name: string;
+}
+
+export enum Level {
+	Low = 1,
+	High,
+}
+
+export function greet(who: Named, level: Level = Level.Low): string {
+	return `hello ${who.name ?? "nobody"} (${level})`;
+}
+
+export const version: Version = { major: 1, minor: 0 };
+
+export function fail(): never {
+	throw new Error("failed on purpose");
+}
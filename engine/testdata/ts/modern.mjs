@@ -0,0 +1,8 @@
+export class Counter {
+	#count = 0;
+
+	inc() {
+		this.#count ||= 0;
+		return ++this.#count;
+	}
+}
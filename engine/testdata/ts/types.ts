@@ -0,0 +1,4 @@
+export type Version = {
+	major: number;
+	minor: number;
+};
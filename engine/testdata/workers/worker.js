@@ -0,0 +1,30 @@
+let utf8 = require("@encoding/utf8");
+
+exports.double = function(item) {
+	return {
+		value: item.value * 2,
+		label: utf8.encode("item-" + item.value),
+	};
+};
+
+exports.later = async function(item) {
+	return await require("@sleep").after("1ms", item * 10);
+};
+
+exports.fail = function(item) {
+	throw new Error("cannot process " + item);
+};
+
+exports.print = function(item) {
+	for (let i = 0; i < 20; i++) {
+		console.info("worker", item);
+	}
+	return item;
+};
+
+exports.audited = function(item) {
+	for (let i = 0; i < 20; i++) {
+		require("@rawexec");
+	}
+	return item;
+};
@@ -0,0 +1,106 @@
+package engine
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"path"
+	"regexp"
+	"strings"
+
+	"github.com/evanw/esbuild/pkg/api"
+)
+
+type (
+	// transpiled holds the output of esbuild and its source map
+	transpiled struct {
+		code      []byte
+		sourceMap []byte
+	}
+)
+
+var (
+	// esmSyntax matches top-level import/export statements, dynamic imports
+	// (eg.: import("x")) are not considered ES module syntax
+	esmSyntax = regexp.MustCompile(`(?m)^\s*(import(\s+[\w$"']|\s*[{*"'])|export(\s+[\w$]|\s*[{*]))`)
+)
+
+// needsTranspile returns true if code cannot be executed by goja as-is,
+// which is the case for TypeScript, .mjs files and any ES module.
+func needsTranspile(modulePath string, code []byte) bool {
+	switch path.Ext(modulePath) {
+	case ".ts", ".mjs":
+		return true
+	}
+	return esmSyntax.Match(code)
+}
+
+// transpile converts code to a CommonJS module that goja can execute.
+//
+// Static imports become calls to require, so they follow exactly the same
+// trust rules. Default imports of CommonJS modules receive module.exports,
+// while ES modules keep their own default export.
+//
+// TypeScript and .mjs files are also lowered to a syntax goja understands,
+// plain .js files are only converted from ES modules to CommonJS.
+//
+// The returned source map points to sourceFile, which should be relative to
+// the name used to compile the module.
+func transpile(name string, modulePath string, sourceFile string, code []byte) (*transpiled, error) {
+	opts := api.TransformOptions{
+		Loader:     api.LoaderJS,
+		Format:     api.FormatCommonJS,
+		Target:     api.ESNext,
+		Sourcemap:  api.SourceMapExternal,
+		Sourcefile: sourceFile,
+	}
+	switch path.Ext(modulePath) {
+	case ".ts":
+		opts.Loader = api.LoaderTS
+		opts.Target = api.ES2017
+	case ".mjs":
+		opts.Target = api.ES2017
+		// esbuild uses node semantics for default imports of .mjs files,
+		// the source map fixes the name later
+		opts.Sourcefile = strings.TrimSuffix(sourceFile, ".mjs") + ".js"
+	}
+	res := api.Transform(string(code), opts)
+	if len(res.Errors) > 0 {
+		return nil, esbuildError(name, res.Errors)
+	}
+	if opts.Sourcefile != sourceFile {
+		var err error
+		res.Map, err = renameSource(res.Map, sourceFile)
+		if err != nil {
+			return nil, err
+		}
+	}
+	return &transpiled{code: res.Code, sourceMap: res.Map}, nil
+}
+
+// sourceMapComment returns the comment used by goja to load an inline source map
+func sourceMapComment(sourceMap []byte) string {
+	return "//# sourceMappingURL=data:application/json;base64," + base64.StdEncoding.EncodeToString(sourceMap)
+}
+
+func renameSource(sourceMap []byte, sourceFile string) ([]byte, error) {
+	var sm map[string]interface{}
+	if err := json.Unmarshal(sourceMap, &sm); err != nil {
+		return nil, err
+	}
+	sm["sources"] = []string{sourceFile}
+	return json.Marshal(sm)
+}
+
+func esbuildError(name string, messages []api.Message) error {
+	var lines []string
+	for _, m := range messages {
+		if m.Location != nil {
+			lines = append(lines, fmt.Sprintf("%v:%v:%v: %v", name, m.Location.Line, m.Location.Column, m.Text))
+		} else {
+			lines = append(lines, fmt.Sprintf("%v: %v", name, m.Text))
+		}
+	}
+	return errors.New(strings.Join(lines, "\n"))
+}
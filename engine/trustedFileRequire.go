@@ -2,6 +2,7 @@ package engine
 
 import (
 	"fmt"
+	"os"
 	"path"
 	"path/filepath"
 
@@ -13,19 +14,53 @@ type (
 	trustedFileRequire struct {
 		root *rootRequire
 		dir  string
+
+		// importer is the module that owns this require function
+		importer string
 	}
 )
 
+// require loads a local module or a builtin.
+//
+// Local files are part of the script being run (they are inside the anchor
+// and were written or reviewed by the user), so they get the same builtins as
+// the code evaluated by the engine: restricted builtins still require Unrestrict
+// (or Grant), but a script can split its code across files. Remote modules are
+// loaded by untrustedRemoteRequire, which only exposes remote builtins.
 func (tf *trustedFileRequire) require(name string) goja.Value {
+	if tf.root.isBuiltin(name) {
+		tf.root.mustNotBeRestricted(name)
+		return tf.root.requireBuiltin(name, tf.importer)
+	}
 	absPath, relativePath, err := tf.resolvePathTo(name)
 	if err != nil {
 		panic(tf.root.e.runtime.NewGoError(fmt.Errorf("Unable to resolve path to %v", name)))
 	}
 	if def := tf.root.hasModule(absPath); def != nil {
-		return def.exports
+		tf.root.trackModule(tf.importer, ModuleInfo{Resolved: relativePath})
+		return tf.root.exportsOf(def)
 	}
-	tf.root.saveModule(absPath, tf.loadModule(name, relativePath, absPath))
-	return tf.root.hasModule(absPath).exports
+	content, err := afero.ReadFile(tf.root.e.fs, relativePath)
+	if err != nil {
+		panic(tf.root.e.runtime.NewGoError(fmt.Errorf("Unable to read %v, cause: %w", name, err)))
+	}
+	def := tf.root.newModuleDef(relativePath)
+	tf.root.saveModule(absPath, def)
+	tf.root.trackModule(tf.importer, ModuleInfo{
+		Specifier: name,
+		Resolved:  relativePath,
+		Trust:     TrustLocal,
+		Hash:      contentHash(content),
+	})
+	defer func() {
+		if def.loading {
+			// loading failed, do not keep partial modules around
+			tf.root.forgetModule(absPath)
+			tf.root.untrackModule(relativePath)
+		}
+	}()
+	tf.loadModule(def, name, relativePath, content)
+	return def.exports
 }
 
 func (tf *trustedFileRequire) javascriptRequire(call goja.FunctionCall) goja.Value {
@@ -33,69 +68,54 @@ func (tf *trustedFileRequire) javascriptRequire(call goja.FunctionCall) goja.Val
 	return tf.require(name)
 }
 
+// resolvePathTo returns the first candidate (see moduleCandidates)
+// that exists inside the anchor.
 func (tf *trustedFileRequire) resolvePathTo(name string) (absPath string, relativePath string, err error) {
-	relativePath = path.Join(tf.dir, name)
-	// TODO: think if this extra precaution is really useful
-	// tf.root.anchor should be absolute already
-	// but it doesn't hurt to add it here
-	absPath, err = filepath.Abs(filepath.Join(tf.root.anchor, filepath.FromSlash(path.Clean(relativePath))))
+	for _, candidate := range moduleCandidates(path.Join(tf.dir, name)) {
+		var stat os.FileInfo
+		stat, err = tf.root.e.fs.Stat(candidate)
+		if err != nil {
+			continue
+		}
+		if stat.IsDir() {
+			err = fmt.Errorf("%v is a directory", candidate)
+			continue
+		}
+		relativePath = candidate
+		// TODO: think if this extra precaution is really useful
+		// tf.root.anchor should be absolute already
+		// but it doesn't hurt to add it here
+		absPath, err = filepath.Abs(filepath.Join(tf.root.anchor, filepath.FromSlash(relativePath)))
+		return
+	}
 	return
 }
 
-func (tf *trustedFileRequire) loadModule(name string, relativePath string, absPath string) *moduleDef {
-	code, err := tf.parseCode(name, relativePath)
-	if err != nil {
-		panic(tf.root.e.runtime.NewGoError(fmt.Errorf("Unable to parse %v, cause: %w", name, err)))
+func (tf *trustedFileRequire) loadModule(def *moduleDef, name string, relativePath string, content []byte) {
+	if kind := kindOf(relativePath); kind != scriptModule {
+		if err := tf.root.loadData(def, name, kind, content); err != nil {
+			panic(tf.root.e.runtime.NewGoError(err))
+		}
+		return
 	}
-	moduleOutput, err := tf.root.e.runtime.RunProgram(code)
+	code, err := tf.parseCode(name, relativePath, content)
 	if err != nil {
-		panic(tf.root.e.runtime.NewGoError(fmt.Errorf("Unable to load %v, cause %w", name, err)))
-	}
-	loader, ok := goja.AssertFunction(moduleOutput)
-	if !ok {
-		panic("This should never ever happen! There some really really wrong with jtb!!!")
+		panic(tf.root.e.runtime.NewGoError(fmt.Errorf("Unable to parse %v, cause: %w", name, err)))
 	}
-	this := tf.root.e.runtime.NewObject()
-	exports := tf.root.e.runtime.NewObject()
 	sub := tf.sub(relativePath)
 	requireFn := tf.root.e.runtime.ToValue(sub.javascriptRequire)
-	this.Set("require", requireFn)
-	this.Set("exports", exports)
-	_, err = loader(this, exports, requireFn)
-	if err != nil {
-		// err is a GoError
-		panic(err)
-	}
-	return &moduleDef{
-		exports: exports,
-	}
+	tf.root.runModule(def, name, code, requireFn, relativePath, sub.dir)
 }
 
 func (tf *trustedFileRequire) sub(relpath string) *trustedFileRequire {
 	return &trustedFileRequire{
-		root: tf.root,
-		dir:  path.Dir(relpath),
+		root:     tf.root,
+		dir:      path.Dir(relpath),
+		importer: relpath,
 	}
 }
 
-func (tf *trustedFileRequire) parseCode(name string, relPath string) (*goja.Program, error) {
-	bytes, err := afero.ReadFile(tf.root.e.fs, relPath)
-	if err != nil {
-		return nil, err
-	}
-
-	safeCode := fmt.Sprintf(`(function(exports, require) {
-		Object.freeze(require);
-		(function(){
-			%v
-			;
-		}).apply(this);
-		Object.freeze(exports);
-	})`, string(bytes))
-
-	program, err := goja.Compile(name, safeCode, true)
-	if err != nil {
-		return nil, err
-	}
-	return program, nil
+func (tf *trustedFileRequire) parseCode(name string, relPath string, bytes []byte) (*goja.Program, error) {
+	// stack traces show paths relative to the anchor
+	return tf.root.e.compileModule(relPath, relPath, path.Base(relPath), bytes)
 }
@@ -8,6 +8,7 @@ import (
 	"net/url"
 	"path"
 
+	"github.com/andrebq/jtb/internal/modules/modutils"
 	"github.com/dop251/goja"
 )
 
@@ -17,9 +18,16 @@ type (
 		origin     *url.URL
 		baseURL    *url.URL
 		httpClient *http.Client
+
+		// importer is the module that owns this require function
+		importer string
 	}
 )
 
+var (
+	errRemoteNotFound = errors.New("remote module not found")
+)
+
 func newRemote(root *rootRequire, target string) (*untrustedRemoteRequire, error) {
 	u, err := url.Parse(target)
 	if err != nil {
@@ -40,7 +48,7 @@ func newRemote(root *rootRequire, target string) (*untrustedRemoteRequire, error
 
 func (r *untrustedRemoteRequire) require(name string) goja.Value {
 	if r.root.isBuiltin(name) {
-		return r.root.requireFromRemote(name)
+		return r.root.requireFromRemote(name, r.importer)
 	}
 	// TODO: currently, it is impossible to use builtin modules from untrusted sources
 	// relax this restriction so `some` builtin modules can be loaded.
@@ -52,6 +60,9 @@ func (r *untrustedRemoteRequire) require(name string) goja.Value {
 		// TODO: check if the scheme is http or https, if not fail!
 		// treat it as absolute URL
 		if !r.sameOrigin(target) {
+			if r.root.isolate {
+				return r.root.requireIsolated(name, r.importer)
+			}
 			return (r.newOrigin(target)).require(name)
 		}
 	} else {
@@ -59,12 +70,67 @@ func (r *untrustedRemoteRequire) require(name string) goja.Value {
 		target = r.absURL(target.Path)
 	}
 
+	candidates := r.candidates(target)
+	for _, candidate := range candidates {
+		if module := r.root.hasModule(candidate.String()); module != nil {
+			r.root.trackModule(r.importer, ModuleInfo{Resolved: publicURL(candidate)})
+			return r.root.exportsOf(module)
+		}
+	}
+	target, content, err := r.downloadFirst(candidates)
+	if err != nil {
+		panic(r.root.e.runtime.NewGoError(r.root.e.redact("remote.download",
+			fmt.Sprintf("Unable to download %v", name),
+			fmt.Errorf("unable to download %v (tried %v): %w", name, candidates, err))))
+	}
+
 	// TODO: remove the number of calls to target.String()
-	if module := r.root.hasModule(target.String()); module != nil {
-		return module.exports
+	def := r.root.newModuleDef(publicURL(target))
+	r.root.saveModule(target.String(), def)
+	r.root.trackModule(r.importer, ModuleInfo{
+		Specifier: name,
+		Resolved:  publicURL(target),
+		Trust:     TrustRemote,
+		Hash:      contentHash(content),
+	})
+	defer func() {
+		if def.loading {
+			// loading failed, do not keep partial modules around
+			r.root.forgetModule(target.String())
+			r.root.untrackModule(publicURL(target))
+		}
+	}()
+	r.loadModule(def, name, target, content)
+	return def.exports
+}
+
+// candidates returns the URLs that should be tried when resolving target,
+// see moduleCandidates.
+func (r *untrustedRemoteRequire) candidates(target *url.URL) []*url.URL {
+	var urls []*url.URL
+	for _, p := range moduleCandidates(target.Path) {
+		u := *target
+		u.Path = p
+		urls = append(urls, &u)
 	}
-	r.root.saveModule(target.String(), r.loadModule(name, target))
-	return r.root.hasModule(target.String()).exports
+	return urls
+}
+
+// downloadFirst returns the content of the first candidate
+// that can be downloaded
+func (r *untrustedRemoteRequire) downloadFirst(candidates []*url.URL) (*url.URL, []byte, error) {
+	var err error
+	for _, candidate := range candidates {
+		var content []byte
+		content, err = r.downloadCode(candidate)
+		if errors.Is(err, errRemoteNotFound) {
+			continue
+		} else if err != nil {
+			return nil, nil, err
+		}
+		return candidate, content, nil
+	}
+	return nil, nil, err
 }
 
 func (r *untrustedRemoteRequire) javascriptRequire(call goja.FunctionCall) goja.Value {
@@ -72,82 +138,63 @@ func (r *untrustedRemoteRequire) javascriptRequire(call goja.FunctionCall) goja.
 	return r.require(name)
 }
 
-func (r *untrustedRemoteRequire) loadModule(name string, target *url.URL) *moduleDef {
-	code, err := r.parseCode(name, target)
-	if err != nil {
-		panic(r.root.e.runtime.NewGoError(fmt.Errorf("Unable to parse %v, cause: %w", name, err)))
+func (r *untrustedRemoteRequire) loadModule(def *moduleDef, name string, target *url.URL, content []byte) {
+	if kind := kindOf(target.Path); kind != scriptModule {
+		if err := r.root.loadData(def, name, kind, content); err != nil {
+			panic(r.root.e.runtime.NewGoError(r.root.e.redact("remote.parse", fmt.Sprintf("Unable to parse %v", name), err)))
+		}
+		return
 	}
-	moduleOutput, err := r.root.e.runtime.RunProgram(code)
+	code, err := r.parseCode(name, target, content)
 	if err != nil {
-		panic(r.root.e.runtime.NewGoError(fmt.Errorf("Unable to load %v, cause %w", name, err)))
-	}
-	loader, ok := goja.AssertFunction(moduleOutput)
-	if !ok {
-		panic("This should never ever happen! There something really really wrong with jtb!!!")
+		panic(r.root.e.runtime.NewGoError(r.root.e.redact("remote.parse",
+			fmt.Sprintf("Unable to parse %v", name),
+			fmt.Errorf("Unable to parse %v, cause: %w", target, err))))
 	}
-	this := r.root.e.runtime.NewObject()
-	exports := r.root.e.runtime.NewObject()
-
 	sub := r.sub(target)
-
+	sub.importer = publicURL(target)
 	requireFn := r.root.e.runtime.ToValue(sub.javascriptRequire)
-
-	this.Set("require", requireFn)
-	this.Set("exports", exports)
-	_, err = loader(this, exports, requireFn)
-	if err != nil {
-		// err is a GoError
-		panic(err)
-	}
-	return &moduleDef{
-		exports: exports,
-	}
+	r.root.remoteCode = true
+	r.root.runModule(def, name, code, requireFn, publicURL(target), publicURL(sub.baseURL))
 }
 
-func (r *untrustedRemoteRequire) parseCode(name string, url *url.URL) (*goja.Program, error) {
-	bytes, err := r.downloadCode(url)
-	if err != nil {
-		return nil, err
-	}
-
-	safeCode := fmt.Sprintf(`(function(exports, require) {
-		Object.freeze(require);
-		(function(){
-			%v
-			;
-		}).apply(this);
-		Object.freeze(exports);
-	})`, string(bytes))
-
-	program, err := goja.Compile(name, safeCode, true)
-	if err != nil {
-		return nil, err
-	}
-	return program, nil
+func (r *untrustedRemoteRequire) parseCode(name string, url *url.URL, bytes []byte) (*goja.Program, error) {
+	// stack traces show the full URL, without credentials
+	return r.root.e.compileModule(url.String(), publicURL(url), path.Base(url.Path), bytes)
 }
 
+// downloadCode returns the content of origin, errors might contain
+// private information (eg.: credentials in the URL) and must be
+// redacted before reaching remote modules.
 func (r *untrustedRemoteRequire) downloadCode(origin *url.URL) ([]byte, error) {
 	if !r.sameOrigin(origin) {
 		return nil, errors.New("an untrusted remote require is trying to download code from a origin different from its own. A new require should have been created to do that!")
 	}
 	req, err := http.NewRequest("GET", origin.String(), nil)
 	if err != nil {
-		// TODO: rethink this, as it might leak private info to a module that we do not trust!
 		return nil, err
 	}
+	ev := modutils.NewAuditEvent(r.root.e.runtime, AuditNetwork)
+	ev.Details["method"] = req.Method
+	ev.Details["url"] = publicURL(origin)
 	res, err := r.httpClient.Do(req)
 	if err != nil {
-		// TODO: rethink this, as it might leak private info to a module that we do not trust!
+		ev.Details["error"] = err.Error()
+		r.root.e.emitAudit(ev)
 		return nil, err
 	}
 	defer res.Body.Close()
+	ev.Details["status"] = res.StatusCode
+	r.root.e.emitAudit(ev)
 
+	if res.StatusCode == http.StatusNotFound {
+		return nil, errRemoteNotFound
+	}
 	if res.StatusCode != http.StatusOK {
-		return nil, errors.New("unexpected status from remote endpoint, expecting 200")
+		return nil, fmt.Errorf("unexpected status %v from remote endpoint, expecting 200", res.StatusCode)
 	}
 	code, err := ioutil.ReadAll(res.Body)
 	if err != nil {
-		// TODO: rethink this, as it might leak private info to a module that we do not trust!
 		return nil, err
 	}
 	return code, nil
@@ -172,6 +219,14 @@ func computeOrigin(other *url.URL) *url.URL {
 	return u
 }
 
+// publicURL returns u without any user information,
+// so credentials are never exposed to remote modules
+func publicURL(u *url.URL) string {
+	public := *u
+	public.User = nil
+	return public.String()
+}
+
 func (r *untrustedRemoteRequire) sub(target *url.URL) *untrustedRemoteRequire {
 	base := *target
 	base.Path = path.Dir(base.Path)
@@ -180,6 +235,7 @@ func (r *untrustedRemoteRequire) sub(target *url.URL) *untrustedRemoteRequire {
 		origin:     r.origin,
 		httpClient: r.httpClient,
 		baseURL:    &base,
+		importer:   r.importer,
 	}
 }
 
@@ -196,5 +252,6 @@ func (r *untrustedRemoteRequire) newOrigin(otherOrigin *url.URL) *untrustedRemot
 		root:       r.root,
 		origin:     computeOrigin(otherOrigin),
 		httpClient: r.httpClient,
+		importer:   r.importer,
 	}
 }
@@ -0,0 +1,133 @@
+package engine
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"sync"
+
+	"github.com/andrebq/jtb/internal/modules/workers"
+	"github.com/dop251/goja"
+)
+
+type (
+	// worker wraps a child engine used by @workers
+	worker struct {
+		e *E
+	}
+
+	// syncWriter serializes writes from an engine and its workers
+	syncWriter struct {
+		mu *sync.Mutex
+		w  io.Writer
+	}
+
+	// ownedWriter is the syncWriter used by the engine that owns
+	// the stream, only the owner closes it
+	ownedWriter struct {
+		syncWriter
+	}
+)
+
+func (s syncWriter) Write(buf []byte) (int, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.w.Write(buf)
+}
+
+func (o ownedWriter) Close() error {
+	if c, ok := o.w.(io.Closer); ok {
+		return c.Close()
+	}
+	return nil
+}
+
+// lockOutput wraps w so that writes from e (eg.: console, @stdio)
+// and from its workers, which run in other goroutines, never interleave
+func (e *E) lockOutput(w io.Writer) io.Writer {
+	return ownedWriter{syncWriter{mu: &e.workerOutput, w: w}}
+}
+
+// sharedOutput returns w (one of the streams of e) for a worker,
+// using the lock of e but without the ability to close it
+func (e *E) sharedOutput(w io.Writer) io.Writer {
+	if o, ok := w.(ownedWriter); ok {
+		return o.syncWriter
+	}
+	return syncWriter{mu: &e.workerOutput, w: w}
+}
+
+// spawnWorker creates a new engine with the same anchor and
+// trust configuration as e.
+//
+// Only builtins defined by New are available to workers,
+// and workers cannot spawn other workers.
+func (e *E) spawnWorker() (workers.Worker, error) {
+	if e.isWorker {
+		return nil, errors.New("workers cannot start other workers")
+	}
+	child, err := New()
+	if err != nil {
+		return nil, err
+	}
+	child.isWorker = true
+	if err := child.AnchorModules(e.require.anchor); err != nil {
+		child.Close()
+		return nil, err
+	}
+	for name := range child.require.restricted {
+		if !e.require.isRestricted(name) {
+			child.Unrestrict(name)
+		}
+	}
+	if err := child.Grant(e.grants); err != nil {
+		child.Close()
+		return nil, err
+	}
+	child.useExecPolicy(e.execPolicy)
+	child.SetArgs(e.args)
+	child.AllowEnv(e.envAllow...)
+	if e.locked {
+		if err := child.Lockdown(); err != nil {
+			child.Close()
+			return nil, err
+		}
+	}
+	child.logger = e.logger
+	child.consoleLevel = e.consoleLevel
+	child.consoleToLogger = e.consoleToLogger
+	child.consolePlainText = e.consolePlainText
+	child.secrets = e.secrets
+	child.audit = e.sharedAudit()
+	child.UseProgramCache(e.programs)
+	child.ConnectStdio(noInput{}, e.sharedOutput(e.stdout), e.sharedOutput(e.stderr))
+	child.colors = e.colors
+	return &worker{e: child}, nil
+}
+
+func (w *worker) Call(module string, fn string, arg interface{}) (interface{}, error) {
+	rt := w.e.runtime
+	require, _ := goja.AssertFunction(rt.Get("require"))
+	exports, err := require(goja.Undefined(), rt.ToValue(module))
+	if err != nil {
+		return nil, err
+	}
+	callable, ok := goja.AssertFunction(exports.ToObject(rt).Get(fn))
+	if !ok {
+		return nil, fmt.Errorf("%v does not export a function called %v", module, fn)
+	}
+	res, err := callable(exports, workers.ToJS(rt, arg))
+	if err != nil {
+		w.e.loop.reset()
+		return nil, w.e.exitStatus(err)
+	}
+	res, err = w.e.loop.drain(res)
+	if err = w.e.exitStatus(err); err != nil {
+		return nil, err
+	}
+	return workers.Clone(res.Export())
+}
+
+func (w *worker) Close() error {
+	return w.e.Close()
+}
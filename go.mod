@@ -3,11 +3,14 @@ module github.com/andrebq/jtb
 go 1.16
 
 require (
-	github.com/dop251/goja v0.0.0-20210802212625-c04c64313062
+	github.com/dop251/goja v0.0.0-20240220182346-e401ed450204
+	github.com/evanw/esbuild v0.20.2
+	github.com/go-sourcemap/sourcemap v2.1.3+incompatible
 	github.com/google/uuid v1.3.0
 	github.com/maruel/fortuna v1.0.0
 	github.com/rs/zerolog v1.23.0
 	github.com/spf13/afero v1.6.0
+	golang.org/x/sys v0.0.0-20220722155257-8c9f86f7a55f
 	gopkg.in/yaml.v2 v2.4.0
 	gopkg.in/yaml.v3 v3.0.0-20210107192922-496545a6307b
 )
@@ -0,0 +1,39 @@
+package modutils
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// InAnchor resolves path relative to anchor, symlinks are followed
+// before checking that it is inside of it. Paths that do not exist are
+// accepted if their parent directory is inside the anchor.
+func InAnchor(anchor string, path string) (string, error) {
+	if anchor == "" {
+		return "", fmt.Errorf("%v cannot be used without an anchor", path)
+	}
+	if filepath.IsAbs(path) {
+		return "", fmt.Errorf("%v must be relative to the anchor", path)
+	}
+	full := filepath.Join(anchor, path)
+	realAnchor, err := filepath.EvalSymlinks(anchor)
+	if err != nil {
+		return "", err
+	}
+	real, err := filepath.EvalSymlinks(full)
+	if _, lerr := os.Lstat(full); os.IsNotExist(err) && os.IsNotExist(lerr) {
+		var parent string
+		parent, err = filepath.EvalSymlinks(filepath.Dir(full))
+		real = filepath.Join(parent, filepath.Base(full))
+	}
+	if err != nil {
+		return "", fmt.Errorf("%v cannot be used: %w", path, err)
+	}
+	rel, err := filepath.Rel(realAnchor, real)
+	if err != nil || rel == ".." || strings.HasPrefix(rel, ".."+string(filepath.Separator)) {
+		return "", fmt.Errorf("%v is outside of the anchor", path)
+	}
+	return full, nil
+}
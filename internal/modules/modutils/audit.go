@@ -0,0 +1,84 @@
+package modutils
+
+import (
+	"fmt"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/dop251/goja"
+)
+
+type (
+	// AuditKind identifies the type of sensitive operation in an AuditEvent
+	AuditKind string
+
+	// AuditEvent records a sensitive operation made by a script
+	AuditEvent struct {
+		Time time.Time `json:"time"`
+		Kind AuditKind `json:"kind"`
+		// Module that started the operation, empty if it was started by the engine
+		Module string `json:"module"`
+		// Details of the operation, depends on Kind
+		Details map[string]interface{} `json:"details"`
+		// CallStack at the moment the operation started
+		CallStack []string `json:"callStack"`
+	}
+
+	// Audit receives audit events, builtins must ignore it when nil
+	Audit func(AuditEvent)
+)
+
+const (
+	AuditRequire   = AuditKind("require")
+	AuditExec      = AuditKind("exec")
+	AuditFileWrite = AuditKind("file_write")
+	AuditNetwork   = AuditKind("network")
+	AuditSecret    = AuditKind("secret")
+)
+
+// NewAuditEvent returns an event with the calling module and
+// the current call stack of runtime
+func NewAuditEvent(runtime *goja.Runtime, kind AuditKind) AuditEvent {
+	return AuditEvent{
+		Time:      time.Now(),
+		Kind:      kind,
+		Module:    CallerModule(runtime),
+		Details:   map[string]interface{}{},
+		CallStack: CallStack(runtime),
+	}
+}
+
+// Emit sends ev to a if a is not nil
+func (a Audit) Emit(ev AuditEvent) {
+	if a == nil {
+		return
+	}
+	a(ev)
+}
+
+// CallStack returns one line for each frame of the current call stack
+func CallStack(runtime *goja.Runtime) []string {
+	var out []string
+	for _, v := range runtime.CaptureCallStack(-1, nil) {
+		out = append(out, fmt.Sprintf("%v @ %v from %v", v.FuncName(), v.Position(), v.SrcName()))
+	}
+	return out
+}
+
+// CallerModule returns the source of the innermost javascript frame that
+// belongs to a module (native frames and engine internals are ignored)
+func CallerModule(runtime *goja.Runtime) string {
+	for _, v := range runtime.CaptureCallStack(-1, nil) {
+		name := v.SrcName()
+		if name == "<native>" || strings.HasPrefix(name, "__goja__") || strings.HasPrefix(name, "__eval_") {
+			continue
+		}
+		if u, err := url.Parse(name); err == nil && u.User != nil {
+			u.User = nil
+			name = u.String()
+		}
+		return name
+	}
+	return ""
+}
@@ -0,0 +1,30 @@
+package modutils
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/dop251/goja"
+)
+
+// ParseDuration converts arg to a duration, arg can be either a duration
+// string (eg.: "1m30s") or a fractional number of seconds.
+//
+// It panics with a GoError if arg is not a valid duration.
+func ParseDuration(runtime *goja.Runtime, arg goja.Value) time.Duration {
+	val := arg.Export()
+	switch val := val.(type) {
+	case string:
+		dur, err := time.ParseDuration(val)
+		if err != nil {
+			panic(runtime.NewGoError(fmt.Errorf("%v is not a valid duration: %w", val, err)))
+		}
+		return dur
+	case int64:
+		return time.Second * time.Duration(val)
+	case float64:
+		return time.Duration(float64(time.Second) * val)
+	default:
+		panic(runtime.NewGoError(fmt.Errorf("a duration must be either: a duration string or a fractional number of seconds")))
+	}
+}
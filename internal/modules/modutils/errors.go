@@ -0,0 +1,38 @@
+package modutils
+
+import (
+	"errors"
+	"sort"
+
+	"github.com/dop251/goja"
+)
+
+type (
+	// ErrorProperties is implemented by errors that expose extra properties
+	// to javascript (eg.: name and code), so scripts can handle them without
+	// parsing messages
+	ErrorProperties interface {
+		error
+		Properties() map[string]interface{}
+	}
+)
+
+// NewGoError works like runtime.NewGoError but also defines the properties
+// of err (or the first error it wraps) implementing ErrorProperties
+func NewGoError(runtime *goja.Runtime, err error) *goja.Object {
+	obj := runtime.NewGoError(err)
+	var withProps ErrorProperties
+	if !errors.As(err, &withProps) {
+		return obj
+	}
+	props := withProps.Properties()
+	keys := make([]string, 0, len(props))
+	for k := range props {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	for _, k := range keys {
+		obj.Set(k, props[k])
+	}
+	return obj
+}
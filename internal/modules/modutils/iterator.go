@@ -0,0 +1,40 @@
+package modutils
+
+import "github.com/dop251/goja"
+
+// NewIterator returns a javascript iterator (that is also iterable, so it can
+// be used with for..of) calling next until it returns false.
+//
+// next is called from the runtime goroutine and can panic with
+// javascript errors.
+func NewIterator(runtime *goja.Runtime, next func() (goja.Value, bool)) *goja.Object {
+	obj := runtime.NewObject()
+	done := false
+	obj.Set("next", func(goja.FunctionCall) goja.Value {
+		res := runtime.NewObject()
+		var val goja.Value
+		if !done {
+			var ok bool
+			if val, ok = next(); !ok {
+				done = true
+			}
+		}
+		if done {
+			val = goja.Undefined()
+		}
+		res.Set("value", val)
+		res.Set("done", done)
+		return res
+	})
+	obj.Set("return", func(call goja.FunctionCall) goja.Value {
+		done = true
+		res := runtime.NewObject()
+		res.Set("value", call.Argument(0))
+		res.Set("done", true)
+		return res
+	})
+	obj.SetSymbol(goja.SymIterator, func(call goja.FunctionCall) goja.Value {
+		return call.This
+	})
+	return obj
+}
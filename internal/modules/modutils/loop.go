@@ -0,0 +1,27 @@
+package modutils
+
+import "github.com/dop251/goja"
+
+type (
+	// Settle is called from the runtime goroutine once the async work is done,
+	// the returned value resolves the promise, an error rejects it.
+	Settle func() (goja.Value, error)
+
+	// Loop allows modules to run blocking work outside of the runtime goroutine.
+	//
+	// goja.Runtime is not goroutine-safe, so work must never touch the runtime,
+	// anything that requires it (eg.: creating objects) should be done by Settle.
+	Loop interface {
+		// Async runs work in a new goroutine and returns a promise that is settled
+		// by the function returned from work.
+		Async(work func() Settle) goja.Value
+
+		// Scheduler returns a function that can be called from any goroutine
+		// to run fn in the runtime goroutine, it is used to report progress
+		// of work started with Async. Functions scheduled after the loop was
+		// reset are discarded.
+		//
+		// Scheduler must be called from the runtime goroutine.
+		Scheduler() func(fn func())
+	}
+)
@@ -0,0 +1,25 @@
+package modutils
+
+import "github.com/dop251/goja"
+
+type (
+	// Secrets reveals the values of the handles returned by @secrets.
+	//
+	// Only builtins that send values out of jtb (eg.: the environment of
+	// a process, HTTP headers) should reveal secrets, and they should
+	// never log the values they receive.
+	Secrets interface {
+		Reveal(v goja.Value) (string, bool)
+	}
+)
+
+// RevealString returns the value of v, if v is a secret handle and
+// secrets is not nil, or v converted to string.
+func RevealString(secrets Secrets, v goja.Value) string {
+	if secrets != nil {
+		if value, ok := secrets.Reveal(v); ok {
+			return value
+		}
+	}
+	return v.String()
+}
@@ -156,3 +156,12 @@ func ToYAMLStr(in interface{}) (string, error) {
 	}
 	return buf.String(), nil
 }
+
+// YamlDocToJSON converts a document decoded by yaml.v3 to a value that
+// can be encoded as JSON, using the same rules as YamlToJSON
+func YamlDocToJSON(doc interface{}) (interface{}, error) {
+	if doc == nil {
+		return struct{}{}, nil
+	}
+	return yamlToCompatibleJSON(doc)
+}
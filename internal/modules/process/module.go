@@ -0,0 +1,170 @@
+package process
+
+import (
+	"fmt"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+
+	"github.com/dop251/goja"
+	"github.com/rs/zerolog"
+)
+
+type (
+	// ExitError is returned to the Go caller when a script calls exit
+	ExitError struct {
+		Code int
+	}
+
+	// Module gives scripts their arguments, a filtered view of the environment,
+	// the working directory (relative to the anchor) and a way to exit.
+	Module struct {
+		// Args returns the arguments given to the script
+		Args func() []string
+
+		// Env returns the patterns (see path.Match) of the environment
+		// variables visible to scripts, nothing is visible by default
+		Env func() []string
+
+		// Anchor returns the directory used to compute cwd
+		Anchor func() string
+
+		// Logger receives the errors thrown by exit hooks
+		Logger func() zerolog.Logger
+
+		runtime *goja.Runtime
+		hooks   []goja.Callable
+		// hooksDone is set once the exit hooks ran, they never run twice
+		hooksDone bool
+		// exitCode is set by exit, until the engine sees it
+		exitCode *int
+	}
+)
+
+func (e *ExitError) Error() string {
+	return fmt.Sprintf("script exited with code %v", e.Code)
+}
+
+// DefineModule exposes argv, env, cwd, exit and onExit
+func (m *Module) DefineModule(exports *goja.Object, runtime *goja.Runtime) error {
+	m.runtime = runtime
+	argv := func(goja.FunctionCall) goja.Value {
+		var args []interface{}
+		if m.Args != nil {
+			for _, a := range m.Args() {
+				args = append(args, a)
+			}
+		}
+		return runtime.NewArray(args...)
+	}
+	env := func(goja.FunctionCall) goja.Value {
+		obj := runtime.NewObject()
+		for _, kv := range os.Environ() {
+			idx := strings.Index(kv, "=")
+			if idx <= 0 || !m.visible(kv[:idx]) {
+				continue
+			}
+			obj.Set(kv[:idx], kv[idx+1:])
+		}
+		return obj
+	}
+	for name, getter := range map[string]func(goja.FunctionCall) goja.Value{"argv": argv, "env": env} {
+		if err := exports.DefineAccessorProperty(name, runtime.ToValue(getter), nil, goja.FLAG_FALSE, goja.FLAG_TRUE); err != nil {
+			return err
+		}
+	}
+	exports.Set("cwd", m.cwd)
+	exports.Set("exit", m.exit)
+	exports.Set("onExit", func(call goja.FunctionCall) goja.Value {
+		fn, ok := goja.AssertFunction(call.Argument(0))
+		if !ok {
+			panic(runtime.NewTypeError("onExit expects a function"))
+		}
+		m.hooks = append(m.hooks, fn)
+		return goja.Undefined()
+	})
+	return nil
+}
+
+func (m *Module) visible(name string) bool {
+	if m.Env == nil {
+		return false
+	}
+	for _, pattern := range m.Env() {
+		if ok, _ := path.Match(pattern, name); ok {
+			return true
+		}
+	}
+	return false
+}
+
+// cwd returns the working directory of jtb relative to the anchor,
+// or null if it is outside of the anchor
+func (m *Module) cwd(call goja.FunctionCall) goja.Value {
+	wd, err := os.Getwd()
+	if err != nil {
+		panic(m.runtime.NewGoError(err))
+	}
+	anchor, err := filepath.EvalSymlinks(m.Anchor())
+	if err != nil {
+		panic(m.runtime.NewGoError(err))
+	}
+	if real, err := filepath.EvalSymlinks(wd); err == nil {
+		wd = real
+	}
+	rel, err := filepath.Rel(anchor, wd)
+	if err != nil || rel == ".." || strings.HasPrefix(rel, ".."+string(filepath.Separator)) {
+		return goja.Null()
+	}
+	return m.runtime.ToValue(filepath.ToSlash(rel))
+}
+
+// exit runs the exit hooks and interrupts the runtime, the code
+// is returned to the Go caller as an ExitError
+func (m *Module) exit(call goja.FunctionCall) goja.Value {
+	code := 0
+	if arg := call.Argument(0); !goja.IsUndefined(arg) {
+		code = int(arg.ToInteger())
+	}
+	if code < 0 || code > 255 {
+		panic(m.runtime.NewTypeError("exit code must be between 0 and 255"))
+	}
+	if m.exitCode == nil {
+		m.exitCode = &code
+		if err := m.RunExitHooks(code); err != nil && m.Logger != nil {
+			logger := m.Logger()
+			logger.Error().Err(err).Int("exitCode", code).Msg("Exit hook failed")
+		}
+	}
+	m.runtime.Interrupt(&ExitError{Code: *m.exitCode})
+	return goja.Undefined()
+}
+
+// RunExitHooks calls the functions registered with onExit, in order, with code.
+// Hooks run only once, either here or when the script calls exit. All hooks run
+// even if some of them fail, the first error is returned.
+func (m *Module) RunExitHooks(code int) error {
+	if m.hooksDone {
+		return nil
+	}
+	m.hooksDone = true
+	var first error
+	for _, fn := range m.hooks {
+		if _, err := fn(goja.Undefined(), m.runtime.ToValue(code)); err != nil && first == nil {
+			first = err
+		}
+	}
+	return first
+}
+
+// Exited returns the code given to exit, if the script called it since the last
+// call to Exited. The caller must clear the interrupt of the runtime.
+func (m *Module) Exited() (int, bool) {
+	if m.exitCode == nil {
+		return 0, false
+	}
+	code := *m.exitCode
+	m.exitCode = nil
+	return code, true
+}
@@ -0,0 +1,75 @@
+package rawexec
+
+import (
+	"errors"
+	"fmt"
+	"os/exec"
+	"syscall"
+)
+
+var (
+	errClosed = errors.New("the engine was closed")
+)
+
+type (
+	// StartError is returned when a process cannot be started, Code is
+	// the errno name of the cause (eg.: ENOENT if the binary was not found)
+	StartError struct {
+		Binary string
+		Code   string
+		Err    error
+	}
+)
+
+func newStartError(binary string, err error) StartError {
+	code := "EUNKNOWN"
+	var errno syscall.Errno
+	switch {
+	case errors.Is(err, exec.ErrNotFound):
+		code = "ENOENT"
+	case errors.Is(err, errClosed):
+		code = "ECLOSED"
+	case errors.As(err, &errno):
+		code = errnoName(errno)
+	}
+	return StartError{Binary: binary, Code: code, Err: err}
+}
+
+func (e StartError) Error() string {
+	return fmt.Sprintf("unable to start %v: %v", e.Binary, e.Err)
+}
+
+func (e StartError) Unwrap() error { return e.Err }
+
+// Properties implements modutils.ErrorProperties
+func (e StartError) Properties() map[string]interface{} {
+	return map[string]interface{}{
+		"name":   "ExecStartError",
+		"code":   e.Code,
+		"binary": e.Binary,
+	}
+}
+
+// errnoName returns the name of the most common errors
+// seen when starting a process
+func errnoName(errno syscall.Errno) string {
+	switch errno {
+	case syscall.ENOENT:
+		return "ENOENT"
+	case syscall.EACCES:
+		return "EACCES"
+	case syscall.EPERM:
+		return "EPERM"
+	case syscall.ENOEXEC:
+		return "ENOEXEC"
+	case syscall.ENOTDIR:
+		return "ENOTDIR"
+	case syscall.E2BIG:
+		return "E2BIG"
+	case syscall.ENOMEM:
+		return "ENOMEM"
+	case syscall.EAGAIN:
+		return "EAGAIN"
+	}
+	return "EUNKNOWN"
+}
@@ -0,0 +1,117 @@
+package rawexec
+
+import (
+	"fmt"
+	"math"
+	"os/exec"
+	"sync"
+	"time"
+
+	"github.com/andrebq/jtb/internal/modules/modutils"
+	"github.com/dop251/goja"
+)
+
+type (
+	// Limits are resource limits applied to a process, and inherited by its
+	// children. Zero values are not limited.
+	Limits struct {
+		// CPU time, rounded up to seconds (RLIMIT_CPU)
+		CPU time.Duration
+		// Memory is the maximum size of the address space in bytes (RLIMIT_AS)
+		Memory uint64
+		// Files is the maximum number of open files (RLIMIT_NOFILE)
+		Files uint64
+		// Processes is the maximum number of processes for the user running
+		// jtb, not only the ones started by the process (RLIMIT_NPROC)
+		Processes uint64
+	}
+
+	// processes started by the module that are still running,
+	// each one leads its own process group
+	processes struct {
+		mu      sync.Mutex
+		running map[*exec.Cmd]struct{}
+		closed  bool
+	}
+)
+
+func (l Limits) empty() bool {
+	return l == Limits{}
+}
+
+// parseLimits reads the limits option:
+//
+//	{ cpu: "10s", memory: 512 * 1024 * 1024, files: 256, processes: 64 }
+func parseLimits(runtime *goja.Runtime, val goja.Value) Limits {
+	var l Limits
+	obj := val.ToObject(runtime)
+	for _, key := range obj.Keys() {
+		v := obj.Get(key)
+		if key == "cpu" {
+			l.CPU = modutils.ParseDuration(runtime, v)
+			continue
+		}
+		n := v.ToFloat()
+		if n < 0 || math.IsNaN(n) || math.IsInf(n, 0) {
+			panic(runtime.NewGoError(fmt.Errorf("limit %v must be a positive number", key)))
+		}
+		switch key {
+		case "memory":
+			l.Memory = uint64(n)
+		case "files":
+			l.Files = uint64(n)
+		case "processes":
+			l.Processes = uint64(n)
+		default:
+			panic(runtime.NewGoError(fmt.Errorf("unknown limit %v, expecting cpu, memory, files or processes", key)))
+		}
+	}
+	return l
+}
+
+// start cmd in a new process group and apply limits to it
+//
+// The lock is not held while the process starts, if killAll is called in
+// the meantime the process is killed as soon as it is registered.
+func (p *processes) start(cmd *exec.Cmd, limits Limits) error {
+	p.mu.Lock()
+	closed := p.closed
+	p.mu.Unlock()
+	if closed {
+		return errClosed
+	}
+	newProcessGroup(cmd)
+	if err := startLimited(cmd, limits); err != nil {
+		return err
+	}
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.closed {
+		killProcessGroup(cmd)
+	}
+	if p.running == nil {
+		p.running = make(map[*exec.Cmd]struct{})
+	}
+	p.running[cmd] = struct{}{}
+	return nil
+}
+
+// wait for cmd to exit
+func (p *processes) wait(cmd *exec.Cmd) error {
+	err := cmd.Wait()
+	p.mu.Lock()
+	delete(p.running, cmd)
+	p.mu.Unlock()
+	return err
+}
+
+// kill the process groups of every running process, processes
+// cannot be started after this call
+func (p *processes) killAll() {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.closed = true
+	for cmd := range p.running {
+		killProcessGroup(cmd)
+	}
+}
@@ -0,0 +1,204 @@
+package rawexec
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"strings"
+	"syscall"
+	"time"
+
+	"golang.org/x/sys/unix"
+)
+
+const limitsSupported = true
+
+func newProcessGroup(cmd *exec.Cmd) {
+	if cmd.SysProcAttr == nil {
+		cmd.SysProcAttr = &syscall.SysProcAttr{}
+	}
+	cmd.SysProcAttr.Setpgid = true
+}
+
+// limitsHelperEnv is set when the binary is executed as the helper
+// that applies limits to itself before running the actual command, its
+// value has the status pipe and the limits as: fd,cpu,memory,files,processes
+const limitsHelperEnv = "JTB_RAWEXEC_LIMITS"
+
+// limitsHelper is true once LimitsHelper was called, so the binary
+// can be executed as the helper
+var limitsHelper bool
+
+// LimitsHelper must be called at the start of main by binaries that want
+// limits applied before the command runs.
+//
+// If the binary was executed as the helper, LimitsHelper applies the limits
+// and executes the command, it never returns. Otherwise it records that the
+// binary can be used as the helper, binaries that don't call it get the
+// limits applied with prlimit right after the process starts.
+func LimitsHelper() {
+	if spec, ok := os.LookupEnv(limitsHelperEnv); ok {
+		runLimitsHelper(spec)
+	}
+	limitsHelper = true
+}
+
+// startLimited starts cmd with the limits in l.
+//
+// os/exec cannot run code between fork and exec, so the binary starts
+// itself (see runLimitsHelper) to call setrlimit and then execute the
+// command, the command keeps the same pid and process group and no other
+// privilege is required. Errors from the helper are reported through
+// a pipe that is closed once the command is executed.
+//
+// If LimitsHelper wasn't called, the limits are set with prlimit right
+// after Start returns, which leaves a very small window where the process
+// runs without them.
+func startLimited(cmd *exec.Cmd, l Limits) error {
+	if l.empty() {
+		return cmd.Start()
+	}
+	if !limitsHelper {
+		if err := cmd.Start(); err != nil {
+			return err
+		}
+		if err := prlimit(cmd.Process.Pid, l); err != nil {
+			killProcessGroup(cmd)
+			cmd.Wait()
+			return fmt.Errorf("unable to apply limits: %w", err)
+		}
+		return nil
+	}
+	status, report, err := os.Pipe()
+	if err != nil {
+		return err
+	}
+	defer status.Close()
+
+	path, args, env := cmd.Path, cmd.Args, cmd.Env
+	if env == nil {
+		env = os.Environ()
+	}
+	cpu := uint64((l.CPU + time.Second - 1) / time.Second)
+	cmd.Path = "/proc/self/exe"
+	cmd.Args = append([]string{args[0], path}, args...)
+	fd := 3 + len(cmd.ExtraFiles)
+	cmd.Env = append(env[:len(env):len(env)], fmt.Sprintf("%v=%v,%v,%v,%v,%v", limitsHelperEnv, fd, cpu, l.Memory, l.Files, l.Processes))
+	cmd.ExtraFiles = append(cmd.ExtraFiles, report)
+	err = cmd.Start()
+	report.Close()
+	// Start copied everything it needed, the original values are
+	// restored for error messages and results
+	cmd.Path, cmd.Args, cmd.Env = path, args, env
+	cmd.ExtraFiles = cmd.ExtraFiles[:len(cmd.ExtraFiles)-1]
+	if err != nil {
+		return err
+	}
+	msg, _ := ioutil.ReadAll(status)
+	if len(msg) == 0 {
+		// the helper executed the command
+		return nil
+	}
+	cmd.Wait()
+	var op string
+	var errno int
+	if _, err := fmt.Sscanf(string(msg), "%s %d", &op, &errno); err != nil {
+		return fmt.Errorf("unable to apply limits: invalid helper status %q", msg)
+	}
+	if op == "exec" {
+		return &os.PathError{Op: "fork/exec", Path: path, Err: syscall.Errno(errno)}
+	}
+	return fmt.Errorf("unable to apply limits: %w", syscall.Errno(errno))
+}
+
+// prlimit sets the limits of the running process pid
+func prlimit(pid int, l Limits) error {
+	for _, r := range resourceLimits(l) {
+		if r.value == 0 {
+			continue
+		}
+		if err := unix.Prlimit(pid, r.resource, &unix.Rlimit{Cur: r.value, Max: r.value}, nil); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+type resourceLimit struct {
+	resource int
+	value    uint64
+}
+
+// resourceLimits returns the rlimits for l, processes is the last one
+// so the helper can still start threads while the other ones are applied
+func resourceLimits(l Limits) []resourceLimit {
+	return []resourceLimit{
+		{unix.RLIMIT_CPU, uint64((l.CPU + time.Second - 1) / time.Second)},
+		{unix.RLIMIT_AS, l.Memory},
+		{unix.RLIMIT_NOFILE, l.Files},
+		{unix.RLIMIT_NPROC, l.Processes},
+	}
+}
+
+// runLimitsHelper applies the limits in spec and executes the command
+// in os.Args[1], it never returns.
+func runLimitsHelper(spec string) {
+	var fd int
+	var cpu int64
+	var l Limits
+	_, specErr := fmt.Sscanf(spec, "%d,%d,%d,%d,%d", &fd, &cpu, &l.Memory, &l.Files, &l.Processes)
+	if specErr != nil {
+		fmt.Fprintf(os.Stderr, "jtb: invalid %v: %q\n", limitsHelperEnv, spec)
+		os.Exit(127)
+	}
+	status := os.NewFile(uintptr(fd), "status")
+	fail := func(op string, err error) {
+		errno, ok := err.(syscall.Errno)
+		if !ok {
+			errno = syscall.EINVAL
+		}
+		fmt.Fprintf(status, "%v %d", op, int(errno))
+		os.Exit(127)
+	}
+	if len(os.Args) < 3 {
+		fail("exec", syscall.EINVAL)
+	}
+	var env []string
+	for _, v := range os.Environ() {
+		if !strings.HasPrefix(v, limitsHelperEnv+"=") {
+			env = append(env, v)
+		}
+	}
+	syscall.CloseOnExec(fd)
+	l.CPU = time.Duration(cpu) * time.Second
+	for _, r := range resourceLimits(l) {
+		if r.value == 0 {
+			continue
+		}
+		if err := unix.Setrlimit(r.resource, &unix.Rlimit{Cur: r.value, Max: r.value}); err != nil {
+			fail("limits", err)
+		}
+	}
+	fail("exec", syscall.Exec(os.Args[1], os.Args[2:], env))
+}
+
+// signalName returns the name of the signal that killed
+// the process (eg.: SIGKILL), if any
+func signalName(state *os.ProcessState) string {
+	if state == nil {
+		return ""
+	}
+	if ws, ok := state.Sys().(syscall.WaitStatus); ok && ws.Signaled() {
+		return unix.SignalName(ws.Signal())
+	}
+	return ""
+}
+
+// killProcessGroup kills cmd and every process in its group
+func killProcessGroup(cmd *exec.Cmd) {
+	if cmd.Process == nil {
+		return
+	}
+	syscall.Kill(-cmd.Process.Pid, syscall.SIGKILL)
+}
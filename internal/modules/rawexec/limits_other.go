@@ -0,0 +1,45 @@
+//go:build !linux
+// +build !linux
+
+package rawexec
+
+import (
+	"os"
+	"os/exec"
+	"syscall"
+)
+
+const limitsSupported = false
+
+func newProcessGroup(cmd *exec.Cmd) {}
+
+// LimitsHelper does nothing, limits are only supported on Linux
+func LimitsHelper() {}
+
+func startLimited(cmd *exec.Cmd, l Limits) error {
+	return cmd.Start()
+}
+
+// signalName returns the description of the signal that killed
+// the process, if the platform supports signals
+func signalName(state *os.ProcessState) string {
+	if state == nil {
+		return ""
+	}
+	status, ok := state.Sys().(interface {
+		Signaled() bool
+		Signal() syscall.Signal
+	})
+	if ok && status.Signaled() {
+		return status.Signal().String()
+	}
+	return ""
+}
+
+// killProcessGroup kills cmd, process groups are only used on Linux
+func killProcessGroup(cmd *exec.Cmd) {
+	if cmd.Process == nil {
+		return
+	}
+	cmd.Process.Kill()
+}
@@ -2,9 +2,14 @@ package rawexec
 
 import (
 	"bytes"
+	"context"
+	"errors"
 	"fmt"
+	"io"
 	"os/exec"
 	"strconv"
+	"sync"
+	"time"
 
 	"github.com/andrebq/jtb/internal/modules/modutils"
 	"github.com/dop251/goja"
@@ -13,49 +18,374 @@ import (
 
 type (
 	Module struct {
-		Logger zerolog.Logger
+		// Logger returns the logger used to report failures,
+		// it is called every time a command runs
+		Logger func() zerolog.Logger
+		Loop   modutils.Loop
+
+		// Commands that can be called, if nil any command is allowed
+		Commands []string
+
+		// Policy limits which binaries (and arguments) can be executed,
+		// if nil any binary is allowed
+		Policy *Policy
+
+		// Audit receives an event for every command, including the ones
+		// that are not allowed
+		Audit modutils.Audit
+
+		// Anchor returns the directory used as the working directory of
+		// processes, the cwd option must be inside of it
+		Anchor func() string
+
+		// Stdout and Stderr receive the output of processes
+		// started with the forward option
+		Stdout func() io.Writer
+		Stderr func() io.Writer
+
+		// Secrets reveals the secret handles used as values of env
+		Secrets modutils.Secrets
+
+		procs processes
+	}
+
+	execution struct {
+		audit  modutils.AuditEvent
+		cmd    *exec.Cmd
+		stdout *output
+		stderr *output
+		err    error
+
+		ctx      context.Context
+		cancel   context.CancelFunc
+		timeout  time.Duration
+		duration time.Duration
+		limits   Limits
+		procs    *processes
+
+		// streaming is true if lines from stdout/stderr must be
+		// delivered to JS while the process runs
+		streaming bool
+		onStdout  goja.Callable
+		onStderr  goja.Callable
+		forward   bool
+
+		// callbackErr is the first error thrown by onStdout/onStderr,
+		// it kills the process
+		callbackErr error
 	}
 )
 
 func (m *Module) DefineModule(exports *goja.Object, runtime *goja.Runtime) error {
-	exports.Set("call_strict", m.callBinary(runtime, true, m.Logger.With().Str("method", "call_strict").Logger()))
-	exports.Set("call", m.callBinary(runtime, false, m.Logger.With().Str("method", "call").Logger()))
+	exports.Set("call_strict", m.callBinary(runtime, true, "call_strict"))
+	exports.Set("call", m.callBinary(runtime, false, "call"))
+	exports.Set("call_async", m.callBinaryAsync(runtime, false, "call_async"))
+	exports.Set("call_strict_async", m.callBinaryAsync(runtime, true, "call_strict_async"))
+	exports.Set("pipeline", m.callPipeline(runtime, false))
+	exports.Set("pipeline_strict", m.callPipeline(runtime, true))
+	exports.Set("pipeline_async", m.callPipelineAsync(runtime, false))
+	exports.Set("pipeline_strict_async", m.callPipelineAsync(runtime, true))
 	return nil
 }
 
-func (m *Module) callBinary(runtime *goja.Runtime, strict bool, logger zerolog.Logger) func(goja.FunctionCall) goja.Value {
+func (m *Module) logger(method string) zerolog.Logger {
+	if m.Logger == nil {
+		return zerolog.Nop()
+	}
+	return m.Logger().With().Str("method", method).Logger()
+}
+
+func (m *Module) callBinary(runtime *goja.Runtime, strict bool, method string) func(goja.FunctionCall) goja.Value {
 	return func(fc goja.FunctionCall) goja.Value {
-		cmd := exec.Command(fc.Argument(0).ToString().Export().(string))
-		if len(fc.Arguments) == 2 {
-			obj := fc.Arguments[1].ToObject(runtime)
-			if obj.Get("args") != nil {
-				args := obj.Get("args").ToObject(runtime)
-				for i := 0; i < int(args.Get("length").ToInteger()); i++ {
-					str := args.Get(strconv.Itoa(i)).ToString().Export().(string)
-					cmd.Args = append(cmd.Args, str)
+		ex := m.prepare(runtime, fc)
+		if ex.streaming {
+			// lines are delivered from the runtime goroutine while
+			// the process runs in another one
+			lines := make(chan func())
+			done := make(chan struct{})
+			m.stream(runtime, ex, func(fn func()) { lines <- fn })
+			go func() {
+				ex.run()
+				close(done)
+			}()
+		wait:
+			for {
+				select {
+				case fn := <-lines:
+					fn()
+				case <-done:
+					break wait
 				}
 			}
-			if obj.Get("input") != nil {
-				var buf []byte
-				runtime.ExportTo(obj.Get("input"), &buf)
-				cmd.Stdin = bytes.NewBuffer(buf)
-			} else {
-				cmd.Stdin = nil
+		} else {
+			ex.run()
+		}
+		m.auditExec(ex)
+		val, err := ex.result(runtime, strict, m.logger(method))
+		if err != nil {
+			panic(modutils.NewGoError(runtime, err))
+		}
+		return val
+	}
+}
+
+// callBinaryAsync works like callBinary but the process runs in a separated goroutine,
+// the returned promise is resolved once the process exits.
+func (m *Module) callBinaryAsync(runtime *goja.Runtime, strict bool, method string) func(goja.FunctionCall) goja.Value {
+	return func(fc goja.FunctionCall) goja.Value {
+		ex := m.prepare(runtime, fc)
+		if ex.streaming {
+			m.stream(runtime, ex, m.Loop.Scheduler())
+		}
+		logger := m.logger(method)
+		return m.Loop.Async(func() modutils.Settle {
+			ex.run()
+			return func() (goja.Value, error) {
+				m.auditExec(ex)
+				return ex.result(runtime, strict, logger)
 			}
+		})
+	}
+}
+
+// stream makes ex send every line written by the process to schedule,
+// which must run the given function from the runtime goroutine
+func (m *Module) stream(runtime *goja.Runtime, ex *execution, schedule func(fn func())) {
+	var stdout, stderr io.Writer
+	if ex.forward {
+		stdout, stderr = m.Stdout(), m.Stderr()
+	}
+	ex.stdout.emit = func(line []byte) {
+		schedule(func() { ex.deliver(runtime, line, ex.onStdout, stdout) })
+	}
+	ex.stderr.emit = func(line []byte) {
+		schedule(func() { ex.deliver(runtime, line, ex.onStderr, stderr) })
+	}
+}
+
+// Close kills every process (and its process group) that is still running,
+// no process can be started after Close. It is safe to call it from
+// any goroutine.
+func (m *Module) Close() error {
+	m.procs.killAll()
+	return nil
+}
+
+// Restrict the module to the given list of commands
+func (m *Module) Restrict(commands []string) error {
+	for _, c := range commands {
+		if c == "" {
+			return errors.New("command name cannot be empty")
+		}
+	}
+	m.Commands = append([]string{}, commands...)
+	return nil
+}
+
+func (m *Module) allowed(name string) bool {
+	if m.Commands == nil {
+		return true
+	}
+	for _, c := range m.Commands {
+		if c == name {
+			return true
+		}
+	}
+	return false
+}
+
+func (m *Module) prepare(runtime *goja.Runtime, fc goja.FunctionCall) *execution {
+	name := fc.Argument(0).ToString().Export().(string)
+	audit := modutils.NewAuditEvent(runtime, modutils.AuditExec)
+	opts := m.parseOptions(runtime, fc.Argument(1))
+	ex := &execution{
+		audit:     audit,
+		stdout:    &output{limit: opts.maxOutput},
+		stderr:    &output{limit: opts.maxOutput},
+		timeout:   opts.timeout,
+		limits:    opts.limits,
+		procs:     &m.procs,
+		onStdout:  opts.onStdout,
+		onStderr:  opts.onStderr,
+		forward:   opts.forward,
+		streaming: opts.onStdout != nil || opts.onStderr != nil || opts.forward,
+	}
+	ex.ctx, ex.cancel = withTimeout(opts.timeout)
+	defer func() {
+		if r := recover(); r != nil {
+			ex.cancel()
+			panic(r)
+		}
+	}()
+	ex.cmd = m.command(runtime, ex.ctx, audit, name, opts)
+	if opts.input != nil {
+		ex.cmd.Stdin = bytes.NewBuffer(opts.input)
+	}
+	return ex
+}
+
+// command returns the process that runs name with opts, commands that were not
+// granted or are denied by the policy are audited and thrown as RestrictedError.
+func (m *Module) command(runtime *goja.Runtime, ctx context.Context, audit modutils.AuditEvent, name string, opts options) *exec.Cmd {
+	deny := func(err RestrictedError) {
+		audit.Details["binary"] = name
+		audit.Details["denied"] = true
+		audit.Details["reason"] = err.Reason
+		m.Audit.Emit(audit)
+		panic(runtime.NewGoError(err))
+	}
+	if !m.allowed(name) {
+		deny(RestrictedError{Binary: name, Reason: "it was not granted to the script"})
+	}
+	path := name
+	if m.Policy != nil {
+		var err error
+		if path, err = m.Policy.check(name, opts.args); err != nil {
+			deny(err.(RestrictedError))
+		}
+	}
+	cmd := exec.CommandContext(ctx, path)
+	// keep the name used by the script as argv[0]
+	cmd.Args[0] = name
+	cmd.Args = append(cmd.Args, opts.args...)
+	cmd.Env = opts.env
+	cmd.Dir = opts.dir
+	return cmd
+}
+
+// withTimeout returns the context used to kill processes,
+// a zero timeout never expires
+func withTimeout(timeout time.Duration) (context.Context, context.CancelFunc) {
+	if timeout > 0 {
+		return context.WithTimeout(context.Background(), timeout)
+	}
+	return context.WithCancel(context.Background())
+}
+
+func (m *Module) auditExec(ex *execution) {
+	m.auditCommand(ex.audit, ex.cmd, ex.err, ex.timedOut())
+}
+
+func (m *Module) auditCommand(ev modutils.AuditEvent, cmd *exec.Cmd, err error, timedOut bool) {
+	ev.Details["binary"] = cmd.Path
+	ev.Details["args"] = cmd.Args
+	ev.Details["dir"] = cmd.Dir
+	ev.Details["exitCode"] = cmd.ProcessState.ExitCode()
+	if err != nil {
+		ev.Details["error"] = err.Error()
+	}
+	if timedOut {
+		ev.Details["timedOut"] = true
+	}
+	m.Audit.Emit(ev)
+}
+
+// run the process, it doesn't touch the runtime so it is
+// safe to call it from any goroutine.
+//
+// Output is read from pipes instead of letting exec.Cmd copy it, so
+// a timeout (or a failed callback) doesn't have to wait for children
+// of the process that still hold stdout/stderr open.
+func (ex *execution) run() {
+	defer ex.cancel()
+	stdout, err := ex.cmd.StdoutPipe()
+	if err != nil {
+		ex.err = newStartError(ex.cmd.Args[0], err)
+		return
+	}
+	stderr, err := ex.cmd.StderrPipe()
+	if err != nil {
+		ex.err = newStartError(ex.cmd.Args[0], err)
+		return
+	}
+	start := time.Now()
+	defer func() { ex.duration = time.Since(start) }()
+	if err := ex.procs.start(ex.cmd, ex.limits); err != nil {
+		ex.err = newStartError(ex.cmd.Args[0], err)
+		return
+	}
+	var wg sync.WaitGroup
+	copied := make(chan struct{})
+	for _, s := range []struct {
+		out *output
+		r   io.Reader
+	}{{ex.stdout, stdout}, {ex.stderr, stderr}} {
+		wg.Add(1)
+		go func(out *output, r io.Reader) {
+			defer wg.Done()
+			io.Copy(out, r)
+			out.flush()
+		}(s.out, s.r)
+	}
+	go func() {
+		wg.Wait()
+		close(copied)
+	}()
+	select {
+	case <-copied:
+	case <-ex.ctx.Done():
+		// Wait closes the pipes once the process is killed
+		killProcessGroup(ex.cmd)
+	}
+	ex.err = ex.procs.wait(ex.cmd)
+	<-copied
+}
+
+func (ex *execution) timedOut() bool {
+	return ex.ctx.Err() == context.DeadlineExceeded
+}
+
+// deliver sends a line of output to callback and w, it must be called
+// from the runtime goroutine
+func (ex *execution) deliver(runtime *goja.Runtime, line []byte, callback goja.Callable, w io.Writer) {
+	if ex.callbackErr != nil {
+		return
+	}
+	if w != nil {
+		w.Write(append(line, '\n'))
+	}
+	if callback == nil {
+		return
+	}
+	if _, err := callback(goja.Undefined(), runtime.ToValue(string(line))); err != nil {
+		ex.callbackErr = err
+		ex.cancel()
+	}
+}
+
+func (ex *execution) result(runtime *goja.Runtime, strict bool, logger zerolog.Logger) (goja.Value, error) {
+	cmd := ex.cmd
+	if ex.callbackErr != nil {
+		return nil, fmt.Errorf("output callback failed: %w", ex.callbackErr)
+	}
+	if ex.timedOut() && strict {
+		return nil, fmt.Errorf("Command timed out after %v", ex.timeout)
+	}
+	var startErr StartError
+	if errors.As(ex.err, &startErr) && strict {
+		return nil, startErr
+	}
+	if ex.err != nil && strict {
+		modutils.AppendCallStack(logger.Error().Err(ex.err), runtime).Strs("args", cmd.Args).Str("exec_path", cmd.Path).Int("pid", cmd.Process.Pid).Msg("Command failed with unexpected error")
+		if signal := signalName(cmd.ProcessState); signal != "" {
+			return nil, fmt.Errorf("Command killed by signal %v", signal)
 		}
-		stdout := &bytes.Buffer{}
-		stderr := &bytes.Buffer{}
-		cmd.Stdout = stdout
-		cmd.Stderr = stderr
-		err := cmd.Run()
-		if err != nil && strict {
-			modutils.AppendCallStack(logger.Error().Err(err), runtime).Strs("args", cmd.Args).Str("exec_path", cmd.Path).Interface("pid", cmd.ProcessState.Pid()).Msg("Command failed with unexpected error")
-			panic(runtime.NewGoError(fmt.Errorf("Command failed with status code %v", cmd.ProcessState.ExitCode())))
-		}
-		obj := runtime.NewObject()
-		obj.Set("exitCode", runtime.ToValue(cmd.ProcessState.ExitCode()))
-		obj.Set("stdout", runtime.ToValue(stdout.Bytes()))
-		obj.Set("stderr", runtime.ToValue(stderr.Bytes()))
-		return obj
+		return nil, fmt.Errorf("Command failed with status code %v", cmd.ProcessState.ExitCode())
+	}
+	obj := processResult(runtime, cmd, ex.err)
+	setOutput(runtime, obj, ex.stdout.buf.Bytes(), ex.stderr.buf.Bytes())
+	obj.Set("duration", durationMillis(ex.duration))
+	obj.Set("timedOut", runtime.ToValue(ex.timedOut()))
+	obj.Set("truncated", runtime.ToValue(ex.stdout.truncated || ex.stderr.truncated))
+	return obj, nil
+}
+
+// parseArgs converts a JS array to a list of strings
+func parseArgs(runtime *goja.Runtime, val goja.Value) []string {
+	var out []string
+	args := val.ToObject(runtime)
+	for i := 0; i < int(args.Get("length").ToInteger()); i++ {
+		out = append(out, args.Get(strconv.Itoa(i)).ToString().Export().(string))
 	}
+	return out
 }
@@ -0,0 +1,189 @@
+package rawexec
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	goruntime "runtime"
+	"strings"
+	"testing"
+
+	"github.com/andrebq/jtb/internal/modules/modutils"
+	"github.com/dop251/goja"
+)
+
+type (
+	// syncLoop runs async work right away, so tests don't need an event loop
+	syncLoop struct {
+		runtime *goja.Runtime
+	}
+)
+
+func (l syncLoop) Async(work func() modutils.Settle) goja.Value {
+	promise, resolve, reject := l.runtime.NewPromise()
+	val, err := work()()
+	if err != nil {
+		reject(modutils.NewGoError(l.runtime, err))
+	} else {
+		resolve(val)
+	}
+	return l.runtime.ToValue(promise)
+}
+
+func (l syncLoop) Scheduler() func(fn func()) {
+	return func(fn func()) { fn() }
+}
+
+func TestMain(m *testing.M) {
+	LimitsHelper()
+	os.Exit(m.Run())
+}
+
+func newRuntime(t *testing.T) *goja.Runtime {
+	t.Helper()
+	rt := goja.New()
+	m := &Module{Loop: syncLoop{runtime: rt}}
+	exports := rt.NewObject()
+	if err := m.DefineModule(exports, rt); err != nil {
+		t.Fatal(err)
+	}
+	rt.Set("exec", exports)
+	return rt
+}
+
+func run(t *testing.T, rt *goja.Runtime, code string) goja.Value {
+	t.Helper()
+	val, err := rt.RunString(code)
+	if err != nil {
+		t.Fatalf("%v: %v", code, err)
+	}
+	return val
+}
+
+func TestMissingBinary(t *testing.T) {
+	rt := newRuntime(t)
+	val := run(t, rt, `
+		const res = exec.call("jtb-binary-that-does-not-exist");
+		[res.exitCode, res.signal, res.startError.code].join(",")
+	`)
+	if val.String() != "-1,,ENOENT" {
+		t.Fatalf("Missing binaries should be reported in startError: %v", val)
+	}
+	for _, fn := range []string{"call_strict", "pipeline_strict"} {
+		call := `exec.call_strict("jtb-binary-that-does-not-exist")`
+		if fn == "pipeline_strict" {
+			call = `exec.pipeline_strict([{ command: "jtb-binary-that-does-not-exist" }])`
+		}
+		val = run(t, rt, `
+			var thrown;
+			try {
+				`+call+`;
+			} catch (e) {
+				thrown = [e.name, e.code, e.binary].join(",");
+			}
+			thrown
+		`)
+		if val.String() != "ExecStartError,ENOENT,jtb-binary-that-does-not-exist" {
+			t.Fatalf("%v should throw a typed error: %v", fn, val)
+		}
+	}
+	promise := run(t, rt, `exec.call_strict_async("jtb-binary-that-does-not-exist")`).Export().(*goja.Promise)
+	if promise.State() != goja.PromiseStateRejected || promise.Result().ToObject(rt).Get("code").String() != "ENOENT" {
+		t.Fatalf("Async calls should be rejected with a typed error: %v", promise.Result())
+	}
+}
+
+func TestPermissionDenied(t *testing.T) {
+	if goruntime.GOOS == "windows" {
+		t.Skip("executable bits are not used on windows")
+	}
+	file := filepath.Join(t.TempDir(), "script.sh")
+	if err := ioutil.WriteFile(file, []byte("#!/bin/sh\necho hello\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	rt := newRuntime(t)
+	rt.Set("file", file)
+	if val := run(t, rt, `exec.call(file).startError.code`); val.String() != "EACCES" {
+		t.Fatalf("Files without execute permissions should fail with EACCES: %v", val)
+	}
+	if !limitsSupported {
+		return
+	}
+	if val := run(t, rt, `exec.call(file, { limits: { files: 32 } }).startError.code`); val.String() != "EACCES" {
+		t.Fatalf("Errors from the limits helper should be reported as start errors: %v", val)
+	}
+	if val := run(t, rt, `exec.call("sh", { args: ["-c", "ulimit -n; echo $JTB_RAWEXEC_LIMITS"], limits: { files: 32 } }).stdout`); string(val.Export().([]byte)) != "32\n\n" {
+		t.Fatalf("Limits should be applied without leaking the helper environment: %q", val.Export())
+	}
+
+	// binaries that didn't call LimitsHelper use prlimit
+	limitsHelper = false
+	defer func() { limitsHelper = true }()
+	if val := run(t, rt, `exec.call(file, { limits: { files: 32 } }).startError.code`); val.String() != "EACCES" {
+		t.Fatalf("Start errors should be reported without the limits helper: %v", val)
+	}
+	if val := run(t, rt, `exec.call("sh", { args: ["-c", "sleep 0.1; ulimit -n"], limits: { files: 32 } }).stdout`); string(val.Export().([]byte)) != "32\n" {
+		t.Fatalf("Limits should be applied without the limits helper: %q", val.Export())
+	}
+}
+
+func TestResult(t *testing.T) {
+	if goruntime.GOOS == "windows" {
+		t.Skip("tests depend on sh")
+	}
+	rt := newRuntime(t)
+	val := run(t, rt, `
+		const res = exec.call("sh", { args: ["-c", "printf '{\"a\": [1, 2]}'"] });
+		[res.exitCode, res.signal, res.startError, res.stdoutText(), res.json().a[1], res.duration >= 0].join("|")
+	`)
+	if val.String() != `0|||{"a": [1, 2]}|2|true` {
+		t.Fatalf("Unexpected result: %v", val)
+	}
+	if val := run(t, rt, `exec.call("sh", { args: ["-c", "exit 3"] }).exitCode`); val.ToInteger() != 3 {
+		t.Fatalf("Exit code should be reported: %v", val)
+	}
+	if val := run(t, rt, `
+		let err;
+		try { exec.call("sh", { args: ["-c", "echo not json"] }).json(); } catch (e) { err = e.name; }
+		err
+	`); val.String() != "SyntaxError" {
+		t.Fatalf("json() should throw a SyntaxError for invalid output: %v", val)
+	}
+	if val := run(t, rt, `
+		let msg;
+		try { exec.call_strict("sh", { args: ["-c", "exit 3"] }); } catch (e) { msg = e.message; }
+		msg
+	`); val.String() != "Command failed with status code 3" {
+		t.Fatalf("Strict calls should fail with the exit code: %v", val)
+	}
+
+	val = run(t, rt, `
+		const killed = exec.call("sh", { args: ["-c", "kill -KILL $$"] });
+		[killed.exitCode, killed.signal].join(",")
+	`)
+	expected := "-1,SIGKILL"
+	if goruntime.GOOS != "linux" {
+		expected = "-1,killed"
+	}
+	if val.String() != expected {
+		t.Fatalf("Signals should be reported: %v", val)
+	}
+}
+
+func TestStreamingLimit(t *testing.T) {
+	var lines []string
+	out := &output{limit: 8, emit: func(line []byte) {
+		lines = append(lines, string(line))
+	}}
+	for i := 0; i < 1000; i++ {
+		out.Write([]byte("no new line "))
+	}
+	if len(out.partial) > out.limit {
+		t.Fatalf("Partial line should be cut at %v bytes, got %v", out.limit, len(out.partial))
+	}
+	out.Write([]byte(" end\nshort\r\nlast"))
+	out.flush()
+	if got := strings.Join(lines, "|"); got != "no new l|short|last" || !out.truncated {
+		t.Fatalf("Long lines should be truncated, got %q (truncated: %v)", got, out.truncated)
+	}
+}
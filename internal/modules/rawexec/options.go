@@ -0,0 +1,160 @@
+package rawexec
+
+import (
+	"fmt"
+	"os"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/andrebq/jtb/internal/modules/modutils"
+	"github.com/dop251/goja"
+)
+
+type (
+	// options accepted by every call function
+	options struct {
+		args  []string
+		input []byte
+
+		// env is never nil, so processes do not inherit the environment
+		// of jtb unless inheritEnv is used
+		env []string
+		dir string
+
+		timeout   time.Duration
+		maxOutput int
+		limits    Limits
+
+		onStdout goja.Callable
+		onStderr goja.Callable
+		forward  bool
+	}
+)
+
+func (m *Module) parseOptions(runtime *goja.Runtime, val goja.Value) options {
+	opts := options{env: []string{}}
+	var obj *goja.Object
+	if !goja.IsUndefined(val) && !goja.IsNull(val) {
+		obj = val.ToObject(runtime)
+	}
+	get := func(name string) goja.Value {
+		if obj == nil {
+			return nil
+		}
+		v := obj.Get(name)
+		if v == nil || goja.IsUndefined(v) || goja.IsNull(v) {
+			return nil
+		}
+		return v
+	}
+	if v := get("args"); v != nil {
+		opts.args = parseArgs(runtime, v)
+	}
+	if v := get("input"); v != nil {
+		runtime.ExportTo(v, &opts.input)
+	}
+	opts.env = parseEnv(runtime, m.Secrets, get("inheritEnv"), get("env"))
+	dir, err := m.workDir(get("cwd"))
+	if err != nil {
+		panic(runtime.NewGoError(err))
+	}
+	opts.dir = dir
+	if v := get("timeout"); v != nil {
+		opts.timeout = modutils.ParseDuration(runtime, v)
+	}
+	if v := get("maxOutput"); v != nil {
+		opts.maxOutput = int(v.ToInteger())
+		if opts.maxOutput < 0 {
+			panic(runtime.NewGoError(fmt.Errorf("maxOutput cannot be negative")))
+		}
+	}
+	for name, target := range map[string]*goja.Callable{"onStdout": &opts.onStdout, "onStderr": &opts.onStderr} {
+		if v := get(name); v != nil {
+			fn, ok := goja.AssertFunction(v)
+			if !ok {
+				panic(runtime.NewTypeError("%v must be a function", name))
+			}
+			*target = fn
+		}
+	}
+	if v := get("limits"); v != nil {
+		opts.limits = parseLimits(runtime, v)
+		if !opts.limits.empty() && !limitsSupported {
+			panic(runtime.NewGoError(fmt.Errorf("resource limits are only supported on Linux")))
+		}
+	}
+	if v := get("forward"); v != nil {
+		opts.forward = v.ToBoolean()
+	}
+	return opts
+}
+
+// parseEnv returns the environment of a process: the variables from the
+// current process listed in inherit (true inherits all of them) followed
+// by the ones in env, whose values can be secret handles.
+func parseEnv(runtime *goja.Runtime, secrets modutils.Secrets, inherit goja.Value, env goja.Value) []string {
+	vars := map[string]string{}
+	if inherit != nil {
+		if names, ok := inherit.Export().([]interface{}); ok {
+			for _, n := range names {
+				if v, ok := os.LookupEnv(fmt.Sprint(n)); ok {
+					vars[fmt.Sprint(n)] = v
+				}
+			}
+		} else if inherit.ToBoolean() {
+			for _, kv := range os.Environ() {
+				if idx := strings.Index(kv, "="); idx > 0 {
+					vars[kv[:idx]] = kv[idx+1:]
+				}
+			}
+		}
+	}
+	if env != nil {
+		obj := env.ToObject(runtime)
+		for _, k := range obj.Keys() {
+			if k == "" || strings.ContainsAny(k, "=\x00") {
+				panic(runtime.NewGoError(fmt.Errorf("invalid environment variable name %q", k)))
+			}
+			vars[k] = modutils.RevealString(secrets, obj.Get(k))
+		}
+	}
+	names := make([]string, 0, len(vars))
+	for k := range vars {
+		names = append(names, k)
+	}
+	sort.Strings(names)
+	out := make([]string, 0, len(names))
+	for _, k := range names {
+		out = append(out, k+"="+vars[k])
+	}
+	return out
+}
+
+// workDir resolves cwd relative to the anchor, without cwd
+// processes run in the anchor.
+func (m *Module) workDir(cwd goja.Value) (string, error) {
+	if cwd == nil {
+		return m.anchor(), nil
+	}
+	dir, err := m.inAnchor(cwd.String())
+	if err != nil {
+		return "", fmt.Errorf("cwd %w", err)
+	}
+	if stat, err := os.Stat(dir); err != nil || !stat.IsDir() {
+		return "", fmt.Errorf("cwd %v is not a directory", cwd.String())
+	}
+	return dir, nil
+}
+
+func (m *Module) anchor() string {
+	if m.Anchor == nil {
+		return ""
+	}
+	return m.Anchor()
+}
+
+// inAnchor resolves path relative to the anchor, see modutils.InAnchor
+func (m *Module) inAnchor(path string) (string, error) {
+	return modutils.InAnchor(m.anchor(), path)
+}
@@ -0,0 +1,66 @@
+package rawexec
+
+import "bytes"
+
+type (
+	// output buffers what a process writes, keeping at most limit bytes
+	// (if limit is positive), and sends every line to emit. Lines sent to
+	// emit are also cut at limit bytes, so a process that never writes a
+	// new line doesn't grow the partial line without bounds.
+	//
+	// exec.Cmd writes to stdout and stderr from different goroutines,
+	// so each stream needs its own output.
+	output struct {
+		buf       bytes.Buffer
+		limit     int
+		truncated bool
+
+		emit    func(line []byte)
+		partial []byte
+	}
+)
+
+func (o *output) Write(p []byte) (int, error) {
+	keep := p
+	if o.limit > 0 {
+		room := o.limit - o.buf.Len()
+		if room < 0 {
+			room = 0
+		}
+		if len(keep) > room {
+			keep = keep[:room]
+			o.truncated = true
+		}
+	}
+	o.buf.Write(keep)
+	if o.emit == nil {
+		return len(p), nil
+	}
+	for rest := p; len(rest) > 0; {
+		line := rest
+		idx := bytes.IndexByte(rest, '\n')
+		if idx >= 0 {
+			line = rest[:idx]
+		}
+		if o.limit > 0 && len(o.partial)+len(line) > o.limit {
+			line = line[:o.limit-len(o.partial)]
+			o.truncated = true
+		}
+		o.partial = append(o.partial, line...)
+		if idx < 0 {
+			break
+		}
+		o.emit(bytes.TrimSuffix(o.partial, []byte("\r")))
+		o.partial = nil
+		rest = rest[idx+1:]
+	}
+	return len(p), nil
+}
+
+// flush sends the last line, if the process didn't end it with a new line
+func (o *output) flush() {
+	if o.emit != nil && len(o.partial) > 0 {
+		o.emit(append([]byte(nil), o.partial...))
+	}
+	o.partial = nil
+}
@@ -0,0 +1,334 @@
+package rawexec
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/andrebq/jtb/internal/modules/modutils"
+	"github.com/dop251/goja"
+)
+
+type (
+	// pipeline connects the stdout of each stage to the stdin of the next
+	// one using os pipes, processes run concurrently and no shell is involved
+	pipeline struct {
+		stages []*stage
+
+		ctx      context.Context
+		cancel   context.CancelFunc
+		timeout  time.Duration
+		duration time.Duration
+
+		// input (or the file stdin) is sent to the first stage
+		input []byte
+		stdin string
+
+		// stdout receives the output of the last stage, unless it is
+		// redirected to stdoutFile
+		stdout       *output
+		stdoutFile   string
+		appendStdout bool
+
+		// err is set if the pipeline could not be started at all
+		err error
+
+		procs *processes
+	}
+
+	stage struct {
+		audit  modutils.AuditEvent
+		cmd    *exec.Cmd
+		limits Limits
+		stderr *output
+		err    error
+	}
+)
+
+func (m *Module) callPipeline(runtime *goja.Runtime, strict bool) func(goja.FunctionCall) goja.Value {
+	return func(fc goja.FunctionCall) goja.Value {
+		p := m.preparePipeline(runtime, fc)
+		p.run()
+		m.auditPipeline(p)
+		val, err := p.result(runtime, strict)
+		if err != nil {
+			panic(modutils.NewGoError(runtime, err))
+		}
+		return val
+	}
+}
+
+// callPipelineAsync works like callPipeline but returns a promise
+// resolved once every stage exits
+func (m *Module) callPipelineAsync(runtime *goja.Runtime, strict bool) func(goja.FunctionCall) goja.Value {
+	return func(fc goja.FunctionCall) goja.Value {
+		p := m.preparePipeline(runtime, fc)
+		return m.Loop.Async(func() modutils.Settle {
+			p.run()
+			return func() (goja.Value, error) {
+				m.auditPipeline(p)
+				return p.result(runtime, strict)
+			}
+		})
+	}
+}
+
+func (m *Module) preparePipeline(runtime *goja.Runtime, fc goja.FunctionCall) (p *pipeline) {
+	if goja.IsUndefined(fc.Argument(0)) || goja.IsNull(fc.Argument(0)) {
+		panic(runtime.NewTypeError("pipeline expects a list of commands"))
+	}
+	stages := fc.Argument(0).ToObject(runtime)
+	length := int(stages.Get("length").ToInteger())
+	if length == 0 {
+		panic(runtime.NewTypeError("pipeline expects a list of commands"))
+	}
+	opts := m.parseOptions(runtime, fc.Argument(1))
+	if opts.onStdout != nil || opts.onStderr != nil || opts.forward {
+		panic(runtime.NewTypeError("pipelines do not support onStdout, onStderr or forward"))
+	}
+	p = &pipeline{
+		timeout: opts.timeout,
+		input:   opts.input,
+		stdout:  &output{limit: opts.maxOutput},
+		procs:   &m.procs,
+	}
+	p.ctx, p.cancel = withTimeout(opts.timeout)
+	defer func() {
+		if r := recover(); r != nil {
+			p.cancel()
+			panic(r)
+		}
+	}()
+	m.parseRedirects(runtime, p, fc.Argument(1))
+	for i := 0; i < length; i++ {
+		obj := stages.Get(strconv.Itoa(i)).ToObject(runtime)
+		name := obj.Get("command")
+		if name == nil || goja.IsUndefined(name) || goja.IsNull(name) {
+			panic(runtime.NewTypeError("stage %v of the pipeline must have a command", i+1))
+		}
+		st := &stage{
+			audit:  modutils.NewAuditEvent(runtime, modutils.AuditExec),
+			stderr: &output{limit: opts.maxOutput},
+		}
+		st.audit.Details["stage"] = i + 1
+		stageOpts := m.parseOptions(runtime, obj)
+		st.limits = stageOpts.limits
+		if st.limits.empty() {
+			st.limits = opts.limits
+		}
+		st.cmd = m.command(runtime, p.ctx, st.audit, name.String(), stageOpts)
+		p.stages = append(p.stages, st)
+	}
+	if p.stdoutFile != "" {
+		ev := modutils.NewAuditEvent(runtime, modutils.AuditFileWrite)
+		ev.Details["path"] = p.stdoutFile
+		ev.Details["append"] = p.appendStdout
+		ev.Details["binary"] = p.stages[len(p.stages)-1].cmd.Args[0]
+		m.Audit.Emit(ev)
+	}
+	return p
+}
+
+// parseRedirects reads the files used as the stdin of the first stage
+// and the stdout of the last one, both must be inside the anchor
+func (m *Module) parseRedirects(runtime *goja.Runtime, p *pipeline, val goja.Value) {
+	if goja.IsUndefined(val) || goja.IsNull(val) {
+		return
+	}
+	obj := val.ToObject(runtime)
+	path := func(name string) string {
+		v := obj.Get(name)
+		if v == nil || goja.IsUndefined(v) || goja.IsNull(v) {
+			return ""
+		}
+		resolved, err := m.inAnchor(v.String())
+		if err != nil {
+			panic(runtime.NewGoError(fmt.Errorf("%v %w", name, err)))
+		}
+		return resolved
+	}
+	p.stdin = path("stdin")
+	if p.stdin != "" && p.input != nil {
+		panic(runtime.NewTypeError("input and stdin cannot be used together"))
+	}
+	p.stdoutFile = path("stdout")
+	if v := obj.Get("append"); v != nil {
+		p.appendStdout = v.ToBoolean()
+	}
+}
+
+// run every stage, it doesn't touch the runtime so it is
+// safe to call it from any goroutine.
+func (p *pipeline) run() {
+	defer p.cancel()
+	// files are inherited by the processes, the copies
+	// from jtb are closed once all of them started
+	var files []*os.File
+	closeFiles := func() {
+		for _, f := range files {
+			f.Close()
+		}
+		files = nil
+	}
+	defer closeFiles()
+
+	first, last := p.stages[0].cmd, p.stages[len(p.stages)-1].cmd
+	switch {
+	case p.stdin != "":
+		f, err := os.Open(p.stdin)
+		if err != nil {
+			p.err = err
+			return
+		}
+		files = append(files, f)
+		first.Stdin = f
+	case p.input != nil:
+		first.Stdin = bytes.NewReader(p.input)
+	}
+	for i := 0; i < len(p.stages)-1; i++ {
+		r, w, err := os.Pipe()
+		if err != nil {
+			p.err = err
+			return
+		}
+		files = append(files, r, w)
+		p.stages[i].cmd.Stdout = w
+		p.stages[i+1].cmd.Stdin = r
+	}
+
+	type stream struct {
+		out *output
+		r   io.Reader
+	}
+	var streams []stream
+	if p.stdoutFile != "" {
+		flags := os.O_CREATE | os.O_WRONLY | os.O_TRUNC
+		if p.appendStdout {
+			flags = os.O_CREATE | os.O_WRONLY | os.O_APPEND
+		}
+		f, err := os.OpenFile(p.stdoutFile, flags, 0644)
+		if err != nil {
+			p.err = err
+			return
+		}
+		files = append(files, f)
+		last.Stdout = f
+	} else {
+		r, err := last.StdoutPipe()
+		if err != nil {
+			p.err = err
+			return
+		}
+		streams = append(streams, stream{p.stdout, r})
+	}
+	for _, st := range p.stages {
+		r, err := st.cmd.StderrPipe()
+		if err != nil {
+			p.err = err
+			return
+		}
+		streams = append(streams, stream{st.stderr, r})
+	}
+
+	var started []*stage
+	start := time.Now()
+	defer func() { p.duration = time.Since(start) }()
+	for _, st := range p.stages {
+		// once a stage fails, the context is cancelled and the remaining
+		// ones fail without starting (closing their pipes)
+		if err := p.procs.start(st.cmd, st.limits); err != nil {
+			st.err = newStartError(st.cmd.Args[0], err)
+			p.cancel()
+			continue
+		}
+		started = append(started, st)
+	}
+	closeFiles()
+
+	var wg sync.WaitGroup
+	copied := make(chan struct{})
+	for _, s := range streams {
+		wg.Add(1)
+		go func(s stream) {
+			defer wg.Done()
+			io.Copy(s.out, s.r)
+		}(s)
+	}
+	go func() {
+		wg.Wait()
+		close(copied)
+	}()
+	select {
+	case <-copied:
+	case <-p.ctx.Done():
+		for _, st := range started {
+			killProcessGroup(st.cmd)
+		}
+	}
+	for _, st := range started {
+		st.err = p.procs.wait(st.cmd)
+	}
+	<-copied
+}
+
+func (p *pipeline) timedOut() bool {
+	return p.ctx.Err() == context.DeadlineExceeded
+}
+
+func (m *Module) auditPipeline(p *pipeline) {
+	if p.err != nil {
+		return
+	}
+	for _, st := range p.stages {
+		m.auditCommand(st.audit, st.cmd, st.err, p.timedOut())
+	}
+}
+
+func (p *pipeline) result(runtime *goja.Runtime, strict bool) (goja.Value, error) {
+	if p.err != nil {
+		return nil, fmt.Errorf("unable to start pipeline: %w", p.err)
+	}
+	if p.timedOut() && strict {
+		return nil, fmt.Errorf("Pipeline timed out after %v", p.timeout)
+	}
+	var stderr bytes.Buffer
+	stages := runtime.NewArray()
+	truncated := p.stdout.truncated
+	for i, st := range p.stages {
+		if strict && st.err != nil {
+			var startErr StartError
+			if errors.As(st.err, &startErr) {
+				return nil, startErr
+			}
+			if signal := signalName(st.cmd.ProcessState); signal != "" {
+				return nil, fmt.Errorf("Pipeline stage %v (%v) killed by signal %v", i+1, st.cmd.Args[0], signal)
+			}
+			var exitErr *exec.ExitError
+			if errors.As(st.err, &exitErr) {
+				return nil, fmt.Errorf("Pipeline stage %v (%v) failed with status code %v", i+1, st.cmd.Args[0], exitErr.ExitCode())
+			}
+			return nil, fmt.Errorf("Pipeline stage %v (%v) failed: %w", i+1, st.cmd.Args[0], st.err)
+		}
+		stderr.Write(st.stderr.buf.Bytes())
+		truncated = truncated || st.stderr.truncated
+		obj := processResult(runtime, st.cmd, st.err)
+		obj.Set("command", st.cmd.Args[0])
+		obj.Set("stderr", runtime.ToValue(st.stderr.buf.Bytes()))
+		stages.Set(strconv.Itoa(i), obj)
+	}
+	last := p.stages[len(p.stages)-1]
+	obj := processResult(runtime, last.cmd, last.err)
+	setOutput(runtime, obj, p.stdout.buf.Bytes(), stderr.Bytes())
+	obj.Set("duration", durationMillis(p.duration))
+	obj.Set("stages", stages)
+	obj.Set("timedOut", runtime.ToValue(p.timedOut()))
+	obj.Set("truncated", runtime.ToValue(truncated))
+	return obj, nil
+}
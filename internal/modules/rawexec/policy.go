@@ -0,0 +1,135 @@
+package rawexec
+
+import (
+	"fmt"
+	"os/exec"
+	"path/filepath"
+	"regexp"
+	"strings"
+
+	"gopkg.in/yaml.v3"
+)
+
+type (
+	// Rule allows a binary to be executed
+	Rule struct {
+		// Binary is the name (searched in PATH) or path of the executable
+		Binary string `yaml:"binary" json:"binary"`
+
+		// Args are patterns (regular expressions matching the whole argument)
+		// for the first arguments, eg.: ["get|apply|diff"] only allows
+		// kubectl get, apply or diff. Arguments after the last pattern
+		// are not checked.
+		Args []string `yaml:"args,omitempty" json:"args,omitempty"`
+
+		// Forbidden flags cannot appear anywhere in the arguments,
+		// either alone (--flag value) or with a value (--flag=value)
+		Forbidden []string `yaml:"forbidden,omitempty" json:"forbidden,omitempty"`
+	}
+
+	// Policy contains the binaries that processes can execute, they are
+	// resolved to absolute paths when the policy is created, so changes to
+	// PATH made later do not change which files are executed.
+	Policy struct {
+		rules map[string]*compiledRule
+	}
+
+	compiledRule struct {
+		Rule
+		path string
+		args []*regexp.Regexp
+	}
+
+	// RestrictedError is returned when a command is not allowed
+	// by the scope or policy of the module
+	RestrictedError struct {
+		Binary string
+		Reason string
+	}
+)
+
+func (r RestrictedError) Error() string {
+	return fmt.Sprintf("command %v is not allowed: %v", r.Binary, r.Reason)
+}
+
+// ParsePolicy reads a list of rules from a YAML document
+//
+//   - binary: kubectl
+//     args: ["get|apply|diff"]
+//     forbidden: [--kubeconfig, --token]
+//   - binary: /usr/bin/helm
+func ParsePolicy(content []byte) ([]Rule, error) {
+	var rules []Rule
+	if err := yaml.Unmarshal(content, &rules); err != nil {
+		return nil, err
+	}
+	return rules, nil
+}
+
+// NewPolicy resolves the binaries of every rule and compiles their patterns
+func NewPolicy(rules []Rule) (*Policy, error) {
+	p := &Policy{rules: map[string]*compiledRule{}}
+	for _, r := range rules {
+		path, err := resolveBinary(r.Binary)
+		if err != nil {
+			return nil, fmt.Errorf("binary %v cannot be resolved: %w", r.Binary, err)
+		}
+		if _, ok := p.rules[path]; ok {
+			return nil, fmt.Errorf("binary %v (%v) is listed more than once", r.Binary, path)
+		}
+		cr := &compiledRule{Rule: r, path: path}
+		for _, pattern := range r.Args {
+			re, err := regexp.Compile("^(?:" + pattern + ")$")
+			if err != nil {
+				return nil, fmt.Errorf("invalid argument pattern %q for %v: %w", pattern, r.Binary, err)
+			}
+			cr.args = append(cr.args, re)
+		}
+		for _, flag := range r.Forbidden {
+			if !strings.HasPrefix(flag, "-") {
+				return nil, fmt.Errorf("forbidden flag %q for %v must start with -", flag, r.Binary)
+			}
+		}
+		p.rules[path] = cr
+	}
+	return p, nil
+}
+
+// check returns the absolute path of the binary that must be executed
+// or a RestrictedError if name cannot be called with args
+func (p *Policy) check(name string, args []string) (string, error) {
+	path, err := resolveBinary(name)
+	if err != nil {
+		return "", RestrictedError{Binary: name, Reason: "binary not found"}
+	}
+	rule := p.rules[path]
+	if rule == nil {
+		return "", RestrictedError{Binary: name, Reason: fmt.Sprintf("%v is not in the allowlist", path)}
+	}
+	for i, re := range rule.args {
+		if i >= len(args) {
+			return "", RestrictedError{Binary: name, Reason: fmt.Sprintf("argument %v is required and must match %v", i+1, rule.Args[i])}
+		}
+		if !re.MatchString(args[i]) {
+			return "", RestrictedError{Binary: name, Reason: fmt.Sprintf("argument %v (%v) does not match %v", i+1, args[i], rule.Args[i])}
+		}
+	}
+	for _, arg := range args {
+		for _, flag := range rule.Forbidden {
+			if arg == flag || strings.HasPrefix(arg, flag+"=") {
+				return "", RestrictedError{Binary: name, Reason: fmt.Sprintf("flag %v is forbidden", flag)}
+			}
+		}
+	}
+	return rule.path, nil
+}
+
+// resolveBinary returns the absolute path of name, symlinks are kept
+// as multi-call binaries (eg.: busybox) behave differently for each of them
+func resolveBinary(name string) (string, error) {
+	path, err := exec.LookPath(name)
+	if err != nil {
+		return "", err
+	}
+	return filepath.Abs(path)
+}
@@ -0,0 +1,63 @@
+package rawexec
+
+import (
+	"errors"
+	"os/exec"
+	"time"
+
+	"github.com/dop251/goja"
+)
+
+// processResult returns an object with the exit code of cmd, the signal
+// that killed it and the error that prevented it from starting (or null).
+//
+// exitCode is -1 if the process did not start or was killed by a signal.
+func processResult(runtime *goja.Runtime, cmd *exec.Cmd, err error) *goja.Object {
+	obj := runtime.NewObject()
+	obj.Set("exitCode", cmd.ProcessState.ExitCode())
+	if signal := signalName(cmd.ProcessState); signal != "" {
+		obj.Set("signal", signal)
+	} else {
+		obj.Set("signal", goja.Null())
+	}
+	var startErr StartError
+	if errors.As(err, &startErr) {
+		desc := runtime.NewObject()
+		desc.Set("code", startErr.Code)
+		desc.Set("message", startErr.Error())
+		obj.Set("startError", desc)
+	} else {
+		obj.Set("startError", goja.Null())
+	}
+	return obj
+}
+
+// setOutput defines stdout/stderr (as bytes) in obj, and the functions
+// used to decode them: stdoutText, stderrText and json (which parses stdout)
+func setOutput(runtime *goja.Runtime, obj *goja.Object, stdout, stderr []byte) {
+	obj.Set("stdout", runtime.ToValue(stdout))
+	obj.Set("stderr", runtime.ToValue(stderr))
+	obj.Set("stdoutText", func(goja.FunctionCall) goja.Value {
+		return runtime.ToValue(string(stdout))
+	})
+	obj.Set("stderrText", func(goja.FunctionCall) goja.Value {
+		return runtime.ToValue(string(stderr))
+	})
+	obj.Set("json", func(goja.FunctionCall) goja.Value {
+		parse, ok := goja.AssertFunction(runtime.Get("JSON").ToObject(runtime).Get("parse"))
+		if !ok {
+			panic(runtime.NewTypeError("JSON.parse is not a function"))
+		}
+		val, err := parse(goja.Undefined(), runtime.ToValue(string(stdout)))
+		if err != nil {
+			panic(err)
+		}
+		return val
+	})
+}
+
+// durationMillis converts d to fractional milliseconds,
+// like the values returned by Date.now()
+func durationMillis(d time.Duration) float64 {
+	return float64(d) / float64(time.Millisecond)
+}
@@ -15,94 +15,230 @@ import (
 
 type (
 	Module struct {
-		Logger zerolog.Logger
+		// Logger returns the logger used to report failures
+		Logger func() zerolog.Logger
+		Loop   modutils.Loop
+
+		// Audit receives an event for every request
+		Audit modutils.Audit
+
+		// Secrets reveals the secret handles used as header values
+		Secrets modutils.Secrets
+
+		// Client used to send requests, http.DefaultClient if nil
+		Client *http.Client
+	}
+
+	// request is prepared in the runtime goroutine and
+	// sent by do, which does not touch the runtime
+	request struct {
+		req   *http.Request
+		audit modutils.AuditEvent
+		log   zerolog.Logger
+
+		resp *http.Response
+		body []byte
+		err  error
+		// failure describes the step that failed
+		failure string
 	}
 )
 
-// DefineModule populates exports with all functions exposed by this package
-func (m *Module) DefineModule(exports *goja.Object, runtime *goja.Runtime, logger zerolog.Logger) error {
-	exports.Set("getJSON", m.getJSON(runtime, logger.With().Str("function", "getJSON").Logger()))
-	exports.Set("doHTTP", m.doHTTP(runtime, logger.With().Str("function", "doHTTP").Logger()))
+var (
+	errFetch = errors.New("Unable to fetch resources from HTTP endpoint. Check logs for more information")
+)
+
+// DefineModule populates exports with all functions exposed by this package,
+// the _async variants return promises and do not block the event loop
+func (m *Module) DefineModule(exports *goja.Object, runtime *goja.Runtime) error {
+	exports.Set("getJSON", m.sync(runtime, "getJSON", m.prepareGetJSON, m.decodeJSON))
+	exports.Set("doHTTP", m.sync(runtime, "doHTTP", m.prepareDoHTTP, m.response))
+	exports.Set("getJSON_async", m.async(runtime, "getJSON_async", m.prepareGetJSON, m.decodeJSON))
+	exports.Set("doHTTP_async", m.async(runtime, "doHTTP_async", m.prepareDoHTTP, m.response))
 	return nil
 }
 
-func (m *Module) getJSON(runtime *goja.Runtime, log zerolog.Logger) func(goja.FunctionCall) goja.Value {
+type (
+	prepareFn func(*goja.Runtime, goja.FunctionCall, zerolog.Logger) *request
+	resultFn  func(*goja.Runtime, *request) goja.Value
+)
+
+func (m *Module) sync(runtime *goja.Runtime, method string, prepare prepareFn, result resultFn) func(goja.FunctionCall) goja.Value {
 	return func(fc goja.FunctionCall) goja.Value {
-		target := fc.Arguments[0].Export().(string)
-		resp, err := http.Get(target)
-		if err != nil {
-			entry := log.Error().Err(err).Str("target", target)
-			modutils.AppendCallStack(entry, runtime).Msgf("Unable to call HTTP GET %v", target)
-			panic(runtime.NewGoError(errors.New("Unable to fetch resources from HTTP endpoint. Check logs for more information")))
-		}
-		defer resp.Body.Close()
-		var out interface{}
-		err = json.NewDecoder(resp.Body).Decode(&out)
-		if err != nil {
-			entry := log.Error().Err(err).Str("target", target)
-			modutils.AppendCallStack(entry, runtime).Msgf("Unable to decode response from HTTP GET %v", target)
-			panic(runtime.NewGoError(errors.New("Unable to fetch resources from HTTP endpoint. Check logs for more information")))
-		}
-		return runtime.ToValue(out)
+		r := prepare(runtime, fc, m.logger(method))
+		r.do(m.client())
+		m.audit(r)
+		return result(runtime, r)
 	}
 }
 
-func (m *Module) doHTTP(runtime *goja.Runtime, log zerolog.Logger) func(goja.FunctionCall) goja.Value {
+func (m *Module) async(runtime *goja.Runtime, method string, prepare prepareFn, result resultFn) func(goja.FunctionCall) goja.Value {
 	return func(fc goja.FunctionCall) goja.Value {
-		target := fc.Arguments[0].Export().(string)
-		opts := struct {
-			Headers   map[string][]string
-			BodyStr   string
-			Method    string
-			BodyBytes *goja.ArrayBuffer
-		}{}
-		if len(fc.Arguments) > 0 {
-			runtime.ExportTo(fc.Argument(1), &opts)
-		}
+		r := prepare(runtime, fc, m.logger(method))
+		client := m.client()
+		return m.Loop.Async(func() modutils.Settle {
+			r.do(client)
+			return func() (val goja.Value, err error) {
+				m.audit(r)
+				if ex := runtime.Try(func() { val = result(runtime, r) }); ex != nil {
+					return nil, ex
+				}
+				return val, nil
+			}
+		})
+	}
+}
 
-		var buf io.Reader
-		if len(opts.BodyStr) > 0 {
-			buf = bytes.NewBufferString(opts.BodyStr)
-		} else if opts.BodyBytes != nil && len(opts.BodyBytes.Bytes()) > 0 {
-			buf = bytes.NewBuffer(append([]byte(nil), opts.BodyBytes.Bytes()...))
-		}
+func (m *Module) logger(method string) zerolog.Logger {
+	if m.Logger == nil {
+		return zerolog.Nop()
+	}
+	return m.Logger().With().Str("function", method).Logger()
+}
 
-		if opts.Method == "" {
-			opts.Method = "GET"
-		}
+func (m *Module) client() *http.Client {
+	if m.Client != nil {
+		return m.Client
+	}
+	return http.DefaultClient
+}
+
+func (m *Module) prepareGetJSON(runtime *goja.Runtime, fc goja.FunctionCall, log zerolog.Logger) *request {
+	return newRequest(runtime, log, "GET", fc.Argument(0).String(), nil, nil)
+}
+
+func (m *Module) prepareDoHTTP(runtime *goja.Runtime, fc goja.FunctionCall, log zerolog.Logger) *request {
+	target := fc.Argument(0).String()
+	opts := struct {
+		BodyStr   string
+		Method    string
+		BodyBytes *goja.ArrayBuffer
+	}{}
+	if len(fc.Arguments) > 1 {
+		runtime.ExportTo(fc.Argument(1), &opts)
+	}
+
+	var buf io.Reader
+	if len(opts.BodyStr) > 0 {
+		buf = bytes.NewBufferString(opts.BodyStr)
+	} else if opts.BodyBytes != nil && len(opts.BodyBytes.Bytes()) > 0 {
+		buf = bytes.NewBuffer(append([]byte(nil), opts.BodyBytes.Bytes()...))
+	}
+
+	if opts.Method == "" {
+		opts.Method = "GET"
+	}
+	return newRequest(runtime, log, opts.Method, target, buf, m.headers(runtime, fc.Argument(1)))
+}
 
-		req, err := http.NewRequest(opts.Method, target, buf)
-		if err != nil {
-			entry := log.Error().Err(err).Str("target", target).Str("method", opts.Method)
-			modutils.AppendCallStack(entry, runtime).Msgf("Unable to prepare request object HTTP %v %v", opts.Method, target)
-			panic(runtime.NewGoError(errors.New("Unable to fetch resources from HTTP endpoint. Check logs for more information")))
+func newRequest(runtime *goja.Runtime, log zerolog.Logger, method, target string, body io.Reader, headers map[string][]string) *request {
+	audit := modutils.NewAuditEvent(runtime, modutils.AuditNetwork)
+	req, err := http.NewRequest(method, target, body)
+	if err != nil {
+		entry := log.Error().Err(err).Str("target", target).Str("method", method)
+		modutils.AppendCallStack(entry, runtime).Msgf("Unable to prepare request object HTTP %v %v", method, target)
+		panic(runtime.NewGoError(errFetch))
+	}
+	for k, valueList := range headers {
+		for _, v := range valueList {
+			req.Header.Add(k, v)
 		}
-		if len(opts.Headers) > 0 {
-			for k, valueList := range opts.Headers {
-				for _, v := range valueList {
-					req.Header.Add(k, v)
+	}
+	return &request{req: req, audit: audit, log: log}
+}
+
+// do sends the request and reads the whole response,
+// it is safe to call it outside of the runtime goroutine
+func (r *request) do(client *http.Client) {
+	r.resp, r.err = client.Do(r.req)
+	if r.err != nil {
+		r.failure = "Unable to perform request"
+		return
+	}
+	defer r.resp.Body.Close()
+	r.body, r.err = ioutil.ReadAll(r.resp.Body)
+	if r.err != nil {
+		r.failure = "Unable to read body from"
+	}
+}
+
+func (m *Module) audit(r *request) {
+	u := *r.req.URL
+	u.User = nil
+	r.audit.Details["method"] = r.req.Method
+	r.audit.Details["url"] = u.String()
+	if r.err != nil {
+		r.audit.Details["error"] = r.err.Error()
+	} else {
+		r.audit.Details["status"] = r.resp.StatusCode
+	}
+	m.Audit.Emit(r.audit)
+}
+
+// fail logs the error of r and throws a generic error
+func (r *request) fail(runtime *goja.Runtime, failure string, err error) {
+	entry := r.log.Error().Err(err).Str("target", r.req.URL.String()).Str("method", r.req.Method)
+	modutils.AppendCallStack(entry, runtime).Msgf("%v HTTP %v %v", failure, r.req.Method, r.req.URL)
+	panic(runtime.NewGoError(errFetch))
+}
+
+func (m *Module) decodeJSON(runtime *goja.Runtime, r *request) goja.Value {
+	if r.err != nil {
+		r.fail(runtime, r.failure, r.err)
+	}
+	var out interface{}
+	if err := json.Unmarshal(r.body, &out); err != nil {
+		r.fail(runtime, "Unable to decode response from", err)
+	}
+	return runtime.ToValue(out)
+}
+
+func (m *Module) response(runtime *goja.Runtime, r *request) goja.Value {
+	if r.err != nil {
+		r.fail(runtime, r.failure, r.err)
+	}
+	obj := runtime.NewObject()
+	obj.Set("statusCode", r.resp.StatusCode)
+	obj.Set("status", r.resp.Status)
+	obj.Set("headers", runtime.ToValue(r.resp.Header))
+	obj.Set("bytes", runtime.ToValue(r.body))
+	return obj
+}
+
+// headers returns the Headers option of doHTTP, values are strings,
+// secret handles or lists of them
+func (m *Module) headers(runtime *goja.Runtime, opts goja.Value) map[string][]string {
+	out := map[string][]string{}
+	if goja.IsUndefined(opts) || goja.IsNull(opts) {
+		return out
+	}
+	headers := opts.ToObject(runtime).Get("Headers")
+	if headers == nil || goja.IsUndefined(headers) || goja.IsNull(headers) {
+		return out
+	}
+	obj := headers.ToObject(runtime)
+	for _, k := range obj.Keys() {
+		v := obj.Get(k)
+		if _, isSecret := m.reveal(v); !isSecret {
+			if list, ok := v.(*goja.Object); ok && list.ClassName() == "Array" {
+				for _, idx := range list.Keys() {
+					value, _ := m.reveal(list.Get(idx))
+					out[k] = append(out[k], value)
 				}
+				continue
 			}
 		}
+		value, _ := m.reveal(v)
+		out[k] = append(out[k], value)
+	}
+	return out
+}
 
-		resp, err := http.DefaultClient.Do(req)
-		if err != nil {
-			entry := log.Error().Err(err).Str("target", target).Str("method", opts.Method)
-			modutils.AppendCallStack(entry, runtime).Msgf("Unable to perform request HTTP %v %v", opts.Method, target)
-			panic(runtime.NewGoError(errors.New("Unable to fetch resources from HTTP endpoint. Check logs for more information")))
-		}
-		defer resp.Body.Close()
-		bodyBytes, err := ioutil.ReadAll(resp.Body)
-		if err != nil {
-			entry := log.Error().Err(err).Str("target", target).Str("method", opts.Method)
-			modutils.AppendCallStack(entry, runtime).Msgf("Unable to read body from HTTP %v %v", opts.Method, target)
-			panic(runtime.NewGoError(errors.New("Unable to fetch resources from HTTP endpoint. Check logs for more information")))
+func (m *Module) reveal(v goja.Value) (string, bool) {
+	if m.Secrets != nil {
+		if value, ok := m.Secrets.Reveal(v); ok {
+			return value, true
 		}
-		obj := runtime.NewObject()
-		obj.Set("statusCode", resp.StatusCode)
-		obj.Set("status", resp.Status)
-		obj.Set("headers", runtime.ToValue(resp.Header))
-		obj.Set("bytes", runtime.ToValue(bodyBytes))
-		return obj
 	}
+	return v.String(), false
 }
@@ -0,0 +1,134 @@
+package secrets
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+
+	"github.com/andrebq/jtb/internal/modules/modutils"
+	"github.com/dop251/goja"
+)
+
+type (
+	// Module loads secrets from the environment or from files inside the anchor,
+	// scripts only get opaque handles, their values are revealed to builtins
+	// through Reveal
+	Module struct {
+		// Store receives the value of every secret loaded by the module
+		Store func() *Store
+
+		// Anchor returns the directory that contains secret files
+		Anchor func() string
+
+		// Audit receives an event every time a secret is loaded
+		Audit modutils.Audit
+
+		// scopes are patterns of the env vars and files that can be loaded,
+		// if nil anything can be loaded
+		scopes []string
+
+		handles map[*goja.Object]string
+	}
+)
+
+// DefineModule exposes env and file, which return secret handles
+func (m *Module) DefineModule(exports *goja.Object, runtime *goja.Runtime) error {
+	exports.Set("env", func(call goja.FunctionCall) goja.Value {
+		name := call.Argument(0).String()
+		m.checkScope(runtime, name)
+		value, ok := os.LookupEnv(name)
+		if !ok {
+			panic(runtime.NewGoError(fmt.Errorf("environment variable %v is not set", name)))
+		}
+		return m.handle(runtime, "env", name, value)
+	})
+	exports.Set("file", func(call goja.FunctionCall) goja.Value {
+		name := filepath.ToSlash(filepath.Clean(call.Argument(0).String()))
+		m.checkScope(runtime, name)
+		full, err := modutils.InAnchor(m.Anchor(), name)
+		if err != nil {
+			panic(runtime.NewGoError(err))
+		}
+		content, err := ioutil.ReadFile(full)
+		if err != nil {
+			panic(runtime.NewGoError(fmt.Errorf("unable to read secret %v: %w", name, err)))
+		}
+		value := strings.TrimSuffix(strings.TrimSuffix(string(content), "\n"), "\r")
+		return m.handle(runtime, "file", name, value)
+	})
+	exports.Set("isSecret", func(call goja.FunctionCall) goja.Value {
+		_, ok := m.Reveal(call.Argument(0))
+		return runtime.ToValue(ok)
+	})
+	return nil
+}
+
+// Restrict the env vars and files that scripts can load to the ones
+// matching the given patterns (see path.Match)
+func (m *Module) Restrict(scopes []string) error {
+	for _, s := range scopes {
+		if _, err := path.Match(s, ""); err != nil || s == "" {
+			return fmt.Errorf("invalid secret pattern %q", s)
+		}
+	}
+	m.scopes = append([]string{}, scopes...)
+	return nil
+}
+
+func (m *Module) checkScope(runtime *goja.Runtime, name string) {
+	if name == "" {
+		panic(runtime.NewTypeError("secret name cannot be empty"))
+	}
+	if m.scopes == nil {
+		return
+	}
+	for _, s := range m.scopes {
+		if ok, _ := path.Match(s, name); ok {
+			return
+		}
+	}
+	panic(runtime.NewGoError(fmt.Errorf("secret %v is not allowed", name)))
+}
+
+// handle registers value and returns an opaque object that represents it,
+// the value is kept outside of the object, so printing or serializing the
+// handle never shows it
+func (m *Module) handle(runtime *goja.Runtime, source, name, value string) goja.Value {
+	if m.Store != nil {
+		m.Store().Add(value)
+	}
+	ev := modutils.NewAuditEvent(runtime, modutils.AuditSecret)
+	ev.Details["source"] = source
+	ev.Details["name"] = name
+	m.Audit.Emit(ev)
+
+	obj := runtime.NewObject()
+	label := fmt.Sprintf("[secret %v]", name)
+	describe := func(goja.FunctionCall) goja.Value { return runtime.ToValue(label) }
+	obj.Set("name", name)
+	obj.Set("source", source)
+	for _, k := range []string{"toString", "toJSON"} {
+		obj.DefineDataProperty(k, runtime.ToValue(describe), goja.FLAG_FALSE, goja.FLAG_FALSE, goja.FLAG_FALSE)
+	}
+	if err := obj.SetSymbol(goja.SymToPrimitive, describe); err != nil {
+		panic(runtime.NewGoError(err))
+	}
+	if m.handles == nil {
+		m.handles = map[*goja.Object]string{}
+	}
+	m.handles[obj] = value
+	return obj
+}
+
+// Reveal returns the value of a secret handle
+func (m *Module) Reveal(v goja.Value) (string, bool) {
+	obj, ok := v.(*goja.Object)
+	if !ok || m.handles == nil {
+		return "", false
+	}
+	value, ok := m.handles[obj]
+	return value, ok
+}
@@ -0,0 +1,93 @@
+package secrets
+
+import (
+	"encoding/json"
+	"io"
+	"sort"
+	"strings"
+	"sync"
+)
+
+const (
+	// Redacted replaces the values of secrets
+	Redacted = "[REDACTED]"
+
+	// minLength of the values that are redacted, shorter values
+	// would replace unrelated text all over the output
+	minLength = 4
+)
+
+type (
+	// Store keeps the values of every secret loaded by an engine (and its
+	// workers), so they can be removed from anything written by jtb.
+	Store struct {
+		mu     sync.RWMutex
+		values []string
+	}
+
+	redactWriter struct {
+		store *Store
+		w     io.Writer
+	}
+)
+
+// Add value to the list of redacted values, the JSON encoded form
+// of the value is also redacted
+func (s *Store) Add(value string) {
+	if len(value) < minLength {
+		return
+	}
+	forms := []string{value}
+	if enc, err := json.Marshal(value); err == nil {
+		if quoted := string(enc[1 : len(enc)-1]); quoted != value {
+			forms = append(forms, quoted)
+		}
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for _, f := range forms {
+		if !s.contains(f) {
+			s.values = append(s.values, f)
+		}
+	}
+	// longer values first, so a secret that contains
+	// another one is fully redacted
+	sort.SliceStable(s.values, func(i, j int) bool { return len(s.values[i]) > len(s.values[j]) })
+}
+
+func (s *Store) contains(value string) bool {
+	for _, v := range s.values {
+		if v == value {
+			return true
+		}
+	}
+	return false
+}
+
+// Redact returns text with the value of every secret replaced by Redacted
+func (s *Store) Redact(text string) string {
+	if s == nil {
+		return text
+	}
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	for _, v := range s.values {
+		text = strings.Replace(text, v, Redacted, -1)
+	}
+	return text
+}
+
+// Writer returns a writer that redacts every call to Write before sending it to w.
+//
+// Secrets split across two calls to Write are not redacted, which is fine
+// for writers that receive whole entries (eg.: zerolog loggers).
+func (s *Store) Writer(w io.Writer) io.Writer {
+	return redactWriter{store: s, w: w}
+}
+
+func (r redactWriter) Write(p []byte) (int, error) {
+	if _, err := io.WriteString(r.w, r.store.Redact(string(p))); err != nil {
+		return 0, err
+	}
+	return len(p), nil
+}
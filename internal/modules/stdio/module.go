@@ -1,6 +1,7 @@
 package stdio
 
 import (
+	"bufio"
 	"fmt"
 	"io"
 
@@ -12,6 +13,14 @@ type (
 		Stdout func() io.Writer
 		Stderr func() io.Writer
 		Stdin  func() io.Reader
+
+		// Colors returns true if the output written to stdout
+		// (or stderr) should be colored, eg.: because it is a terminal
+		Colors func(stderr bool) bool
+
+		// in buffers src, which is the last reader returned by Stdin
+		src io.Reader
+		in  *bufio.Reader
 	}
 )
 
@@ -21,6 +30,9 @@ func (m *Module) DefineModule(exports *goja.Object, runtime *goja.Runtime) error
 
 	exports.Set("eprint", m.printIO(runtime, " ", false, true))
 	exports.Set("eprintln", m.printIO(runtime, " ", false, true))
+
+	m.defineReaders(exports, runtime)
+	m.defineWriters(exports, runtime)
 	return nil
 }
 
@@ -0,0 +1,286 @@
+package stdio
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"reflect"
+	"strings"
+
+	"github.com/andrebq/jtb/internal/modules/modutils"
+	"github.com/dop251/goja"
+	"gopkg.in/yaml.v3"
+)
+
+type (
+	// jsonReader decodes one value at a time from a stream of JSON values,
+	// if path is not nil it returns the elements of the array found at path
+	// (a list of object keys) of every value instead
+	jsonReader struct {
+		dec  *json.Decoder
+		path []string
+
+		// depth is the number of objects entered to reach the array
+		depth   int
+		inArray bool
+	}
+)
+
+func (m *Module) defineReaders(exports *goja.Object, runtime *goja.Runtime) {
+	exports.Set("readAll", func(goja.FunctionCall) goja.Value {
+		content, err := ioutil.ReadAll(m.input())
+		if err != nil {
+			panic(runtime.NewGoError(err))
+		}
+		return runtime.ToValue(string(content))
+	})
+	exports.Set("readLine", func(goja.FunctionCall) goja.Value {
+		line, ok := m.readLine(runtime)
+		if !ok {
+			return goja.Null()
+		}
+		return runtime.ToValue(line)
+	})
+	exports.Set("lines", func(goja.FunctionCall) goja.Value {
+		return modutils.NewIterator(runtime, func() (goja.Value, bool) {
+			line, ok := m.readLine(runtime)
+			return runtime.ToValue(line), ok
+		})
+	})
+	exports.Set("readJSON", func(call goja.FunctionCall) goja.Value {
+		r := &jsonReader{dec: json.NewDecoder(m.input())}
+		if opts := call.Argument(0); !goja.IsUndefined(opts) && !goja.IsNull(opts) {
+			if path := opts.ToObject(runtime).Get("path"); path != nil && !goja.IsUndefined(path) {
+				if err := runtime.ExportTo(path, &r.path); err != nil {
+					panic(runtime.NewTypeError("path must be a list of keys: %v", err))
+				}
+				if r.path == nil {
+					r.path = []string{}
+				}
+			}
+		}
+		return modutils.NewIterator(runtime, func() (goja.Value, bool) {
+			raw, ok, err := r.next()
+			if err != nil {
+				panic(runtime.NewGoError(fmt.Errorf("invalid JSON input: %w", err)))
+			}
+			if !ok {
+				return nil, false
+			}
+			return parseJSON(runtime, raw), true
+		})
+	})
+	exports.Set("readNDJSON", func(goja.FunctionCall) goja.Value {
+		lineNo := 0
+		return modutils.NewIterator(runtime, func() (goja.Value, bool) {
+			for {
+				line, ok := m.readLine(runtime)
+				if !ok {
+					return nil, false
+				}
+				lineNo++
+				line = string(bytes.TrimSpace([]byte(line)))
+				if line == "" {
+					continue
+				}
+				if !json.Valid([]byte(line)) {
+					panic(runtime.NewGoError(fmt.Errorf("invalid JSON at line %v", lineNo)))
+				}
+				return parseJSON(runtime, []byte(line)), true
+			}
+		})
+	})
+	exports.Set("readYAML", func(goja.FunctionCall) goja.Value {
+		dec := yaml.NewDecoder(m.input())
+		return modutils.NewIterator(runtime, func() (goja.Value, bool) {
+			var doc interface{}
+			err := dec.Decode(&doc)
+			if errors.Is(err, io.EOF) {
+				return nil, false
+			} else if err != nil {
+				panic(runtime.NewGoError(fmt.Errorf("invalid YAML input: %w", err)))
+			}
+			doc, err = modutils.YamlDocToJSON(doc)
+			if err != nil {
+				panic(runtime.NewGoError(err))
+			}
+			raw, err := json.Marshal(doc)
+			if err != nil {
+				panic(runtime.NewGoError(err))
+			}
+			return parseJSON(runtime, raw), true
+		})
+	})
+}
+
+// input returns a buffered reader for stdin, it is shared by all read
+// functions so nothing read ahead by one of them is lost
+func (m *Module) input() *bufio.Reader {
+	src := m.Stdin()
+	if m.in == nil || !sameReader(src, m.src) {
+		m.src = src
+		m.in = bufio.NewReader(src)
+	}
+	return m.in
+}
+
+// sameReader returns true if a and b are the same reader,
+// readers that cannot be compared are never the same
+func sameReader(a, b io.Reader) bool {
+	if a == nil || b == nil || reflect.TypeOf(a) != reflect.TypeOf(b) || !reflect.TypeOf(a).Comparable() {
+		return false
+	}
+	return a == b
+}
+
+// readLine returns the next line without the line terminator,
+// ok is false at the end of the input
+func (m *Module) readLine(runtime *goja.Runtime) (string, bool) {
+	line, err := m.input().ReadString('\n')
+	if err != nil && !errors.Is(err, io.EOF) {
+		panic(runtime.NewGoError(err))
+	}
+	if line == "" && err != nil {
+		return "", false
+	}
+	line = line[:len(line)-len(trailingNewLine(line))]
+	return line, true
+}
+
+func trailingNewLine(line string) string {
+	switch {
+	case len(line) >= 2 && line[len(line)-2:] == "\r\n":
+		return "\r\n"
+	case len(line) >= 1 && line[len(line)-1] == '\n':
+		return "\n"
+	}
+	return ""
+}
+
+// parseJSON converts raw into a javascript value, using JSON.parse
+// so scripts get plain objects and arrays
+func parseJSON(runtime *goja.Runtime, raw []byte) goja.Value {
+	parse, ok := goja.AssertFunction(runtime.Get("JSON").ToObject(runtime).Get("parse"))
+	if !ok {
+		panic(runtime.NewTypeError("JSON.parse is not a function"))
+	}
+	val, err := parse(goja.Undefined(), runtime.ToValue(string(raw)))
+	if err != nil {
+		panic(err)
+	}
+	return val
+}
+
+// next returns the next value (or array element) from the stream
+func (r *jsonReader) next() (json.RawMessage, bool, error) {
+	for {
+		if r.path == nil || r.inArray {
+			if r.path == nil || r.dec.More() {
+				var raw json.RawMessage
+				err := r.dec.Decode(&raw)
+				if r.path == nil && errors.Is(err, io.EOF) {
+					return nil, false, nil
+				}
+				return raw, err == nil, err
+			}
+			// end of the array
+			if _, err := r.dec.Token(); err != nil {
+				return nil, false, err
+			}
+			r.inArray = false
+			if err := r.leave(r.depth); err != nil {
+				return nil, false, err
+			}
+			continue
+		}
+		found, err := r.enter()
+		if errors.Is(err, io.EOF) && r.depth == 0 {
+			return nil, false, nil
+		} else if err != nil {
+			return nil, false, err
+		}
+		r.inArray = found
+	}
+}
+
+// enter reads the next top-level value until the start of the array at path,
+// if the path does not exist the whole value is consumed and found is false
+func (r *jsonReader) enter() (found bool, err error) {
+	r.depth = 0
+	for i, key := range r.path {
+		if err := r.expect('{', r.path[:i]); err != nil {
+			return false, err
+		}
+		r.depth++
+		found := false
+		for !found && r.dec.More() {
+			tok, err := r.dec.Token()
+			if err != nil {
+				return false, err
+			}
+			if tok == key {
+				found = true
+				continue
+			}
+			if err := r.skip(); err != nil {
+				return false, err
+			}
+		}
+		if !found {
+			// consume the end of the current object and the ones around it
+			if _, err := r.dec.Token(); err != nil {
+				return false, err
+			}
+			return false, r.leave(r.depth - 1)
+		}
+	}
+	return true, r.expect('[', r.path)
+}
+
+// leave consumes the remaining keys of the objects entered to reach the array
+func (r *jsonReader) leave(depth int) error {
+	for ; depth > 0; depth-- {
+		for r.dec.More() {
+			if _, err := r.dec.Token(); err != nil {
+				return err
+			}
+			if err := r.skip(); err != nil {
+				return err
+			}
+		}
+		if _, err := r.dec.Token(); err != nil {
+			return err
+		}
+	}
+	r.depth = 0
+	return nil
+}
+
+func (r *jsonReader) skip() error {
+	var raw json.RawMessage
+	return r.dec.Decode(&raw)
+}
+
+func (r *jsonReader) expect(delim json.Delim, path []string) error {
+	tok, err := r.dec.Token()
+	if err != nil {
+		return err
+	}
+	if tok != delim {
+		kind := "an object"
+		if delim == '[' {
+			kind = "an array"
+		}
+		return fmt.Errorf("expecting %v at %v but got %v", kind, jsonPath(path), tok)
+	}
+	return nil
+}
+
+// jsonPath formats path like jq, eg.: .items.metadata
+func jsonPath(path []string) string {
+	return "." + strings.Join(path, ".")
+}
@@ -0,0 +1,404 @@
+package stdio
+
+import (
+	"bytes"
+	"encoding/json"
+	"io"
+	"sort"
+	"strings"
+	"text/tabwriter"
+
+	"github.com/dop251/goja"
+	"gopkg.in/yaml.v3"
+)
+
+type (
+	// writeOptions are accepted by every structured writer
+	writeOptions struct {
+		indent   int
+		sortKeys bool
+		stderr   bool
+		color    *bool
+	}
+)
+
+func (m *Module) defineWriters(exports *goja.Object, runtime *goja.Runtime) {
+	exports.Set("writeJSON", func(call goja.FunctionCall) goja.Value {
+		opts := parseWriteOptions(runtime, call.Argument(1), 2)
+		out := encodeJSON(runtime, call.Argument(0), opts)
+		m.write(runtime, opts, out, colorJSON)
+		return goja.Undefined()
+	})
+	exports.Set("writeNDJSON", func(call goja.FunctionCall) goja.Value {
+		opts := parseWriteOptions(runtime, call.Argument(1), 0)
+		opts.indent = 0
+		var out bytes.Buffer
+		iterate(runtime, call.Argument(0), func(v goja.Value) {
+			out.Write(encodeJSON(runtime, v, opts))
+		})
+		m.write(runtime, opts, out.Bytes(), colorJSON)
+		return goja.Undefined()
+	})
+	exports.Set("writeYAML", func(call goja.FunctionCall) goja.Value {
+		opts := parseWriteOptions(runtime, call.Argument(1), 2)
+		out, err := encodeYAML(stringify(runtime, call.Argument(0)), opts)
+		if err != nil {
+			panic(runtime.NewGoError(err))
+		}
+		m.write(runtime, opts, out, colorYAML)
+		return goja.Undefined()
+	})
+	exports.Set("writeTable", func(call goja.FunctionCall) goja.Value {
+		opts := parseWriteOptions(runtime, call.Argument(2), 0)
+		out := Table(runtime, call.Argument(0), call.Argument(1), opts.sortKeys)
+		m.write(runtime, opts, out, colorTable)
+		return goja.Undefined()
+	})
+}
+
+func parseWriteOptions(runtime *goja.Runtime, val goja.Value, indent int) writeOptions {
+	opts := writeOptions{indent: indent}
+	if goja.IsUndefined(val) || goja.IsNull(val) {
+		return opts
+	}
+	obj := val.ToObject(runtime)
+	if v := obj.Get("indent"); v != nil && !goja.IsUndefined(v) {
+		opts.indent = int(v.ToInteger())
+		if opts.indent < 0 || opts.indent > 16 {
+			panic(runtime.NewTypeError("indent must be between 0 and 16"))
+		}
+	}
+	if v := obj.Get("sortKeys"); v != nil {
+		opts.sortKeys = v.ToBoolean()
+	}
+	if v := obj.Get("stderr"); v != nil {
+		opts.stderr = v.ToBoolean()
+	}
+	if v := obj.Get("color"); v != nil && !goja.IsUndefined(v) {
+		color := v.ToBoolean()
+		opts.color = &color
+	}
+	return opts
+}
+
+// write out to stdout (or stderr), coloring it if the stream is a terminal
+func (m *Module) write(runtime *goja.Runtime, opts writeOptions, out []byte, colorize func([]byte) []byte) {
+	w := m.Stdout()
+	if opts.stderr {
+		w = m.Stderr()
+	}
+	color := m.Colors != nil && m.Colors(opts.stderr)
+	if opts.color != nil {
+		color = *opts.color
+	}
+	if color {
+		out = colorize(out)
+	}
+	if _, err := w.Write(out); err != nil {
+		panic(runtime.NewGoError(err))
+	}
+}
+
+// stringify returns the value encoded by JSON.stringify, so toJSON methods,
+// dates and values that cannot be represented (eg.: functions) are handled
+// exactly like in javascript
+func stringify(runtime *goja.Runtime, val goja.Value) []byte {
+	fn, ok := goja.AssertFunction(runtime.Get("JSON").ToObject(runtime).Get("stringify"))
+	if !ok {
+		panic(runtime.NewTypeError("JSON.stringify is not a function"))
+	}
+	res, err := fn(goja.Undefined(), val)
+	if err != nil {
+		panic(err)
+	}
+	if goja.IsUndefined(res) {
+		panic(runtime.NewTypeError("value cannot be encoded as JSON"))
+	}
+	return []byte(res.String())
+}
+
+// encodeJSON returns val encoded as JSON followed by a new line
+func encodeJSON(runtime *goja.Runtime, val goja.Value, opts writeOptions) []byte {
+	raw := stringify(runtime, val)
+	var out bytes.Buffer
+	if opts.sortKeys {
+		var v interface{}
+		dec := json.NewDecoder(bytes.NewReader(raw))
+		dec.UseNumber()
+		if err := dec.Decode(&v); err != nil {
+			panic(runtime.NewGoError(err))
+		}
+		enc := json.NewEncoder(&out)
+		enc.SetEscapeHTML(false)
+		enc.SetIndent("", strings.Repeat(" ", opts.indent))
+		if err := enc.Encode(v); err != nil {
+			panic(runtime.NewGoError(err))
+		}
+		return out.Bytes()
+	}
+	if opts.indent == 0 {
+		out.Write(raw)
+	} else if err := json.Indent(&out, raw, "", strings.Repeat(" ", opts.indent)); err != nil {
+		panic(runtime.NewGoError(err))
+	}
+	out.WriteByte('\n')
+	return out.Bytes()
+}
+
+// encodeYAML converts raw JSON to a YAML document, keys keep
+// the order they have in raw unless opts.sortKeys is set
+func encodeYAML(raw []byte, opts writeOptions) ([]byte, error) {
+	var doc yaml.Node
+	if err := yaml.Unmarshal(raw, &doc); err != nil {
+		return nil, err
+	}
+	blockStyle(&doc, opts.sortKeys)
+	var out bytes.Buffer
+	enc := yaml.NewEncoder(&out)
+	if opts.indent > 0 {
+		enc.SetIndent(opts.indent)
+	}
+	if err := enc.Encode(&doc); err != nil {
+		return nil, err
+	}
+	if err := enc.Close(); err != nil {
+		return nil, err
+	}
+	return out.Bytes(), nil
+}
+
+// blockStyle removes the JSON (flow) style from the nodes
+// decoded by yaml, so they are encoded as regular YAML
+func blockStyle(node *yaml.Node, sortKeys bool) {
+	if node.Kind == yaml.ScalarNode && node.Tag == "!!str" {
+		node.Style = 0
+	} else if node.Kind != yaml.ScalarNode {
+		node.Style = 0
+	}
+	if node.Kind == yaml.MappingNode && sortKeys {
+		pairs := make([][2]*yaml.Node, 0, len(node.Content)/2)
+		for i := 0; i+1 < len(node.Content); i += 2 {
+			pairs = append(pairs, [2]*yaml.Node{node.Content[i], node.Content[i+1]})
+		}
+		sort.SliceStable(pairs, func(i, j int) bool { return pairs[i][0].Value < pairs[j][0].Value })
+		node.Content = node.Content[:0]
+		for _, p := range pairs {
+			node.Content = append(node.Content, p[0], p[1])
+		}
+	}
+	for _, child := range node.Content {
+		blockStyle(child, sortKeys)
+	}
+}
+
+// iterate calls fn for every element of an array or iterable
+func iterate(runtime *goja.Runtime, val goja.Value, fn func(goja.Value)) {
+	obj, ok := val.(*goja.Object)
+	if !ok {
+		panic(runtime.NewTypeError("expecting an array or an iterable"))
+	}
+	iterFn, ok := goja.AssertFunction(obj.GetSymbol(goja.SymIterator))
+	if !ok {
+		panic(runtime.NewTypeError("expecting an array or an iterable"))
+	}
+	iter, err := iterFn(obj)
+	if err != nil {
+		panic(err)
+	}
+	next, ok := goja.AssertFunction(iter.ToObject(runtime).Get("next"))
+	if !ok {
+		panic(runtime.NewTypeError("iterator does not have a next method"))
+	}
+	for {
+		res, err := next(iter)
+		if err != nil {
+			panic(err)
+		}
+		resObj := res.ToObject(runtime)
+		if resObj.Get("done").ToBoolean() {
+			return
+		}
+		fn(resObj.Get("value"))
+	}
+}
+
+// Table writes rows (an array of objects) as aligned columns.
+//
+// columns is either undefined (every key found in rows, in the order they
+// first appear, or sorted with sortKeys), a list of keys or a list
+// of {key, title} objects.
+func Table(runtime *goja.Runtime, rowsVal goja.Value, columnsVal goja.Value, sortKeys bool) []byte {
+	var rows []*goja.Object
+	iterate(runtime, rowsVal, func(v goja.Value) {
+		obj, ok := v.(*goja.Object)
+		if !ok {
+			panic(runtime.NewTypeError("table rows must be objects"))
+		}
+		rows = append(rows, obj)
+	})
+	var keys, titles []string
+	if goja.IsUndefined(columnsVal) || goja.IsNull(columnsVal) {
+		seen := map[string]bool{}
+		for _, row := range rows {
+			for _, k := range row.Keys() {
+				if !seen[k] {
+					seen[k] = true
+					keys = append(keys, k)
+				}
+			}
+		}
+		if sortKeys {
+			sort.Strings(keys)
+		}
+		titles = keys
+	} else {
+		iterate(runtime, columnsVal, func(v goja.Value) {
+			if obj, ok := v.(*goja.Object); ok {
+				key := obj.Get("key")
+				if key == nil || goja.IsUndefined(key) {
+					panic(runtime.NewTypeError("table columns must have a key"))
+				}
+				title := obj.Get("title")
+				if title == nil || goja.IsUndefined(title) {
+					title = key
+				}
+				keys = append(keys, key.String())
+				titles = append(titles, title.String())
+				return
+			}
+			keys = append(keys, v.String())
+			titles = append(titles, v.String())
+		})
+	}
+	var out bytes.Buffer
+	tw := tabwriter.NewWriter(&out, 0, 0, 2, ' ', 0)
+	writeRow := func(cells []string) {
+		for i, c := range cells {
+			if i > 0 {
+				io.WriteString(tw, "\t")
+			}
+			io.WriteString(tw, strings.NewReplacer("\t", " ", "\n", " ").Replace(c))
+		}
+		io.WriteString(tw, "\n")
+	}
+	writeRow(titles)
+	for _, row := range rows {
+		cells := make([]string, len(keys))
+		for i, k := range keys {
+			cells[i] = cellText(runtime, row.Get(k))
+		}
+		writeRow(cells)
+	}
+	tw.Flush()
+	return out.Bytes()
+}
+
+// cellText returns strings as-is and any other value as JSON
+func cellText(runtime *goja.Runtime, v goja.Value) string {
+	if v == nil || goja.IsUndefined(v) || goja.IsNull(v) {
+		return ""
+	}
+	if s, ok := v.Export().(string); ok {
+		return s
+	}
+	if _, ok := goja.AssertFunction(v); ok {
+		return ""
+	}
+	return string(stringify(runtime, v))
+}
+
+const (
+	ansiReset  = "\x1b[0m"
+	ansiBold   = "\x1b[1m"
+	ansiKey    = "\x1b[34m"
+	ansiString = "\x1b[32m"
+	ansiNumber = "\x1b[36m"
+	ansiOther  = "\x1b[35m"
+)
+
+// colorJSON highlights keys, strings, numbers and literals of
+// valid JSON documents
+func colorJSON(in []byte) []byte {
+	var out bytes.Buffer
+	for i := 0; i < len(in); {
+		c := in[i]
+		switch {
+		case c == '"':
+			end := i + 1
+			for end < len(in) && in[end] != '"' {
+				if in[end] == '\\' {
+					end++
+				}
+				end++
+			}
+			end++
+			if end > len(in) {
+				end = len(in)
+			}
+			color := ansiString
+			rest := bytes.TrimLeft(in[end:], " \t\r\n")
+			if len(rest) > 0 && rest[0] == ':' {
+				color = ansiKey
+			}
+			out.WriteString(color)
+			out.Write(in[i:end])
+			out.WriteString(ansiReset)
+			i = end
+		case c == '-' || (c >= '0' && c <= '9'):
+			end := i + 1
+			for end < len(in) && strings.IndexByte("0123456789.eE+-", in[end]) >= 0 {
+				end++
+			}
+			out.WriteString(ansiNumber)
+			out.Write(in[i:end])
+			out.WriteString(ansiReset)
+			i = end
+		case c == 't' || c == 'f' || c == 'n':
+			end := i + 1
+			for end < len(in) && in[end] >= 'a' && in[end] <= 'z' {
+				end++
+			}
+			out.WriteString(ansiOther)
+			out.Write(in[i:end])
+			out.WriteString(ansiReset)
+			i = end
+		default:
+			out.WriteByte(c)
+			i++
+		}
+	}
+	return out.Bytes()
+}
+
+// colorYAML highlights the keys of mappings
+func colorYAML(in []byte) []byte {
+	lines := bytes.SplitAfter(in, []byte("\n"))
+	var out bytes.Buffer
+	for _, line := range lines {
+		trimmed := bytes.TrimLeft(line, " -")
+		prefix := line[:len(line)-len(trimmed)]
+		idx := bytes.Index(trimmed, []byte(": "))
+		if idx < 0 && bytes.HasSuffix(bytes.TrimRight(trimmed, "\n"), []byte(":")) {
+			idx = len(bytes.TrimRight(trimmed, "\n")) - 1
+		}
+		if idx <= 0 || trimmed[0] == '"' || trimmed[0] == '\'' {
+			out.Write(line)
+			continue
+		}
+		out.Write(prefix)
+		out.WriteString(ansiKey)
+		out.Write(trimmed[:idx])
+		out.WriteString(ansiReset)
+		out.Write(trimmed[idx:])
+	}
+	return out.Bytes()
+}
+
+// colorTable makes the header bold
+func colorTable(in []byte) []byte {
+	idx := bytes.IndexByte(in, '\n')
+	if idx < 0 {
+		return in
+	}
+	return []byte(ansiBold + string(in[:idx]) + ansiReset + string(in[idx:]))
+}
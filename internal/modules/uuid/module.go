@@ -4,6 +4,7 @@ import (
 	"crypto/rand"
 	"errors"
 	"io"
+	"sync"
 
 	"github.com/dop251/goja"
 	"github.com/google/uuid"
@@ -16,21 +17,39 @@ type (
 	}
 )
 
+var (
+	sharedRNG     fortuna.Fortuna
+	sharedRNGErr  error
+	sharedRNGOnce sync.Once
+)
+
+// DefineModule exposes the v4/v5 functions. Fortuna is thread-safe, so all engines
+// share a single generator that is seeded only once per process, which keeps
+// engine creation cheap.
 func (m *Module) DefineModule(exports *goja.Object, runtime *goja.Runtime) error {
-	var seed [128]byte
-	_, err := io.ReadFull(rand.Reader, seed[:])
-	if err != nil {
-		return err
-	}
-	m.rng, err = fortuna.NewFortuna(seed[:])
-	if err != nil {
-		return err
+	if m.rng == nil {
+		sharedRNGOnce.Do(func() {
+			sharedRNG, sharedRNGErr = newRNG()
+		})
+		if sharedRNGErr != nil {
+			return sharedRNGErr
+		}
+		m.rng = sharedRNG
 	}
 	exports.Set("v4", m.newv4(runtime))
 	exports.Set("v5", newv5(runtime))
 	return nil
 }
 
+func newRNG() (fortuna.Fortuna, error) {
+	var seed [128]byte
+	_, err := io.ReadFull(rand.Reader, seed[:])
+	if err != nil {
+		return nil, err
+	}
+	return fortuna.NewFortuna(seed[:])
+}
+
 func (m *Module) newv4(runtime *goja.Runtime) func(goja.FunctionCall) goja.Value {
 	return func(fc goja.FunctionCall) goja.Value {
 		id, err := uuid.NewRandomFromReader(m.rng)
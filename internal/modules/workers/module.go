@@ -0,0 +1,240 @@
+package workers
+
+import (
+	"errors"
+	"fmt"
+	"runtime"
+	"sort"
+	"strconv"
+	"sync"
+
+	"github.com/andrebq/jtb/internal/modules/modutils"
+	"github.com/dop251/goja"
+)
+
+type (
+	// Worker runs functions exported by modules in a separated engine.
+	//
+	// A worker is used by a single goroutine at a time.
+	Worker interface {
+		// Call the function fn exported by module, arg and the returned value
+		// must contain only values accepted by Clone.
+		Call(module string, fn string, arg interface{}) (interface{}, error)
+		Close() error
+	}
+
+	Module struct {
+		// Spawn a new worker with the same configuration of the engine
+		// that defined this module
+		Spawn func() (Worker, error)
+		Loop  modutils.Loop
+
+		// MaxWorkers limits how many workers a single call can use,
+		// if zero, runtime.NumCPU is used.
+		MaxWorkers int
+	}
+
+	mapCall struct {
+		items   []interface{}
+		module  string
+		fn      string
+		workers int
+	}
+)
+
+func (m *Module) DefineModule(exports *goja.Object, runtime *goja.Runtime) error {
+	exports.Set("map", func(fc goja.FunctionCall) goja.Value {
+		call := m.parseMapCall(runtime, fc)
+		results, err := m.run(call)
+		if err != nil {
+			panic(runtime.NewGoError(err))
+		}
+		return ToJS(runtime, results)
+	})
+	exports.Set("mapAsync", func(fc goja.FunctionCall) goja.Value {
+		call := m.parseMapCall(runtime, fc)
+		return m.Loop.Async(func() modutils.Settle {
+			results, err := m.run(call)
+			return func() (goja.Value, error) {
+				if err != nil {
+					return nil, err
+				}
+				return ToJS(runtime, results), nil
+			}
+		})
+	})
+	return nil
+}
+
+func (m *Module) parseMapCall(runtime *goja.Runtime, fc goja.FunctionCall) *mapCall {
+	items, err := Clone(fc.Argument(0).Export())
+	if err != nil {
+		panic(runtime.NewGoError(err))
+	}
+	list, ok := items.([]interface{})
+	if !ok {
+		panic(runtime.NewTypeError("items must be an array"))
+	}
+	call := &mapCall{
+		items:   list,
+		module:  fc.Argument(1).String(),
+		fn:      fc.Argument(2).String(),
+		workers: m.maxWorkers(),
+	}
+	if opts := fc.Argument(3); !goja.IsUndefined(opts) && !goja.IsNull(opts) {
+		if n := opts.ToObject(runtime).Get("workers"); n != nil && !goja.IsUndefined(n) {
+			call.workers = int(n.ToInteger())
+		}
+	}
+	if call.workers <= 0 {
+		panic(runtime.NewTypeError("workers must be a positive number"))
+	}
+	if call.workers > m.maxWorkers() {
+		call.workers = m.maxWorkers()
+	}
+	if call.workers > len(call.items) {
+		call.workers = len(call.items)
+	}
+	return call
+}
+
+func (m *Module) maxWorkers() int {
+	if m.MaxWorkers > 0 {
+		return m.MaxWorkers
+	}
+	return runtime.NumCPU()
+}
+
+// run distributes items among the workers, results are kept in the
+// same order as the items
+func (m *Module) run(call *mapCall) ([]interface{}, error) {
+	results := make([]interface{}, len(call.items))
+	if len(call.items) == 0 {
+		return results, nil
+	}
+
+	var workers []Worker
+	defer func() {
+		for _, w := range workers {
+			w.Close()
+		}
+	}()
+	for i := 0; i < call.workers; i++ {
+		w, err := m.Spawn()
+		if err != nil {
+			return nil, fmt.Errorf("unable to start worker: %w", err)
+		}
+		workers = append(workers, w)
+	}
+
+	var (
+		wg       sync.WaitGroup
+		errOnce  sync.Once
+		firstErr error
+		failed   = make(chan struct{})
+		next     = make(chan int)
+	)
+	for _, w := range workers {
+		wg.Add(1)
+		go func(w Worker) {
+			defer wg.Done()
+			for idx := range next {
+				res, err := w.Call(call.module, call.fn, call.items[idx])
+				if err != nil {
+					errOnce.Do(func() {
+						firstErr = fmt.Errorf("item %v failed: %w", idx, err)
+						close(failed)
+					})
+					return
+				}
+				results[idx] = res
+			}
+		}(w)
+	}
+dispatch:
+	for idx := range call.items {
+		select {
+		case next <- idx:
+		case <-failed:
+			break dispatch
+		}
+	}
+	close(next)
+	wg.Wait()
+	if firstErr != nil {
+		return nil, firstErr
+	}
+	return results, nil
+}
+
+// Clone returns a deep copy of v, only JSON compatible values and
+// byte arrays can be copied, anything else returns an error.
+func Clone(v interface{}) (interface{}, error) {
+	switch v := v.(type) {
+	case nil, bool, string, int64, float64:
+		return v, nil
+	case int:
+		return int64(v), nil
+	case []byte:
+		return append([]byte(nil), v...), nil
+	case goja.ArrayBuffer:
+		return append([]byte(nil), v.Bytes()...), nil
+	case []interface{}:
+		out := make([]interface{}, len(v))
+		for i, item := range v {
+			var err error
+			out[i], err = Clone(item)
+			if err != nil {
+				return nil, fmt.Errorf("[%v]: %w", i, err)
+			}
+		}
+		return out, nil
+	case map[string]interface{}:
+		out := make(map[string]interface{}, len(v))
+		for k, item := range v {
+			var err error
+			out[k], err = Clone(item)
+			if err != nil {
+				return nil, fmt.Errorf("%v: %w", strconv.Quote(k), err)
+			}
+		}
+		return out, nil
+	}
+	return nil, errUnsupportedValue(v)
+}
+
+// ToJS converts a value returned by Clone to plain javascript values,
+// byte arrays are converted to ArrayBuffers.
+func ToJS(runtime *goja.Runtime, v interface{}) goja.Value {
+	switch v := v.(type) {
+	case []byte:
+		return runtime.ToValue(runtime.NewArrayBuffer(v))
+	case []interface{}:
+		items := make([]interface{}, len(v))
+		for i, item := range v {
+			items[i] = ToJS(runtime, item)
+		}
+		return runtime.NewArray(items...)
+	case map[string]interface{}:
+		// go maps have no order, sorting keeps
+		// the output deterministic
+		keys := make([]string, 0, len(v))
+		for k := range v {
+			keys = append(keys, k)
+		}
+		sort.Strings(keys)
+		obj := runtime.NewObject()
+		for _, k := range keys {
+			obj.Set(k, ToJS(runtime, v[k]))
+		}
+		return obj
+	}
+	return runtime.ToValue(v)
+}
+
+func errUnsupportedValue(v interface{}) error {
+	if _, ok := v.(func(goja.FunctionCall) goja.Value); ok {
+		return errors.New("functions cannot be sent to workers")
+	}
+	return fmt.Errorf("values of type %T cannot be sent to workers", v)
+}